@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// cacheHandler drops cached query results and rendered responses, of all
+// targets or of the one given with ?target=, so the next probe evaluates
+// against the upstream again
+func cacheHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var response struct {
+			Queries   int `json:"queries"`
+			Responses int `json:"responses"`
+		}
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			response.Queries = queryCache.Flush()
+			response.Responses = responseCache.Flush()
+		} else {
+			if _, exists := config.Targets[target]; !exists {
+				http.Error(w, "Target not found", http.StatusNotFound)
+				return
+			}
+			response.Queries = queryCache.Namespace(target).Flush()
+			response.Responses = responseCache.Namespace(target).Flush()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
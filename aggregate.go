@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// validateAggregate checks a target with aggregate_of, which has no
+// datasource or rules of its own
+func validateAggregate(config Config, name string, group Group) error {
+	if group.Type != "" || group.Endpoint != "" || len(group.Rules) > 0 {
+		return fmt.Errorf("aggregate targets have no type, endpoint or rules")
+	}
+	switch group.Aggregate {
+	case "", "sum", "avg":
+	default:
+		return fmt.Errorf("unknown aggregate %q, expected sum or avg", group.Aggregate)
+	}
+	for _, member := range group.AggregateOf {
+		memberGroup, exists := config.Targets[member]
+		if !exists {
+			return fmt.Errorf("unknown target %q in aggregate_of", member)
+		}
+		if len(memberGroup.AggregateOf) > 0 {
+			return fmt.Errorf("aggregate_of target %s is an aggregate itself", member)
+		}
+		if memberGroup.Tenant != group.Tenant {
+			return fmt.Errorf("aggregate_of target %s belongs to another tenant", member)
+		}
+	}
+	return nil
+}
+
+// aggregateEvaluation merges the evaluations of the members of an aggregate
+// target. Without aggregate the series of the members are kept apart by a
+// target label, with sum or avg the values of series with the same name and
+// labels are combined, leaving out histograms and summaries.
+func aggregateEvaluation(group Group, evaluate func(member string) evaluation) evaluation {
+	eval := evaluation{Time: time.Now()}
+	type combined struct {
+		sample Sample
+		count  int
+	}
+	var order []string
+	series := map[string]*combined{}
+	// Samples of one name need the same help in the exposition
+	help := map[string]string{}
+
+	for _, member := range group.AggregateOf {
+		memberEval := evaluate(member)
+		for _, ruleErr := range memberEval.Errors {
+			eval.Errors = append(eval.Errors, RuleError{Rule: member + "/" + ruleErr.Rule, Error: ruleErr.Error})
+		}
+
+		for _, sample := range memberEval.Samples {
+			if h, exists := help[sample.Name]; exists {
+				sample.Help = h
+			} else {
+				help[sample.Name] = sample.Help
+			}
+			if group.Aggregate == "" {
+				labels := make(prometheus.Labels, len(sample.Labels)+1)
+				for k, v := range sample.Labels {
+					labels[k] = v
+				}
+				if v, exists := labels["target"]; exists {
+					labels["exported_target"] = v
+				}
+				labels["target"] = member
+				sample.Labels = labels
+				eval.Samples = append(eval.Samples, sample)
+				continue
+			}
+
+			if sample.Histogram != nil || sample.Summary != nil || sample.NativeHistogram != nil {
+				continue
+			}
+			key := sample.Name + formatLabels(sample.Labels)
+			if c, exists := series[key]; exists {
+				c.sample.Value += sample.Value
+				c.count++
+				continue
+			}
+			series[key] = &combined{sample: sample, count: 1}
+			order = append(order, key)
+		}
+	}
+
+	for _, key := range order {
+		c := series[key]
+		if group.Aggregate == "avg" {
+			c.sample.Value /= float64(c.count)
+		}
+		eval.Samples = append(eval.Samples, c.sample)
+	}
+	return eval
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// probeAuth holds the credentials accepted by the protected endpoints
+type probeAuth struct {
+	bearerToken string
+	users       map[string]string // user name -> htpasswd hash
+	verified    sync.Map          // digests of basic auth credentials that passed bcrypt
+}
+
+// loadProbeAuth reads the bearer token and htpasswd files. It returns nil if
+// neither is configured.
+func loadProbeAuth(tokenFile, htpasswdFile string) (*probeAuth, error) {
+	if tokenFile == "" && htpasswdFile == "" {
+		return nil, nil
+	}
+
+	auth := &probeAuth{}
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.bearerToken = strings.TrimSpace(string(data))
+		if auth.bearerToken == "" {
+			return nil, fmt.Errorf("%s: empty bearer token", tokenFile)
+		}
+	}
+
+	if htpasswdFile != "" {
+		users, err := loadHtpasswd(htpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.users = users
+	}
+	return auth, nil
+}
+
+// loadHtpasswd reads a htpasswd file with bcrypt or {SHA} hashes
+func loadHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: only bcrypt and {SHA} hashes are supported", file, line)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// wrap requires valid credentials for h. A nil probeAuth allows everything.
+func (a *probeAuth) wrap(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if a.users != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="rules_exporter"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *probeAuth) authorized(r *http.Request) bool {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && a.bearerToken != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(a.bearerToken)) == 1
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok || a.users == nil {
+		return false
+	}
+	hash, exists := a.users[user]
+	if !exists {
+		return false
+	}
+
+	if sha, found := strings.CutPrefix(hash, "{SHA}"); found {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(sha)) == 1
+	}
+
+	// bcrypt is deliberately slow, so remember credentials that passed
+	digest := sha256.Sum256([]byte(user + ":" + password + ":" + hash))
+	if _, seen := a.verified.Load(digest); seen {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	a.verified.Store(digest, true)
+	return true
+}
+
+// checkProbeToken verifies the probe token of a target, sent as bearer token
+// or, if the bearer token is already used for --web.auth.bearer-token-file,
+// in the X-Probe-Token header. It writes an error response and returns false
+// if the token is missing or wrong.
+func checkProbeToken(w http.ResponseWriter, r *http.Request, group Group) bool {
+	if group.ProbeToken == "" {
+		return true
+	}
+
+	token := requestProbeToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing probe token", http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(group.ProbeToken)) != 1 {
+		http.Error(w, "Invalid probe token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// probeAllowed reports whether the request has the probe token of the group,
+// if it needs one
+func probeAllowed(r *http.Request, group Group) bool {
+	if group.ProbeToken == "" {
+		return true
+	}
+	token := requestProbeToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(group.ProbeToken)) == 1
+}
+
+func requestProbeToken(r *http.Request) string {
+	token := r.Header.Get("X-Probe-Token")
+	if token == "" {
+		// Other schemes, like Basic for --web.auth.htpasswd-file, carry
+		// no probe token
+		if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			token = bearer
+		}
+	}
+	return token
+}
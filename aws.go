@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials sign requests to AWS APIs
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time
+}
+
+// AWSAuth are the credentials of AWS datasources. Without access keys the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables are used. With a role ARN the credentials assume that role.
+type AWSAuth struct {
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	SessionToken    string `yaml:"session_token,omitempty"`
+	RoleARN         string `yaml:"role_arn,omitempty"`
+	ExternalID      string `yaml:"external_id,omitempty"`
+	// STSEndpoint assumes roles, https://sts.<region>.amazonaws.com by default
+	STSEndpoint string `yaml:"sts_endpoint,omitempty"`
+}
+
+func (a AWSAuth) validate() error {
+	if a.Region == "" {
+		return fmt.Errorf("no region")
+	}
+	if (a.AccessKeyID == "") != (a.SecretAccessKey == "") {
+		return fmt.Errorf("access_key_id and secret_access_key must be given together")
+	}
+	if a.STSEndpoint != "" {
+		return validateEndpoint(a.STSEndpoint)
+	}
+	return nil
+}
+
+var (
+	awsRolesMu sync.Mutex
+	awsRoles   = map[string]awsCredentials{}
+)
+
+// credentials returns the credentials to sign requests with, assuming the
+// role if there is one. Role credentials are reused until a minute before
+// they expire.
+func (a AWSAuth) credentials(ctx context.Context, client *http.Client) (awsCredentials, error) {
+	base := awsCredentials{accessKeyID: a.AccessKeyID, secretAccessKey: a.SecretAccessKey, sessionToken: a.SessionToken}
+	if base.accessKeyID == "" {
+		base = awsCredentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if base.accessKeyID == "" || base.secretAccessKey == "" {
+			return awsCredentials{}, fmt.Errorf("no AWS credentials configured or in the environment")
+		}
+	}
+	if a.RoleARN == "" {
+		return base, nil
+	}
+
+	key := strings.Join([]string{a.Region, a.STSEndpoint, a.RoleARN, a.ExternalID, base.accessKeyID}, " ")
+	awsRolesMu.Lock()
+	creds, exists := awsRoles[key]
+	awsRolesMu.Unlock()
+	if exists && time.Until(creds.expires) > time.Minute {
+		return creds, nil
+	}
+
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {a.RoleARN},
+		"RoleSessionName": {"rules_exporter"},
+	}
+	if a.ExternalID != "" {
+		form.Set("ExternalId", a.ExternalID)
+	}
+	endpoint := a.STSEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", a.Region)
+	}
+	body, err := awsPost(ctx, client, endpoint, a.Region, "sts", base, form)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assume role %s: %w", a.RoleARN, err)
+	}
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil || response.Credentials.AccessKeyID == "" {
+		return awsCredentials{}, fmt.Errorf("assume role %s: %w", a.RoleARN, &parseError{fmt.Errorf("no credentials in response")})
+	}
+	creds = awsCredentials{
+		accessKeyID:     response.Credentials.AccessKeyID,
+		secretAccessKey: response.Credentials.SecretAccessKey,
+		sessionToken:    response.Credentials.SessionToken,
+		expires:         response.Credentials.Expiration,
+	}
+	awsRolesMu.Lock()
+	awsRoles[key] = creds
+	awsRolesMu.Unlock()
+	return creds, nil
+}
+
+// awsPost calls an action of an AWS query protocol API
+func awsPost(ctx context.Context, client *http.Client, endpoint, region, service string, creds awsCredentials, form url.Values) ([]byte, error) {
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, payload, creds, region, service, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var response struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(body, &response) == nil && response.Code != "" {
+			return nil, responseError(resp.StatusCode, []byte(response.Code+": "+response.Message))
+		}
+		return nil, responseError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// signAWSRequest adds a Signature Version 4 authorization to a request
+func signAWSRequest(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// Query values are sorted by Encode, which escapes them like AWS expects
+	// except for spaces
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AzureMonitorConfig configures the azure_monitor datasource, which queries
+// Azure Monitor Metrics with the credentials of an app registration. The
+// expression of a rule is the metric name.
+type AzureMonitorConfig struct {
+	TenantID     string `yaml:"tenant_id"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// AuthorityHost issues the tokens, https://login.microsoftonline.com by
+	// default
+	AuthorityHost string `yaml:"authority_host,omitempty"`
+	// SubscriptionID and ResourceGroup scope the resources of the rules
+	// given without a full resource ID
+	SubscriptionID string `yaml:"subscription_id,omitempty"`
+	ResourceGroup  string `yaml:"resource_group,omitempty"`
+	// Resource is the resource of rules without resource of their own
+	Resource string `yaml:"resource,omitempty"`
+}
+
+// AzureMetric selects what a rule of an azure_monitor target queries
+type AzureMetric struct {
+	// Resource is a resource ID, or a path like
+	// providers/Microsoft.Compute/virtualMachines/vm1 in the resource group
+	Resource string `yaml:"resource,omitempty"`
+	// Namespace is the metric namespace, the resource's default if empty
+	Namespace string `yaml:"namespace,omitempty"`
+	// Aggregation is Average (default), Total, Minimum, Maximum or Count
+	Aggregation string `yaml:"aggregation,omitempty"`
+	// Interval is the time grain of the data points, 1m by default
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Filter selects and splits the dimensions, e.g. "LUN eq '*'". Every
+	// dimension becomes a label.
+	Filter string `yaml:"filter,omitempty"`
+}
+
+const (
+	defaultAzureAuthorityHost = "https://login.microsoftonline.com"
+	defaultAzureEndpoint      = "https://management.azure.com"
+	azureMetricsAPIVersion    = "2023-10-01"
+)
+
+// azureIntervals are the time grains supported by Azure Monitor
+var azureIntervals = map[time.Duration]string{
+	time.Minute:      "PT1M",
+	5 * time.Minute:  "PT5M",
+	15 * time.Minute: "PT15M",
+	30 * time.Minute: "PT30M",
+	time.Hour:        "PT1H",
+	6 * time.Hour:    "PT6H",
+	12 * time.Hour:   "PT12H",
+	24 * time.Hour:   "P1D",
+}
+
+func init() {
+	datasourceTypes["azure_monitor"] = newAzureDatasource
+	defaultEndpoints["azure_monitor"] = func(Group) string { return defaultAzureEndpoint }
+}
+
+type azureDatasource struct {
+	group  Group
+	config AzureMonitorConfig
+}
+
+func newAzureDatasource(group Group) (Datasource, error) {
+	c := group.AzureMonitor
+	if c == nil || c.TenantID == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return nil, fmt.Errorf("azure_monitor targets need tenant_id, client_id and client_secret")
+	}
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		metric := AzureMetric{}
+		if rule.Azure != nil {
+			metric = *rule.Azure
+		}
+		if metric.Resource == "" && c.Resource == "" {
+			return nil, fmt.Errorf("rule %s: no resource", ruleID(rule))
+		}
+		switch metric.Aggregation {
+		case "", "Average", "Total", "Minimum", "Maximum", "Count":
+		default:
+			return nil, fmt.Errorf("rule %s: unknown aggregation %q", ruleID(rule), metric.Aggregation)
+		}
+		if _, exists := azureIntervals[metric.Interval]; metric.Interval != 0 && !exists {
+			return nil, fmt.Errorf("rule %s: interval %s is not supported by Azure Monitor", ruleID(rule), metric.Interval)
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return nil, fmt.Errorf("rule %s: azure_monitor targets only support gauge and counter rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: azure_monitor targets don't support join", ruleID(rule))
+		}
+	}
+	return azureDatasource{group: group, config: *c}, nil
+}
+
+// resourceID returns the full ID of a resource of a rule
+func (a azureDatasource) resourceID(resource string) string {
+	if resource == "" {
+		resource = a.config.Resource
+	}
+	if strings.HasPrefix(resource, "/") {
+		return resource
+	}
+	scope := "/subscriptions/" + a.config.SubscriptionID
+	if a.config.ResourceGroup != "" {
+		scope += "/resourceGroups/" + a.config.ResourceGroup
+	}
+	return scope + "/" + resource
+}
+
+func (a azureDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return a.QueryRule(ctx, Rule{}, expr, at)
+}
+
+func (a azureDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	metric := AzureMetric{}
+	if rule.Azure != nil {
+		metric = *rule.Azure
+	}
+	if metric.Aggregation == "" {
+		metric.Aggregation = "Average"
+	}
+	if metric.Interval == 0 {
+		metric.Interval = time.Minute
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	client, err := clientFor(a.group)
+	if err != nil {
+		return nil, err
+	}
+	authority := a.config.AuthorityHost
+	if authority == "" {
+		authority = defaultAzureAuthorityHost
+	}
+	endpoint := strings.TrimSuffix(groupEndpoint(a.group), "/")
+	token, err := clientCredentialsToken(ctx, client,
+		fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), url.PathEscape(a.config.TenantID)),
+		a.config.ClientID, a.config.ClientSecret, endpoint+"/.default")
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask for a few intervals to get the latest complete data point
+	params := url.Values{
+		"api-version": {azureMetricsAPIVersion},
+		"metricnames": {expr},
+		"aggregation": {metric.Aggregation},
+		"interval":    {azureIntervals[metric.Interval]},
+		"timespan":    {at.Add(-3*metric.Interval).UTC().Format(time.RFC3339) + "/" + at.UTC().Format(time.RFC3339)},
+	}
+	if metric.Namespace != "" {
+		params.Set("metricnamespace", metric.Namespace)
+	}
+	if metric.Filter != "" {
+		params.Set("$filter", metric.Filter)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		endpoint+a.resourceID(metric.Resource)+"/providers/Microsoft.Insights/metrics?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+	return parseAzureResponse(body, strings.ToLower(metric.Aggregation))
+}
+
+// parseAzureResponse returns the latest data point of every time series,
+// with its dimensions as labels
+func parseAzureResponse(body []byte, aggregation string) ([]map[string]interface{}, error) {
+	var response struct {
+		Value []struct {
+			Timeseries []struct {
+				Metadatavalues []struct {
+					Name struct {
+						Value string `json:"value"`
+					} `json:"name"`
+					Value string `json:"value"`
+				} `json:"metadatavalues"`
+				Data []map[string]interface{} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, &parseError{err}
+	}
+
+	var results []map[string]interface{}
+	for _, metric := range response.Value {
+		for _, series := range metric.Timeseries {
+			var value float64
+			found := false
+			for _, point := range series.Data {
+				if v, ok := point[aggregation].(float64); ok {
+					value, found = v, true
+				}
+			}
+			if !found {
+				continue
+			}
+			result := map[string]interface{}{"value": strconv.FormatFloat(value, 'g', -1, 64)}
+			for _, dimension := range series.Metadatavalues {
+				if dimension.Value != "" {
+					result[sanitizeLabelName(dimension.Name.Value)] = dimension.Value
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
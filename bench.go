@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult is what benchCommand measured for one rule
+type benchResult struct {
+	rule     string
+	series   int
+	bytes    int // -1 for datasources whose responses aren't measured
+	min, max time.Duration
+	total    time.Duration
+	runs     int
+	errors   int
+	lastErr  error
+}
+
+// benchCommand runs the expression of every rule of a target several times
+// against its endpoint, bypassing the cache, and prints the latency, size of
+// the response and number of series of each, slowest first. Rules that are
+// slow or return many series are candidates for native recording rules
+// upstream. Compute rules don't query and are left out.
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := configFlags(fs)
+	target := fs.String("target", "", "Target whose rules are measured.")
+	iterations := fs.Int("iterations", 10, "Number of times every rule is queried.")
+	fs.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("--target is required")
+	}
+	if *iterations < 1 {
+		return fmt.Errorf("--iterations must be at least 1")
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	group, exists := config.Targets[*target]
+	if !exists {
+		return fmt.Errorf("target %q not found", *target)
+	}
+	if len(group.AggregateOf) > 0 {
+		return fmt.Errorf("target %q is an aggregate, bench its members", *target)
+	}
+	datasource, err := newDatasource(group)
+	if err != nil {
+		return err
+	}
+	_, prometheus := datasource.(prometheusDatasource)
+
+	var results []benchResult
+	for _, rule := range queryRules(group.Rules) {
+		result := benchResult{rule: ruleID(rule), bytes: -1}
+		for i := 0; i < *iterations; i++ {
+			at := queryTime(rule)
+			start := time.Now()
+			var series, bytes int
+			if prometheus {
+				var body []byte
+				body, err = fetchQuery(context.Background(), group, rule.Expr, at)
+				if err == nil {
+					bytes = len(body)
+					var parsed []map[string]interface{}
+					parsed, _, err = parseQueryResponse(body)
+					series = len(parsed)
+				}
+			} else {
+				var parsed []map[string]interface{}
+				parsed, err = queryRule(context.Background(), datasource, rule, rule.Expr, at)
+				series = len(parsed)
+			}
+			duration := time.Since(start)
+			if err != nil {
+				result.errors++
+				result.lastErr = err
+				continue
+			}
+			if result.runs == 0 || duration < result.min {
+				result.min = duration
+			}
+			if duration > result.max {
+				result.max = duration
+			}
+			result.total += duration
+			result.runs++
+			result.series = series
+			if prometheus {
+				result.bytes = bytes
+			}
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].average() > results[j].average()
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tSERIES\tBYTES\tMIN\tAVG\tMAX\tERRORS")
+	var total time.Duration
+	for _, r := range results {
+		if r.runs == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%d\n", r.rule, r.errors)
+			continue
+		}
+		bytes := "-"
+		if r.bytes >= 0 {
+			bytes = fmt.Sprint(r.bytes)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%d\n", r.rule, r.series, bytes,
+			roundDuration(r.min), roundDuration(r.average()), roundDuration(r.max), r.errors)
+		total += r.average()
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d rules, %s per evaluation of the target on average\n", len(results), roundDuration(total))
+	for _, r := range results {
+		if r.lastErr != nil {
+			fmt.Printf("%s failed %d of %d times: %v\n", r.rule, r.errors, *iterations, r.lastErr)
+		}
+	}
+	return nil
+}
+
+func (r benchResult) average() time.Duration {
+	if r.runs == 0 {
+		return 0
+	}
+	return r.total / time.Duration(r.runs)
+}
+
+// roundDuration rounds a duration to a precision that is easy to compare
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// timeoutOffset is subtracted from the scrape timeout of probes, set by
+// --web.timeout-offset
+var timeoutOffset = 500 * time.Millisecond
+
+// errRuleBudget is the cause of the context of a rule that ran out of its
+// share of the probe deadline
+var errRuleBudget = errors.New("rule budget exceeded")
+
+// probeContext returns the context of a probe, which has a deadline if the
+// scraper sent its timeout in X-Prometheus-Scrape-Timeout-Seconds
+func probeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - timeoutOffset
+	return context.WithTimeout(r.Context(), max(timeout, 0))
+}
+
+// ruleContext returns the context for evaluating the first of rules, the
+// rules of a target not evaluated yet in the order of prioritizedRules. With
+// a deadline every rule gets a share of the remaining time by its
+// budget_weight, so a slow rule can't take the time of the others. Rules
+// only share with those of the same priority, rules of a lower priority get
+// the time left. Time left by faster rules goes to the following ones.
+func ruleContext(ctx context.Context, rules []Rule) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || rules[0].Compute != nil {
+		// Compute rules don't query, they take no share
+		return ctx, func() {}
+	}
+	total := 0.0
+	for _, rule := range rules {
+		if rule.Priority == rules[0].Priority && rule.Compute == nil {
+			total += budgetWeight(rule)
+		}
+	}
+	remaining := time.Until(deadline)
+	budget := time.Duration(float64(remaining) * budgetWeight(rules[0]) / total)
+	return context.WithDeadlineCause(ctx, time.Now().Add(budget), errRuleBudget)
+}
+
+// prioritizedRules returns the rules in the order they are evaluated,
+// higher priorities first and otherwise as configured, except that the
+// rules compute rules depend on come before them
+func prioritizedRules(rules []Rule) []Rule {
+	sorted := slices.Clone(rules)
+	slices.SortStableFunc(sorted, func(a, b Rule) int { return cmp.Compare(b.Priority, a.Priority) })
+	return dependencyOrder(sorted)
+}
+
+func budgetWeight(rule Rule) float64 {
+	if rule.BudgetWeight > 0 {
+		return rule.BudgetWeight
+	}
+	return 1
+}
@@ -1,65 +1,381 @@
 package cache
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultShards is the number of shards of a cache created with NewCache
+const DefaultShards = 16
+
 // CacheItem represents a single item in the cache
 type CacheItem struct {
 	Value      interface{}
 	Expiration int64
+
+	added int64 // unix nano time the item was stored
+	size  int64 // estimated size in bytes, if the cache is limited
 }
 
-// Cache represents the cache structure
+// Cache represents the cache structure. Items are spread over shards by key
+// hash, each with its own lock.
 type Cache struct {
-	items map[string]CacheItem
-	mu    sync.RWMutex
+	shards []*shard
+
+	hooksMu sync.RWMutex
+	onEvict []func(key string, value interface{})
+
+	limitMu  sync.Mutex // held while shrinking the cache
+	maxBytes int64
+	sizeOf   func(key string, value interface{}) int64
+	bytes    atomic.Int64
+
+	janitorMu sync.Mutex
+	stop      chan struct{} // closed to stop the janitor
+	stopped   chan struct{} // closed when the janitor has returned
 }
 
-// NewCache creates a new cache
+// shard holds the items whose key hashes to it
+type shard struct {
+	items   map[string]CacheItem
+	loading map[string]*load
+	mu      sync.RWMutex
+}
+
+// load is a running Fetch loader that other callers of the key wait for
+type load struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewCache creates a new cache with DefaultShards shards
 func NewCache() *Cache {
-	return &Cache{
-		items: make(map[string]CacheItem),
+	return NewShardedCache(DefaultShards)
+}
+
+// NewShardedCache creates a new cache with the given number of shards, at
+// least one
+func NewShardedCache(shards int) *Cache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &Cache{shards: make([]*shard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			items:   make(map[string]CacheItem),
+			loading: make(map[string]*load),
+		}
+	}
+	return c
+}
+
+func (c *Cache) shard(key string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// OnEvict registers a function that is called with every item removed by
+// Delete, DeleteFunc, Flush, Cleanup or the size limit. It is called without holding the
+// cache lock, so it may use the cache.
+func (c *Cache) OnEvict(f func(key string, value interface{})) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onEvict = append(c.onEvict, f)
+}
+
+// evicted calls the eviction hooks for the removed items
+func (c *Cache) evicted(items map[string]CacheItem) {
+	if len(items) == 0 {
+		return
+	}
+	c.hooksMu.RLock()
+	hooks := c.onEvict
+	c.hooksMu.RUnlock()
+	for key, item := range items {
+		for _, f := range hooks {
+			f(key, item.Value)
+		}
 	}
 }
 
 // Set adds an item to the cache with a specified duration
 func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.items[key] = CacheItem{
+	s := c.shard(key)
+	s.mu.Lock()
+	c.store(s, key, value, duration)
+	s.mu.Unlock()
+	c.limit()
+}
+
+// store adds an item to a locked shard and accounts for its size
+func (c *Cache) store(s *shard, key string, value interface{}, duration time.Duration) {
+	now := time.Now()
+	item := CacheItem{
 		Value:      value,
-		Expiration: time.Now().Add(duration).UnixNano(),
+		Expiration: now.Add(duration).UnixNano(),
+		added:      now.UnixNano(),
+	}
+	if c.sizeOf != nil {
+		item.size = c.sizeOf(key, value)
+	}
+	c.bytes.Add(item.size - s.items[key].size)
+	s.items[key] = item
+}
+
+// SetMaxBytes limits the total size of the items, estimated by sizeOf. When
+// the limit is exceeded, expired items and then the oldest items are removed
+// until the cache is below 90% of the limit. It must be called before the
+// cache is used. A limit of 0 disables it.
+func (c *Cache) SetMaxBytes(max int64, sizeOf func(key string, value interface{}) int64) {
+	c.maxBytes = max
+	c.sizeOf = sizeOf
+}
+
+// Bytes returns the estimated total size of the items, or 0 without a limit
+func (c *Cache) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+// limit shrinks the cache if it grew above the limit
+func (c *Cache) limit() {
+	if c.maxBytes <= 0 || c.bytes.Load() <= c.maxBytes {
+		return
+	}
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	if c.bytes.Load() <= c.maxBytes {
+		return
+	}
+
+	type candidate struct {
+		key   string
+		shard *shard
+		item  CacheItem
+	}
+	var candidates []candidate
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for key, item := range s.items {
+			candidates = append(candidates, candidate{key, s, item})
+		}
+		s.mu.RUnlock()
 	}
+	now := time.Now().UnixNano()
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].item, candidates[j].item
+		if expiredA, expiredB := now > a.Expiration, now > b.Expiration; expiredA != expiredB {
+			return expiredA
+		}
+		return a.added < b.added
+	})
+
+	target := c.maxBytes / 10 * 9
+	removed := map[string]CacheItem{}
+	for _, candidate := range candidates {
+		if c.bytes.Load() <= target {
+			break
+		}
+		s := candidate.shard
+		s.mu.Lock()
+		// The item may have been replaced since it was collected
+		if item, found := s.items[candidate.key]; found && item.added == candidate.item.added {
+			delete(s.items, candidate.key)
+			c.bytes.Add(-item.size)
+			removed[candidate.key] = item
+		}
+		s.mu.Unlock()
+	}
+	c.evicted(removed)
 }
 
 // Get retrieves an item from the cache
 func (c *Cache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	item, found := c.items[key]
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, found := s.items[key]
 	if !found || time.Now().UnixNano() > item.Expiration {
 		return nil, false
 	}
 	return item.Value, true
 }
 
+// Fetch returns the item cached under key, or calls loader and caches its
+// value for the specified duration. Concurrent calls for a key that is being
+// loaded wait for that loader and share its result. Errors are not cached,
+// and if the loader panics the waiting calls get an error.
+func (c *Cache) Fetch(key string, duration time.Duration, loader func() (interface{}, error)) (interface{}, error) {
+	return c.FetchContext(context.Background(), key, duration, func(context.Context) (interface{}, error) {
+		return loader()
+	})
+}
+
+// FetchContext is Fetch with a context that is passed to the loader. A
+// caller waiting for the loader of another call returns when ctx is done,
+// while the loader runs to completion for the remaining callers.
+func (c *Cache) FetchContext(ctx context.Context, key string, duration time.Duration, loader func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	if item, found := s.items[key]; found && time.Now().UnixNano() <= item.Expiration {
+		s.mu.Unlock()
+		return item.Value, nil
+	}
+	if l, found := s.loading[key]; found {
+		s.mu.Unlock()
+		select {
+		case <-l.done:
+			return l.value, l.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	l := &load{done: make(chan struct{})}
+	s.loading[key] = l
+	s.mu.Unlock()
+
+	defer func() {
+		// A panicking loader fails the waiting callers instead of leaving
+		// them blocked, and panics again in the calling goroutine
+		p := recover()
+		if p != nil {
+			l.value, l.err = nil, fmt.Errorf("cache: loader of %q panicked: %v", key, p)
+		}
+		s.mu.Lock()
+		if l.err == nil {
+			c.store(s, key, l.value, duration)
+		}
+		delete(s.loading, key)
+		s.mu.Unlock()
+		close(l.done)
+		c.limit()
+		if p != nil {
+			panic(p)
+		}
+	}()
+	l.value, l.err = loader(ctx)
+	return l.value, l.err
+}
+
+// GetContext is Get that returns the error of ctx once it is done
+func (c *Cache) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	value, found := c.Get(key)
+	return value, found, nil
+}
+
+// SetContext is Set that stores nothing and returns the error of ctx once
+// it is done
+func (c *Cache) SetContext(ctx context.Context, key string, value interface{}, duration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Set(key, value, duration)
+	return nil
+}
+
 // Delete removes an item from the cache
 func (c *Cache) Delete(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.items, key)
+	s := c.shard(key)
+	s.mu.Lock()
+	item, found := s.items[key]
+	delete(s.items, key)
+	c.bytes.Add(-item.size)
+	s.mu.Unlock()
+	if found {
+		c.evicted(map[string]CacheItem{key: item})
+	}
 }
 
 // Cleanup removes expired items from the cache
 func (c *Cache) Cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
 	now := time.Now().UnixNano()
-	for key, item := range c.items {
-		if now > item.Expiration {
-			delete(c.items, key)
+	c.DeleteFunc(func(key string, item CacheItem) bool {
+		return now > item.Expiration
+	})
+}
+
+// StartJanitor runs Cleanup every interval in the background until Stop is
+// called. A running janitor is stopped first.
+func (c *Cache) StartJanitor(interval time.Duration) {
+	c.Stop()
+
+	c.janitorMu.Lock()
+	defer c.janitorMu.Unlock()
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	c.stop, c.stopped = stop, stopped
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Cleanup()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the janitor and waits for it to return. It does nothing if no
+// janitor is running.
+func (c *Cache) Stop() {
+	c.janitorMu.Lock()
+	defer c.janitorMu.Unlock()
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.stopped
+	c.stop, c.stopped = nil, nil
+}
+
+// DeleteFunc removes the items that match and returns how many were removed
+func (c *Cache) DeleteFunc(match func(key string, item CacheItem) bool) int {
+	removed := map[string]CacheItem{}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, item := range s.items {
+			if match(key, item) {
+				delete(s.items, key)
+				c.bytes.Add(-item.size)
+				removed[key] = item
+			}
+		}
+		s.mu.Unlock()
+	}
+	c.evicted(removed)
+	return len(removed)
+}
+
+// Flush removes all items from the cache and returns how many were removed
+func (c *Cache) Flush() int {
+	removed := map[string]CacheItem{}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, item := range s.items {
+			removed[key] = item
+			c.bytes.Add(-item.size)
 		}
+		s.items = make(map[string]CacheItem)
+		s.mu.Unlock()
 	}
+	c.evicted(removed)
+	return len(removed)
 }
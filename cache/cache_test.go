@@ -0,0 +1,300 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitLoading waits until a Fetch loader of key is running
+func waitLoading(t *testing.T, c *Cache, key string) {
+	t.Helper()
+	s := c.shard(key)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.RLock()
+		_, loading := s.loading[key]
+		s.mu.RUnlock()
+		if loading {
+			return
+		}
+	}
+	t.Fatalf("no loader of %q started", key)
+}
+
+// waitWaiting waits until n callers wait for the loader of key. Waiters
+// can't be observed directly, so it gives them time to get there after
+// checking the loader runs.
+func waitWaiting(t *testing.T, c *Cache, key string, started *atomic.Int32, n int32) {
+	t.Helper()
+	waitLoading(t, c, key)
+	for deadline := time.Now().Add(5 * time.Second); started.Load() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d callers started", started.Load(), n)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestSetGet(t *testing.T) {
+	c := NewCache()
+	c.Set("a", 1, time.Minute)
+	c.Set("expired", 2, -time.Second)
+
+	if v, found := c.Get("a"); !found || v != 1 {
+		t.Errorf("Get(a) = %v, %v, want 1, true", v, found)
+	}
+	if v, found := c.Get("expired"); found {
+		t.Errorf("Get(expired) = %v, true, want not found", v)
+	}
+	if _, found := c.Get("missing"); found {
+		t.Errorf("Get(missing) found")
+	}
+
+	c.Cleanup()
+	if n := c.Flush(); n != 1 {
+		t.Errorf("Flush after Cleanup removed %d items, want 1", n)
+	}
+}
+
+func TestFetchSharesLoader(t *testing.T) {
+	c := NewCache()
+	release := make(chan struct{})
+	var calls, started atomic.Int32
+	loader := func() (interface{}, error) {
+		calls.Add(1)
+		<-release
+		return "value", nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make([]interface{}, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Add(1)
+			results[i], errs[i] = c.Fetch("key", time.Minute, loader)
+		}(i)
+	}
+	waitWaiting(t, c, "key", &started, callers)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	for i := range results {
+		if results[i] != "value" || errs[i] != nil {
+			t.Errorf("caller %d got %v, %v, want value, nil", i, results[i], errs[i])
+		}
+	}
+
+	v, err := c.Fetch("key", time.Minute, func() (interface{}, error) {
+		t.Error("loader called for a cached key")
+		return nil, nil
+	})
+	if v != "value" || err != nil {
+		t.Errorf("cached Fetch = %v, %v, want value, nil", v, err)
+	}
+}
+
+func TestFetchDoesNotCacheErrors(t *testing.T) {
+	c := NewCache()
+	failure := errors.New("failure")
+	if _, err := c.Fetch("key", time.Minute, func() (interface{}, error) { return nil, failure }); err != failure {
+		t.Fatalf("Fetch error = %v, want %v", err, failure)
+	}
+	if _, found := c.Get("key"); found {
+		t.Fatal("failed load was cached")
+	}
+	v, err := c.Fetch("key", time.Minute, func() (interface{}, error) { return 2, nil })
+	if v != 2 || err != nil {
+		t.Errorf("Fetch after a failure = %v, %v, want 2, nil", v, err)
+	}
+}
+
+func TestFetchLoaderPanic(t *testing.T) {
+	c := NewCache()
+	release := make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.Fetch("key", time.Minute, func() (interface{}, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+
+	waitLoading(t, c, "key")
+	var started atomic.Int32
+	waiter := make(chan error)
+	go func() {
+		started.Add(1)
+		_, err := c.Fetch("key", time.Minute, func() (interface{}, error) {
+			return nil, fmt.Errorf("waiter ran its own loader")
+		})
+		waiter <- err
+	}()
+	waitWaiting(t, c, "key", &started, 1)
+	close(release)
+
+	if p := <-panicked; p != "boom" {
+		t.Errorf("panicking Fetch recovered %v, want boom", p)
+	}
+	if err := <-waiter; err == nil || err.Error() != `cache: loader of "key" panicked: boom` {
+		t.Errorf("waiting Fetch error = %v, want the panic of the loader", err)
+	}
+	if _, found := c.Get("key"); found {
+		t.Error("value of a panicking loader was cached")
+	}
+
+	// The key isn't stuck loading
+	v, err := c.Fetch("key", time.Minute, func() (interface{}, error) { return 3, nil })
+	if v != 3 || err != nil {
+		t.Errorf("Fetch after a panic = %v, %v, want 3, nil", v, err)
+	}
+}
+
+func TestFetchContextCancelledWaiter(t *testing.T) {
+	c := NewCache()
+	release := make(chan struct{})
+	loaded := make(chan error)
+	go func() {
+		_, err := c.Fetch("key", time.Minute, func() (interface{}, error) {
+			<-release
+			return "value", nil
+		})
+		loaded <- err
+	}()
+	waitLoading(t, c, "key")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.FetchContext(ctx, "key", time.Minute, func(context.Context) (interface{}, error) {
+		return nil, fmt.Errorf("loader of a cancelled call ran")
+	})
+	if err != context.Canceled {
+		t.Errorf("cancelled FetchContext error = %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if err := <-loaded; err != nil {
+		t.Fatalf("Fetch error = %v", err)
+	}
+	if v, found := c.Get("key"); !found || v != "value" {
+		t.Errorf("Get = %v, %v after the loader finished, want value, true", v, found)
+	}
+}
+
+func TestShards(t *testing.T) {
+	if n := len(NewShardedCache(0).shards); n != 1 {
+		t.Errorf("NewShardedCache(0) has %d shards, want 1", n)
+	}
+
+	c := NewShardedCache(4)
+	used := map[*shard]bool{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		c.Set(key, i, time.Minute)
+		if c.shard(key) != c.shard(key) {
+			t.Fatalf("key %s maps to different shards", key)
+		}
+		used[c.shard(key)] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("100 keys use %d of 4 shards", len(used))
+	}
+	for i := 0; i < 100; i++ {
+		if v, found := c.Get(fmt.Sprintf("key%d", i)); !found || v != i {
+			t.Fatalf("Get(key%d) = %v, %v", i, v, found)
+		}
+	}
+
+	evicted := 0
+	c.OnEvict(func(string, interface{}) { evicted++ })
+	removed := c.DeleteFunc(func(key string, item CacheItem) bool { return item.Value.(int)%2 == 0 })
+	if removed != 50 || evicted != 50 {
+		t.Errorf("DeleteFunc removed %d items and evicted %d, want 50", removed, evicted)
+	}
+	if n := c.Flush(); n != 50 {
+		t.Errorf("Flush removed %d items, want 50", n)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	c := NewShardedCache(2)
+	c.SetMaxBytes(100, func(key string, value interface{}) int64 { return 10 })
+	var evicted []string
+	c.OnEvict(func(key string, value interface{}) { evicted = append(evicted, key) })
+
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("key%d", i), i, time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+	if b := c.Bytes(); b != 100 || len(evicted) != 0 {
+		t.Fatalf("at the limit Bytes = %d with %d evictions, want 100 and none", b, len(evicted))
+	}
+
+	// Exceeding the limit removes the oldest items down to 90%
+	c.Set("key10", 10, time.Minute)
+	if b := c.Bytes(); b != 90 {
+		t.Errorf("Bytes = %d above the limit, want 90", b)
+	}
+	if len(evicted) != 2 || evicted[0] != "key0" && evicted[1] != "key0" {
+		t.Errorf("evicted %v, want key0 and key1", evicted)
+	}
+	for _, key := range []string{"key0", "key1"} {
+		if _, found := c.Get(key); found {
+			t.Errorf("oldest item %s was kept", key)
+		}
+	}
+	if _, found := c.Get("key10"); !found {
+		t.Error("newest item was removed")
+	}
+
+	// Expired items go first
+	c.Set("key5", 5, -time.Second)
+	c.Set("key11", 11, time.Minute)
+	c.Set("key12", 12, time.Minute)
+	if len(evicted) != 4 || evicted[2] != "key5" && evicted[3] != "key5" {
+		t.Errorf("evicted %v, want key5 and key2 after key0 and key1", evicted)
+	}
+	if _, found := c.Get("key3"); !found {
+		t.Error("an item newer than the oldest was removed")
+	}
+
+	c.Delete("key10")
+	if b := c.Bytes(); b != 80 {
+		t.Errorf("Bytes = %d after Delete, want 80", b)
+	}
+	c.Flush()
+	if b := c.Bytes(); b != 0 {
+		t.Errorf("Bytes = %d after Flush, want 0", b)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	c := NewCache()
+	a, b := c.Namespace("a"), c.Namespace("b")
+	a.Set("key", 1, time.Minute)
+	b.Set("key", 2, time.Minute)
+
+	if v, _ := a.Get("key"); v != 1 {
+		t.Errorf("a.Get = %v, want 1", v)
+	}
+	if keys := b.Keys(); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("b.Keys = %v, want [key]", keys)
+	}
+	if n := a.Flush(); n != 1 {
+		t.Errorf("a.Flush removed %d items, want 1", n)
+	}
+	if v, found := b.Get("key"); !found || v != 2 {
+		t.Errorf("b.Get = %v, %v after flushing a, want 2, true", v, found)
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// namespaceSeparator ends the namespace prefix of a key
+const namespaceSeparator = "\x00"
+
+// Namespace is a view of a cache whose keys are prefixed with its name, so
+// that its entries can be enumerated and removed without touching the
+// entries of other namespaces. Eviction hooks see the prefixed keys.
+type Namespace struct {
+	cache  *Cache
+	prefix string
+}
+
+// Namespace returns the namespace with the given name
+func (c *Cache) Namespace(name string) *Namespace {
+	return &Namespace{cache: c, prefix: name + namespaceSeparator}
+}
+
+// Set adds an item to the namespace with a specified duration
+func (n *Namespace) Set(key string, value interface{}, duration time.Duration) {
+	n.cache.Set(n.prefix+key, value, duration)
+}
+
+// Get retrieves an item from the namespace
+func (n *Namespace) Get(key string) (interface{}, bool) {
+	return n.cache.Get(n.prefix + key)
+}
+
+// GetContext is Cache.GetContext within the namespace
+func (n *Namespace) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	return n.cache.GetContext(ctx, n.prefix+key)
+}
+
+// SetContext is Cache.SetContext within the namespace
+func (n *Namespace) SetContext(ctx context.Context, key string, value interface{}, duration time.Duration) error {
+	return n.cache.SetContext(ctx, n.prefix+key, value, duration)
+}
+
+// Fetch is Cache.Fetch within the namespace
+func (n *Namespace) Fetch(key string, duration time.Duration, loader func() (interface{}, error)) (interface{}, error) {
+	return n.cache.Fetch(n.prefix+key, duration, loader)
+}
+
+// FetchContext is Cache.FetchContext within the namespace
+func (n *Namespace) FetchContext(ctx context.Context, key string, duration time.Duration, loader func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return n.cache.FetchContext(ctx, n.prefix+key, duration, loader)
+}
+
+// Delete removes an item from the namespace
+func (n *Namespace) Delete(key string) {
+	n.cache.Delete(n.prefix + key)
+}
+
+// Keys returns the keys of the items in the namespace, including expired
+// items that haven't been cleaned up yet
+func (n *Namespace) Keys() []string {
+	var keys []string
+	for _, s := range n.cache.shards {
+		s.mu.RLock()
+		for key := range s.items {
+			if k, found := strings.CutPrefix(key, n.prefix); found {
+				keys = append(keys, k)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return keys
+}
+
+// Flush removes all items of the namespace and returns how many were removed
+func (n *Namespace) Flush() int {
+	return n.cache.DeleteFunc(func(key string, _ CacheItem) bool {
+		return strings.HasPrefix(key, n.prefix)
+	})
+}
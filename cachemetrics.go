@@ -0,0 +1,23 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rules_exporter_cache_evictions_total",
+	Help: "Number of entries removed from the query and response caches.",
+}, []string{"cache"})
+
+func init() {
+	prometheus.MustRegister(cacheEvictions)
+}
+
+// countCacheEvictions counts the evictions of the query and response caches,
+// once they have been created from the flags
+func countCacheEvictions() {
+	queryCache.OnEvict(func(string, interface{}) {
+		cacheEvictions.WithLabelValues("query").Inc()
+	})
+	responseCache.OnEvict(func(string, interface{}) {
+		cacheEvictions.WithLabelValues("response").Inc()
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compute derives the value of a rule from the results of two other rules of
+// the target instead of querying, e.g. a ratio or the series above a
+// threshold. Series are matched by the values of the on labels, all labels by
+// default, and keep the labels of the left series. A side that returned a
+// single series without labels is matched with every series of the other.
+// Comparisons keep the left series for which they hold, like in PromQL.
+type Compute struct {
+	Left  string   `yaml:"left"`
+	Op    string   `yaml:"op"`
+	Right string   `yaml:"right"`
+	On    []string `yaml:"on,omitempty"`
+}
+
+var computeOps = map[string]func(a, b float64) (float64, bool){
+	"+":  func(a, b float64) (float64, bool) { return a + b, true },
+	"-":  func(a, b float64) (float64, bool) { return a - b, true },
+	"*":  func(a, b float64) (float64, bool) { return a * b, true },
+	"/":  func(a, b float64) (float64, bool) { return a / b, true },
+	"==": func(a, b float64) (float64, bool) { return a, a == b },
+	"!=": func(a, b float64) (float64, bool) { return a, a != b },
+	">":  func(a, b float64) (float64, bool) { return a, a > b },
+	">=": func(a, b float64) (float64, bool) { return a, a >= b },
+	"<":  func(a, b float64) (float64, bool) { return a, a < b },
+	"<=": func(a, b float64) (float64, bool) { return a, a <= b },
+}
+
+func (c *Compute) validate() error {
+	if c.Left == "" || c.Right == "" {
+		return fmt.Errorf("compute needs left and right")
+	}
+	if _, exists := computeOps[c.Op]; !exists {
+		var ops []string
+		for op := range computeOps {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		return fmt.Errorf("unknown compute op %q, expected one of %s", c.Op, strings.Join(ops, " "))
+	}
+	return nil
+}
+
+// dependencies returns the records of the rules a rule needs the results of
+func (r Rule) dependencies() []string {
+	if r.Compute == nil {
+		return nil
+	}
+	return []string{r.Compute.Left, r.Compute.Right}
+}
+
+// ruleOutputs holds the samples of the rules of a target that succeeded in
+// an evaluation by record, for the compute rules evaluated after them
+type ruleOutputs map[string][]Sample
+
+// add records the samples of a rule that succeeded, without its _present
+// series
+func (o ruleOutputs) add(rule Rule, samples []Sample) {
+	if rule.Record == "" {
+		return
+	}
+	values := o[rule.Record]
+	if values == nil {
+		values = []Sample{}
+	}
+	for _, sample := range samples {
+		if sample.Name == ruleMetricName(rule) {
+			values = append(values, sample)
+		}
+	}
+	o[rule.Record] = values
+}
+
+// computeRule evaluates a compute rule from the outputs of the rules it
+// depends on
+func computeRule(rule Rule, outputs ruleOutputs) ([]Sample, error) {
+	c := rule.Compute
+	left, ok := outputs[c.Left]
+	if !ok {
+		return nil, fmt.Errorf("rule %s failed or wasn't evaluated", c.Left)
+	}
+	right, ok := outputs[c.Right]
+	if !ok {
+		return nil, fmt.Errorf("rule %s failed or wasn't evaluated", c.Right)
+	}
+
+	type operands struct {
+		labels      prometheus.Labels
+		left, right float64
+	}
+	var matched []operands
+	switch {
+	case len(right) == 1 && len(right[0].Labels) == 0:
+		for _, l := range left {
+			matched = append(matched, operands{l.Labels, l.Value, right[0].Value})
+		}
+	case len(left) == 1 && len(left[0].Labels) == 0:
+		for _, r := range right {
+			matched = append(matched, operands{r.Labels, left[0].Value, r.Value})
+		}
+	default:
+		byKey := make(map[string]Sample, len(right))
+		for _, r := range right {
+			key := c.matchKey(r.Labels)
+			if _, exists := byKey[key]; exists {
+				return nil, fmt.Errorf("rule %s returned several series for %s", c.Right, key)
+			}
+			byKey[key] = r
+		}
+		for _, l := range left {
+			if r, exists := byKey[c.matchKey(l.Labels)]; exists {
+				matched = append(matched, operands{l.Labels, l.Value, r.Value})
+			}
+		}
+	}
+
+	op := computeOps[c.Op]
+	var samples []Sample
+	for _, m := range matched {
+		value, keep := op(m.left, m.right)
+		if !keep {
+			continue
+		}
+		labels := make(prometheus.Labels, len(m.labels))
+		for k, v := range m.labels {
+			labels[k] = v
+		}
+		samples = append(samples, Sample{
+			Name:   ruleMetricName(rule),
+			Help:   ruleHelp(rule),
+			Type:   prometheus.GaugeValue,
+			Labels: labels,
+			Value:  transformValue(rule, value),
+		})
+	}
+	if len(samples) == 0 && rule.OnEmpty != nil && rule.OnEmpty.Value != nil {
+		samples = append(samples, Sample{
+			Name:   ruleMetricName(rule),
+			Help:   ruleHelp(rule),
+			Type:   prometheus.GaugeValue,
+			Labels: prometheus.Labels{},
+			Value:  *rule.OnEmpty.Value,
+		})
+	}
+	return samples, nil
+}
+
+// matchKey identifies the series of both sides that are matched
+func (c *Compute) matchKey(labels prometheus.Labels) string {
+	if len(c.On) == 0 {
+		return formatLabels(labels)
+	}
+	on := make(prometheus.Labels, len(c.On))
+	for _, name := range c.On {
+		on[name] = labels[name]
+	}
+	return formatLabels(on)
+}
+
+// validateDependencies requires the rules compute rules depend on to be
+// gauge or counter rules of the same target and rejects cycles
+func validateDependencies(rules []Rule) error {
+	byRecord := map[string][]Rule{}
+	for _, rule := range rules {
+		if rule.Record != "" {
+			byRecord[rule.Record] = append(byRecord[rule.Record], rule)
+		}
+	}
+	for _, rule := range rules {
+		for _, dep := range rule.dependencies() {
+			deps, exists := byRecord[dep]
+			if !exists {
+				return fmt.Errorf("rule %s: no rule of the target records %s", ruleID(rule), dep)
+			}
+			for _, d := range deps {
+				if d.Type != "" && d.Type != "gauge" && d.Type != "counter" {
+					return fmt.Errorf("rule %s: %s is a %s rule, compute needs gauge or counter rules", ruleID(rule), dep, d.Type)
+				}
+			}
+		}
+	}
+
+	// Depth first search, a rule met again while its dependencies are
+	// visited is part of a cycle
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(record string, path []string) error
+	visit = func(record string, path []string) error {
+		switch state[record] {
+		case visiting:
+			return fmt.Errorf("dependency cycle %s", strings.Join(append(path, record), " -> "))
+		case done:
+			return nil
+		}
+		state[record] = visiting
+		for _, rule := range byRecord[record] {
+			for _, dep := range rule.dependencies() {
+				if err := visit(dep, append(path, record)); err != nil {
+					return err
+				}
+			}
+		}
+		state[record] = done
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.Compute != nil {
+			if err := visit(rule.Record, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dependencyOrder moves the rules compute rules depend on before them,
+// keeping the order of the rules otherwise
+func dependencyOrder(rules []Rule) []Rule {
+	byRecord := map[string][]int{}
+	for i, rule := range rules {
+		if rule.Record != "" {
+			byRecord[rule.Record] = append(byRecord[rule.Record], i)
+		}
+	}
+	ordered := make([]Rule, 0, len(rules))
+	visited := make([]bool, len(rules))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			// Also ends cycles, which validateDependencies rejects
+			return
+		}
+		visited[i] = true
+		for _, dep := range rules[i].dependencies() {
+			for _, j := range byRecord[dep] {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, rules[i])
+	}
+	for i := range rules {
+		visit(i)
+	}
+	return ordered
+}
+
+// queryRules returns the rules that query the datasource of a target, all
+// but compute rules
+func queryRules(rules []Rule) []Rule {
+	var query []Rule
+	for _, rule := range rules {
+		if rule.Compute == nil {
+			query = append(query, rule)
+		}
+	}
+	return query
+}
+
+// evaluateWithDependencies evaluates a rule after the rules it depends on,
+// for commands that evaluate a single rule
+func evaluateWithDependencies(ctx context.Context, target string, group Group, rule Rule) ([]Sample, error) {
+	if rule.Compute == nil {
+		return evaluateRule(ctx, target, group, rule)
+	}
+	needed := map[string]bool{}
+	var need func(deps []string)
+	need = func(deps []string) {
+		for _, dep := range deps {
+			if !needed[dep] {
+				needed[dep] = true
+				for _, r := range group.Rules {
+					if r.Record == dep {
+						need(r.dependencies())
+					}
+				}
+			}
+		}
+	}
+	need(rule.dependencies())
+
+	outputs := ruleOutputs{}
+	for _, r := range prioritizedRules(group.Rules) {
+		if !needed[r.Record] {
+			continue
+		}
+		var samples []Sample
+		var err error
+		if r.Compute != nil {
+			samples, err = computeRule(r, outputs)
+		} else {
+			samples, err = evaluateRule(ctx, target, group, r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", ruleID(r), err)
+		}
+		outputs.add(r, samples)
+	}
+	return computeRule(rule, outputs)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	upstreamInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_upstream_in_flight_requests",
+		Help: "Number of queries currently sent to the endpoint.",
+	}, []string{"endpoint"})
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_upstream_requests_total",
+		Help: "Number of queries sent to the endpoint by status code.",
+	}, []string{"endpoint", "code", "method"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rules_exporter_upstream_request_duration_seconds",
+		Help:    "Duration of queries sent to the endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code", "method"})
+
+	// httpClients holds the shared client of every configured endpoint,
+	// keyed by clientKey
+	httpClients   = map[string]*http.Client{}
+	httpClientsMu sync.RWMutex
+)
+
+// HTTPClientConfig configures the connections to the endpoint of a target
+type HTTPClientConfig struct {
+	// HTTPVersion is "1.1" to force HTTP/1.1, "2" to always use HTTP/2
+	// (with prior knowledge for plain http endpoints) or empty to negotiate
+	// HTTP/2 for https endpoints
+	HTTPVersion string `yaml:"http_version,omitempty"`
+	// HTTP2ReadIdleTimeout sends a health check ping on HTTP/2 connections
+	// that received no frame for this long
+	HTTP2ReadIdleTimeout time.Duration `yaml:"http2_read_idle_timeout,omitempty"`
+	// TLS configures the verification and protocol of https endpoints
+	TLS TLSConfig `yaml:"tls_config,omitempty"`
+	// ProxyURL sends the queries through this proxy instead of the one set
+	// in the environment
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+	// ProxyFromEnvironment uses the proxy set in HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY if no proxy_url is given. It defaults to true.
+	ProxyFromEnvironment *bool `yaml:"proxy_from_environment,omitempty"`
+	// NoProxy lists hosts, domains (.example.com) and CIDR ranges that are
+	// connected to directly, in addition to those in NO_PROXY if the proxy
+	// is taken from the environment
+	NoProxy []string `yaml:"no_proxy,omitempty"`
+}
+
+// proxy returns the function choosing the proxy of a request, nil if no
+// proxy is used
+func (c HTTPClientConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	var config httpproxy.Config
+	switch {
+	case c.ProxyURL != "":
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %v", err)
+		}
+		config = httpproxy.Config{HTTPProxy: c.ProxyURL, HTTPSProxy: c.ProxyURL}
+	case c.ProxyFromEnvironment == nil || *c.ProxyFromEnvironment:
+		config = *httpproxy.FromEnvironment()
+	default:
+		return nil, nil
+	}
+	if len(c.NoProxy) > 0 {
+		config.NoProxy = strings.Trim(config.NoProxy+","+strings.Join(c.NoProxy, ","), ",")
+	}
+
+	proxyFunc := config.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}, nil
+}
+
+// TLSConfig configures TLS connections to the endpoint
+type TLSConfig struct {
+	// InsecureSkipVerify accepts any certificate, e.g. self-signed ones
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// MinVersion and MaxVersion are TLS10, TLS11, TLS12 or TLS13
+	MinVersion string `yaml:"min_version,omitempty"`
+	MaxVersion string `yaml:"max_version,omitempty"`
+	// CipherSuites are the names of the allowed TLS 1.0-1.2 cipher suites as
+	// listed by crypto/tls, all secure ones if empty
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// tlsClientConfig builds the crypto/tls configuration, nil if nothing is set
+func (c TLSConfig) tlsClientConfig() (*tls.Config, error) {
+	if !c.InsecureSkipVerify && c.MinVersion == "" && c.MaxVersion == "" && len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	for _, v := range []struct {
+		name    string
+		setting string
+		version *uint16
+	}{{"min_version", c.MinVersion, &config.MinVersion}, {"max_version", c.MaxVersion, &config.MaxVersion}} {
+		if v.setting == "" {
+			continue
+		}
+		version, exists := tlsVersions[v.setting]
+		if !exists {
+			return nil, fmt.Errorf("unknown %s %q", v.name, v.setting)
+		}
+		*v.version = version
+	}
+	if config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("min_version is above max_version")
+	}
+
+	suites := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range c.CipherSuites {
+		id, exists := suites[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// validate checks the settings for connections to the endpoint
+func (c HTTPClientConfig) validate(endpoint string) error {
+	switch c.HTTPVersion {
+	case "", "1.1", "2":
+	default:
+		return fmt.Errorf("unknown http_version %q", c.HTTPVersion)
+	}
+	if c.HTTP2ReadIdleTimeout != 0 && c.HTTPVersion == "1.1" {
+		return fmt.Errorf("http2_read_idle_timeout requires HTTP/2")
+	}
+	if _, err := c.TLS.tlsClientConfig(); err != nil {
+		return fmt.Errorf("tls_config: %v", err)
+	}
+	if _, err := c.proxy(); err != nil {
+		return err
+	}
+	if c.HTTPVersion == "2" && c.ProxyURL != "" && strings.HasPrefix(endpoint, "http://") {
+		// The HTTP/2 only transport of h2c has no proxy support
+		return fmt.Errorf("proxy_url can't be used with http_version \"2\" for http:// endpoints")
+	}
+	return nil
+}
+
+// clientKey identifies the clients that can be shared between targets
+func clientKey(group Group) string {
+	settings, _ := yaml.Marshal(group.HTTPClient)
+	return clientEndpoint(group) + " " + string(settings)
+}
+
+// clientEndpoint is the endpoint label of the metrics of a client: the
+// endpoint the datasource queries, without the credentials it may contain
+func clientEndpoint(group Group) string {
+	endpoint := groupEndpoint(group)
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User == nil {
+		return endpoint
+	}
+	u.User = nil
+	return u.String()
+}
+
+func init() {
+	prometheus.MustRegister(upstreamInFlight, upstreamRequests, upstreamDuration)
+}
+
+// setupClients builds one instrumented HTTP client per endpoint and client
+// configuration. Clients of the previous configuration are kept if they are
+// still needed, along with their connections.
+func setupClients(config Config) error {
+	httpClientsMu.RLock()
+	previous := httpClients
+	httpClientsMu.RUnlock()
+
+	groups := make([]Group, 0, len(config.Targets)+len(config.Discovery))
+	for _, group := range config.Targets {
+		// Aggregate and exec targets query no endpoint
+		if len(group.AggregateOf) == 0 && group.Type != "exec" {
+			groups = append(groups, group)
+		}
+	}
+	for _, d := range config.Discovery {
+		groups = append(groups, d.group())
+	}
+
+	clients := map[string]*http.Client{}
+	for _, group := range groups {
+		key := clientKey(group)
+		if _, exists := clients[key]; exists {
+			continue
+		}
+		if client, exists := previous[key]; exists {
+			clients[key] = client
+			continue
+		}
+		client, err := newClient(group)
+		if err != nil {
+			return err
+		}
+		clients[key] = client
+	}
+
+	httpClientsMu.Lock()
+	httpClients = clients
+	httpClientsMu.Unlock()
+	return nil
+}
+
+func newClient(group Group) (*http.Client, error) {
+	transport, err := newTransport(group)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := prometheus.Labels{"endpoint": clientEndpoint(group)}
+	instrumented := promhttp.InstrumentRoundTripperInFlight(upstreamInFlight.With(labels),
+		promhttp.InstrumentRoundTripperCounter(upstreamRequests.MustCurryWith(labels),
+			promhttp.InstrumentRoundTripperDuration(upstreamDuration.MustCurryWith(labels),
+				transport)))
+	return &http.Client{Timeout: 50 * time.Second, Transport: instrumented}, nil
+}
+
+// newTransport builds the transport for HTTP/1.1 or HTTP/2 connections as
+// configured for the group
+func newTransport(group Group) (http.RoundTripper, error) {
+	config := group.HTTPClient
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := config.TLS.tlsClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if transport.Proxy, err = config.proxy(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case config.HTTPVersion == "1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return transport, nil
+
+	case config.HTTPVersion == "2" && strings.HasPrefix(group.Endpoint, "http://"):
+		// Unencrypted HTTP/2 needs an HTTP/2 only transport
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: config.HTTP2ReadIdleTimeout,
+		}, nil
+
+	default:
+		if config.HTTPVersion == "2" {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.NextProtos = []string{"h2"}
+		}
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, err
+		}
+		h2.ReadIdleTimeout = config.HTTP2ReadIdleTimeout
+		return transport, nil
+	}
+}
+
+// clientFor returns the shared client of a group, creating one for groups
+// that weren't known when the clients were set up, like discovered targets,
+// which is then shared as well
+func clientFor(group Group) (*http.Client, error) {
+	key := clientKey(group)
+	httpClientsMu.RLock()
+	client, exists := httpClients[key]
+	httpClientsMu.RUnlock()
+	if exists {
+		return client, nil
+	}
+
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	if client, exists := httpClients[key]; exists {
+		return client, nil
+	}
+	client, err := newClient(group)
+	if err != nil {
+		return nil, err
+	}
+	httpClients[key] = client
+	return client, nil
+}
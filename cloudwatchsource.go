@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CloudWatchMetric selects what a rule of a cloudwatch target queries. The
+// expression of the rule is the metric name.
+type CloudWatchMetric struct {
+	Namespace string `yaml:"namespace"`
+	// Dimensions select the metric and become labels
+	Dimensions map[string]string `yaml:"dimensions,omitempty"`
+	// Period of the data points, 5m by default
+	Period time.Duration `yaml:"period,omitempty"`
+	// Statistic is Average (default), Sum, Minimum, Maximum, SampleCount or
+	// an extended statistic like p99
+	Statistic string `yaml:"statistic,omitempty"`
+}
+
+const (
+	defaultCloudWatchPeriod    = 5 * time.Minute
+	defaultCloudWatchStatistic = "Average"
+)
+
+var cloudWatchStatistic = regexp.MustCompile(`^(Average|Sum|Minimum|Maximum|SampleCount|(p|tm|wm|tc|ts)\d+(\.\d+)?)$`)
+
+func init() {
+	datasourceTypes["cloudwatch"] = newCloudWatchDatasource
+	defaultEndpoints["cloudwatch"] = func(group Group) string {
+		if group.CloudWatch == nil {
+			return ""
+		}
+		return fmt.Sprintf("https://monitoring.%s.amazonaws.com", group.CloudWatch.Region)
+	}
+}
+
+type cloudWatchDatasource struct {
+	group Group
+	auth  AWSAuth
+}
+
+func newCloudWatchDatasource(group Group) (Datasource, error) {
+	if group.CloudWatch == nil {
+		return nil, fmt.Errorf("cloudwatch targets need cloudwatch settings")
+	}
+	if err := group.CloudWatch.validate(); err != nil {
+		return nil, fmt.Errorf("cloudwatch: %v", err)
+	}
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		if rule.CloudWatch == nil || rule.CloudWatch.Namespace == "" {
+			return nil, fmt.Errorf("rule %s: cloudwatch targets need a cloudwatch namespace per rule", ruleID(rule))
+		}
+		metric := rule.CloudWatch
+		if metric.Statistic != "" && !cloudWatchStatistic.MatchString(metric.Statistic) {
+			return nil, fmt.Errorf("rule %s: unknown statistic %q", ruleID(rule), metric.Statistic)
+		}
+		switch period := metric.Period; {
+		case period == 0, period == time.Second, period == 5*time.Second, period == 10*time.Second, period == 30*time.Second:
+		case period < 0 || period%time.Minute != 0:
+			return nil, fmt.Errorf("rule %s: period must be 1s, 5s, 10s, 30s or a multiple of 1m", ruleID(rule))
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return nil, fmt.Errorf("rule %s: cloudwatch targets only support gauge and counter rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: cloudwatch targets don't support join", ruleID(rule))
+		}
+	}
+	return cloudWatchDatasource{group: group, auth: *group.CloudWatch}, nil
+}
+
+// Query needs the cloudwatch settings of a rule
+func (c cloudWatchDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return nil, fmt.Errorf("cloudwatch queries need a rule with cloudwatch settings")
+}
+
+func (c cloudWatchDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	if rule.CloudWatch == nil {
+		return c.Query(ctx, expr, at)
+	}
+	metric := *rule.CloudWatch
+	if metric.Period == 0 {
+		metric.Period = defaultCloudWatchPeriod
+	}
+	if metric.Statistic == "" {
+		metric.Statistic = defaultCloudWatchStatistic
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	client, err := clientFor(c.group)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := c.auth.credentials(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask for a few periods to get the latest complete data point. The end
+	// is exclusive, aligned to the period it leaves out the current one,
+	// whose Sum and SampleCount are still growing.
+	end := at.Truncate(metric.Period)
+	form := url.Values{
+		"Action":    {"GetMetricData"},
+		"Version":   {"2010-08-01"},
+		"StartTime": {end.Add(-3 * metric.Period).UTC().Format(time.RFC3339)},
+		"EndTime":   {end.UTC().Format(time.RFC3339)},
+		"ScanBy":    {"TimestampDescending"},
+	}
+	query := "MetricDataQueries.member.1."
+	form.Set(query+"Id", "m0")
+	form.Set(query+"ReturnData", "true")
+	form.Set(query+"MetricStat.Metric.Namespace", metric.Namespace)
+	form.Set(query+"MetricStat.Metric.MetricName", expr)
+	form.Set(query+"MetricStat.Period", strconv.Itoa(int(metric.Period/time.Second)))
+	form.Set(query+"MetricStat.Stat", metric.Statistic)
+	var names []string
+	for name := range metric.Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		dimension := fmt.Sprintf("%sMetricStat.Metric.Dimensions.member.%d.", query, i+1)
+		form.Set(dimension+"Name", name)
+		form.Set(dimension+"Value", metric.Dimensions[name])
+	}
+
+	body, err := awsPost(ctx, client, groupEndpoint(c.group), c.auth.Region, "monitoring", creds, form)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Results []struct {
+			StatusCode string    `xml:"StatusCode"`
+			Values     []float64 `xml:"Values>member"`
+		} `xml:"GetMetricDataResult>MetricDataResults>member"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return nil, &parseError{err}
+	}
+	var results []map[string]interface{}
+	for _, result := range response.Results {
+		if len(result.Values) == 0 {
+			continue
+		}
+		// The values are newest first
+		sample := map[string]interface{}{"value": strconv.FormatFloat(result.Values[0], 'g', -1, 64)}
+		for name, value := range metric.Dimensions {
+			if value != "" {
+				sample[sanitizeLabelName(name)] = value
+			}
+		}
+		results = append(results, sample)
+	}
+	return results, nil
+}
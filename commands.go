@@ -0,0 +1,13 @@
+package main
+
+// commands maps subcommand names to their implementation. Running the binary
+// without a known subcommand starts the exporter.
+var commands = map[string]func(args []string) error{
+	"bench":        benchCommand,
+	"convert":      convertCommand,
+	"init":         initCommand,
+	"list-targets": listTargetsCommand,
+	"schema":       schemaCommand,
+	"test-query":   testQueryCommand,
+	"validate":     validateCommand,
+}
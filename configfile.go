@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configCommandTimeout limits the commands evaluating or checking
+// configuration files
+const configCommandTimeout = 30 * time.Second
+
+// configFlags registers --config.file and the flags of how it is read on
+// the flag set of the exporter or of a subcommand
+func configFlags(fs *flag.FlagSet) *string {
+	configFile := fs.String("config.file", "rules_exporter.yaml", "Path to configuration file.")
+	fs.StringVar(&jsonnetCommand, "config.jsonnet-command", jsonnetCommand, "Command evaluating a --config.file ending in .jsonnet, printing the configuration as JSON.")
+	fs.Var(&jsonnetExtVars, "config.jsonnet-ext-var", "External variable of a .jsonnet --config.file, name=value or name to take the value of the environment variable. Repeat for several variables.")
+	fs.StringVar(&cueCommand, "config.cue-command", cueCommand, "Command evaluating a --config.file ending in .cue and checking YAML ones with --config.cue-validate.")
+	fs.BoolVar(&cueValidate, "config.cue-validate", false, "Check a YAML --config.file against the CUE schema of the configuration, printed by the schema command, before loading it.")
+	fs.StringVar(&sopsCommand, "config.sops-command", sopsCommand, "Command decrypting a --config.file encrypted with SOPS, on every load and reload. It takes the keys from the environment, e.g. SOPS_AGE_KEY_FILE.")
+	fs.StringVar(&signaturePublicKey, "config.signature-public-key", "", "minisign or cosign (PEM) public key file. If set, --config.file must have a detached signature by it, checked on every load and reload. Files imported by a .jsonnet or .cue --config.file are not covered by the signature.")
+	fs.StringVar(&signatureFile, "config.signature-file", "", "Detached signature of --config.file, by default --config.file with .minisig appended for minisign keys and .sig for cosign keys.")
+	return configFile
+}
+
+// readConfigFile returns the YAML of a configuration file, after checking
+// its signature with --config.signature-public-key. Files ending in .jsonnet
+// and .cue are evaluated with jsonnetCommand and cueCommand, the JSON they
+// print is YAML as well, and .toml files are converted. Files encrypted with
+// SOPS are decrypted, other YAML files are checked against the CUE schema of
+// the configuration first with --config.cue-validate. The commands get a
+// copy of the bytes whose signature was checked, not the file.
+func readConfigFile(configFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if signaturePublicKey != "" {
+		// Only the file itself, not what .jsonnet and .cue files import
+		if err := verifyConfigSignature(configFile, data); err != nil {
+			return nil, fmt.Errorf("%s: %v", configFile, err)
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(configFile, ".jsonnet"):
+		return evaluateJsonnet(configFile, data)
+	case strings.HasSuffix(configFile, ".cue"):
+		return exportCUE(configFile, data)
+	case strings.HasSuffix(configFile, ".toml"):
+		yaml, err := tomlToYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", configFile, err)
+		}
+		return yaml, nil
+	}
+	if sopsEncrypted(data) {
+		return decryptSOPS(configFile, data)
+	}
+	if cueValidate {
+		if err := vetCUE(configFile, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// withConfigCopy runs fn on a copy of the data read from a configuration
+// file, in a private temporary directory, so commands see the bytes that were
+// checked rather than the file, and returns its errors with the path of the
+// file
+func withConfigCopy(configFile string, data []byte, fn func(file string) ([]byte, error)) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "rules_exporter-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, filepath.Base(configFile))
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return nil, err
+	}
+	out, err := fn(file)
+	if err != nil {
+		return nil, errors.New(strings.ReplaceAll(err.Error(), file, configFile))
+	}
+	return out, nil
+}
+
+// runConfigCommand runs a command on a configuration file and returns its
+// output, or an error with what it printed to stderr
+func runConfigCommand(command string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configCommandTimeout)
+	defer cancel()
+	stdout := &bytes.Buffer{}
+	stderr := &limitedBuffer{max: 4096, truncate: true}
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", command, ctx.Err())
+		}
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", command, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Structure of a native Prometheus rule file
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string         `yaml:"name"`
+	Interval string         `yaml:"interval,omitempty"`
+	Rules    []ruleFileRule `yaml:"rules"`
+}
+
+type ruleFileRule struct {
+	Record string            `yaml:"record,omitempty"`
+	Alert  string            `yaml:"alert,omitempty"`
+	Expr   string            `yaml:"expr"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// convertCommand converts between the exporter config and Prometheus rule files.
+// By default the configured rules are written as recording rules, one group per
+// target. With --reverse the given rule files are read and an exporter config
+// querying --endpoint is written instead.
+func convertCommand(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	configFile := configFlags(fs)
+	output := fs.String("output", "-", "File to write the result to, - for stdout.")
+	reverse := fs.Bool("reverse", false, "Convert Prometheus rule files given as arguments into an exporter config.")
+	endpoint := fs.String("endpoint", "http://localhost:9090", "Endpoint used for targets created with --reverse.")
+	fs.Parse(args)
+
+	var out interface{}
+	if *reverse {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("no rule files given")
+		}
+		config, err := configFromRuleFiles(fs.Args(), *endpoint)
+		if err != nil {
+			return err
+		}
+		out = config
+	} else {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		out = ruleFileFromConfig(config)
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*output, data, 0644)
+}
+
+func ruleFileFromConfig(config Config) ruleFile {
+	var names []string
+	for name := range config.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rf ruleFile
+	for _, name := range names {
+		if len(config.Targets[name].AggregateOf) > 0 {
+			log.Printf("Skipping aggregate target %s", name)
+			continue
+		}
+		if t := config.Targets[name].Type; t != "" && t != "prometheus" {
+			log.Printf("Skipping %s target %s, its expressions aren't PromQL", t, name)
+			continue
+		}
+		group := ruleGroup{Name: name}
+		for _, rule := range config.Targets[name].Rules {
+			if rule.Record == "" {
+				log.Printf("Skipping rule %s without record in target %s", rule.Expr, name)
+				continue
+			}
+			if rule.Compute != nil {
+				log.Printf("Skipping compute rule %s in target %s, it has no PromQL expression", rule.Record, name)
+				continue
+			}
+			group.Rules = append(group.Rules, ruleFileRule{Record: ruleMetricName(rule), Expr: nativeExpr(rule)})
+			if rule.Present {
+				group.Rules = append(group.Rules, ruleFileRule{
+					Record: ruleMetricName(rule) + "_present",
+					Expr:   fmt.Sprintf("(count(%s) > bool 0) or vector(0)", rule.Expr),
+				})
+			}
+		}
+		rf.Groups = append(rf.Groups, group)
+	}
+	return rf
+}
+
+// nativeExpr expresses the value conversions of a rule in PromQL. Rounding
+// to significant digits and joins, which keep unmatched results, have no
+// PromQL equivalent and are left out.
+func nativeExpr(rule Rule) string {
+	expr := rule.Expr
+	if rule.KeepMetricName {
+		expr = fmt.Sprintf(`label_replace(%s, "source_metric", "$1", "__name__", "(.+)")`, expr)
+	}
+	if conversion, exists := unitConversions[rule.Unit]; exists {
+		if conversion.factor < 1 {
+			expr = fmt.Sprintf("(%s) / %s", expr, strconv.FormatFloat(1/conversion.factor, 'f', -1, 64))
+		} else {
+			expr = fmt.Sprintf("(%s) * %s", expr, strconv.FormatFloat(conversion.factor, 'f', -1, 64))
+		}
+	}
+	if rule.Bool != nil {
+		expr = fmt.Sprintf("(%s) %s bool %g", expr, rule.Bool.Operator, rule.Bool.Threshold)
+	}
+	if rule.Precision != nil && rule.Precision.Decimals != nil {
+		expr = fmt.Sprintf("round(%s, %s)", expr, strconv.FormatFloat(math.Pow10(-*rule.Precision.Decimals), 'f', -1, 64))
+	}
+	return expr
+}
+
+func configFromRuleFiles(files []string, endpoint string) (Config, error) {
+	config := Config{Targets: map[string]Group{}}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return Config{}, err
+		}
+
+		var rf ruleFile
+		if err := yaml.Unmarshal(data, &rf); err != nil {
+			return Config{}, fmt.Errorf("%s: %v", file, err)
+		}
+
+		for _, g := range rf.Groups {
+			if _, exists := config.Targets[g.Name]; exists {
+				return Config{}, fmt.Errorf("%s: duplicate group %q", file, g.Name)
+			}
+			group := Group{Endpoint: endpoint}
+			for _, r := range g.Rules {
+				if r.Record == "" {
+					log.Printf("Skipping alerting rule %s in group %s", r.Alert, g.Name)
+					continue
+				}
+				if len(r.Labels) > 0 {
+					log.Printf("Dropping static labels of rule %s in group %s", r.Record, g.Name)
+				}
+				group.Rules = append(group.Rules, Rule{Record: r.Record, Expr: r.Expr})
+			}
+			if len(group.Rules) == 0 {
+				log.Printf("Skipping group %s without recording rules", g.Name)
+				continue
+			}
+			config.Targets[g.Name] = group
+		}
+	}
+	return config, nil
+}
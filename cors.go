@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsConfig holds the CORS settings of the browser-facing endpoints
+type corsConfig struct {
+	origins []string // allowed origins, * allows any
+	methods []string
+}
+
+// wrap adds CORS headers for allowed origins and answers preflight requests.
+// It must wrap authentication, as preflight requests carry no credentials.
+func (c corsConfig) wrap(h http.Handler) http.Handler {
+	if len(c.origins) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !c.allowed(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-Probe-Token, X-Tenant-Token")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c corsConfig) allowed(origin string) bool {
+	for _, allowed := range c.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// counterState tracks the exported value of one counter series
+type counterState struct {
+	last  float64 // last value returned by the query
+	total float64 // exported, monotonically increasing value
+}
+
+var (
+	countersMu sync.Mutex
+	counters   = map[string]map[string]counterState{} // target/rule -> series -> state
+)
+
+// updateCounters replaces the queried values of a counter rule with totals
+// that never decrease. A value lower than the previous one is a reset of the
+// upstream data: with counter_reset accumulate (the default) the new value is
+// counted as the increase since the reset, like rate() does, with ignore the
+// new value only becomes the baseline for the next increase. Series missing
+// from the result are forgotten and start over from their queried value.
+func updateCounters(target string, rule Rule, samples []Sample) {
+	key := target + "/" + ruleID(rule)
+
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	previous := counters[key]
+	current := make(map[string]counterState, len(samples))
+	for i := range samples {
+		if samples[i].NativeHistogram != nil {
+			continue
+		}
+		series := samples[i].Name + formatLabels(samples[i].Labels)
+		value := samples[i].Value
+
+		state, seen := previous[series]
+		switch {
+		case !seen:
+			state.total = value
+		case value >= state.last:
+			state.total += value - state.last
+		case rule.CounterReset == "ignore":
+		default:
+			state.total += value
+		}
+		state.last = value
+
+		current[series] = state
+		samples[i].Value = state.total
+	}
+	counters[key] = current
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// cueCommand evaluates .cue configuration files and checks YAML ones
+	// against the schema, set by --config.cue-command
+	cueCommand = "cue"
+	// cueValidate checks YAML configuration files against the schema before
+	// loading them, set by --config.cue-validate
+	cueValidate bool
+)
+
+// exportCUE returns the configuration the data of a .cue file without
+// package clause evaluates to together with the schema, which rejects unknown
+// settings and values of the wrong type
+func exportCUE(configFile string, data []byte) ([]byte, error) {
+	schema, err := writeCUESchema()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(schema)
+	return withConfigCopy(configFile, data, func(file string) ([]byte, error) {
+		return runConfigCommand(cueCommand, "export", "--out", "json", schema, file)
+	})
+}
+
+// vetCUE checks the YAML read from a configuration file against the schema.
+// cueCommand gets a copy of data, not the file, which may have changed since.
+func vetCUE(configFile string, data []byte) error {
+	schema, err := writeCUESchema()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(schema)
+	_, err = withConfigCopy(configFile, data, func(file string) ([]byte, error) {
+		return runConfigCommand(cueCommand, "vet", schema, file)
+	})
+	return err
+}
+
+// writeCUESchema writes the schema to a temporary file for cueCommand
+func writeCUESchema() (string, error) {
+	f, err := ioutil.TempFile("", "rules_exporter-*.cue")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(cueSchema())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// cueDefaults are the defaults the exporter applies to unset settings, by
+// type and YAML name, for the schema to fill them in
+var cueDefaults = map[string]interface{}{
+	"Sink.queue_size":               defaultSinkQueueSize,
+	"Sink.overflow":                 "drop_newest",
+	"Sink.batch_size":               1,
+	"Sink.retry_backoff":            defaultWebhookBackoff,
+	"Webhook.retries":               defaultWebhookRetries,
+	"Webhook.retry_backoff":         defaultWebhookBackoff,
+	"Webhook.timeout":               defaultWebhookTimeout,
+	"RemoteWriteSink.retries":       defaultWebhookRetries,
+	"RemoteWriteSink.retry_backoff": defaultWebhookBackoff,
+	"RemoteWriteSink.timeout":       defaultRemoteWriteTimeout,
+	"RemoteWriteSink.wal_max_size":  defaultWALMaxSize,
+	"RemoteWriteSink.send_metadata": true,
+	"GraphiteSink.timeout":          defaultGraphiteTimeout,
+	"MQTTSink.topic":                defaultMQTTTopic,
+	"MQTTSink.keep_alive":           defaultMQTTKeepAlive,
+	"MQTTSink.timeout":              defaultMQTTTimeout,
+	"NATSSink.subject":              defaultNATSSubject,
+	"NATSSink.timeout":              defaultNATSTimeout,
+	"ExecConfig.timeout":            defaultExecTimeout,
+	"ExecConfig.max_output_bytes":   defaultExecMaxOutput,
+	"Discovery.interval":            defaultDiscoveryInterval,
+}
+
+// cueSchema returns the CUE schema of the configuration, generated from the
+// types it is decoded into so it can't get out of date. Every setting is
+// optional; those in cueDefaults default to the value the exporter applies,
+// so cue export prints them and cue vet accepts the file without them.
+// Settings with their own YAML decoding, like on_empty, accept any value.
+func cueSchema() string {
+	var b strings.Builder
+	b.WriteString("// Schema of the rules_exporter configuration, written by rules_exporter schema\n\n")
+	b.WriteString("#Config\n\n")
+
+	unmarshaler := reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	duration := reflect.TypeOf(time.Duration(0))
+	defined := map[string]bool{}
+	var pending []reflect.Type
+
+	var cueType func(t reflect.Type) string
+	cueType = func(t reflect.Type) string {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch {
+		case t == duration:
+			return "#Duration"
+		case reflect.PtrTo(t).Implements(unmarshaler):
+			return "_"
+		}
+		switch t.Kind() {
+		case reflect.String:
+			return "string"
+		case reflect.Bool:
+			return "bool"
+		case reflect.Int, reflect.Int64, reflect.Int32:
+			return "int"
+		case reflect.Uint8:
+			return "uint8"
+		case reflect.Uint, reflect.Uint64, reflect.Uint32:
+			return "uint"
+		case reflect.Float64, reflect.Float32:
+			return "number"
+		case reflect.Slice:
+			return "[..." + cueType(t.Elem()) + "]"
+		case reflect.Map:
+			return "{[string]: " + cueType(t.Elem()) + "}"
+		case reflect.Struct:
+			name := "#" + t.Name()
+			if !defined[name] {
+				defined[name] = true
+				pending = append(pending, t)
+			}
+			return name
+		}
+		return "_"
+	}
+
+	cueType(reflect.TypeOf(Config{}))
+	for len(pending) > 0 {
+		t := pending[0]
+		pending = pending[1:]
+		fmt.Fprintf(&b, "#%s: {\n", t.Name())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			switch def := cueDefaults[t.Name()+"."+name].(type) {
+			case nil:
+				fmt.Fprintf(&b, "\t%q?: %s\n", name, cueType(field.Type))
+			case time.Duration:
+				fmt.Fprintf(&b, "\t%q: *%q | %s\n", name, def.String(), cueType(field.Type))
+			case string:
+				fmt.Fprintf(&b, "\t%q: *%q | %s\n", name, def, cueType(field.Type))
+			default:
+				fmt.Fprintf(&b, "\t%q: *%v | %s\n", name, def, cueType(field.Type))
+			}
+		}
+		b.WriteString("}\n\n")
+	}
+	b.WriteString("#Duration: =~\"^-?([0-9]+(\\\\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$\" | \"0\" | int\n")
+	return b.String()
+}
+
+// schemaCommand prints the CUE schema of the configuration, for .cue
+// configuration files and editors
+func schemaCommand(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	output := fs.String("output", "", "File to write the schema to instead of stdout.")
+	fs.Parse(args)
+
+	schema := cueSchema()
+	if *output == "" {
+		_, err := fmt.Print(schema)
+		return err
+	}
+	return ioutil.WriteFile(*output, []byte(schema), 0644)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DatadogConfig configures the datadog datasource, which runs metric queries
+// like avg:system.cpu.user{env:prod} by {host} with the v1 query API
+type DatadogConfig struct {
+	APIKey string `yaml:"api_key"`
+	AppKey string `yaml:"app_key"`
+	// Site is the Datadog site, datadoghq.com by default. The endpoint of the
+	// target overrides it.
+	Site string `yaml:"site,omitempty"`
+}
+
+// DatadogQuery configures a rule of a datadog target
+type DatadogQuery struct {
+	// Window is how far back to look for the latest point, 5m by default
+	Window time.Duration `yaml:"window,omitempty"`
+}
+
+const (
+	defaultDatadogSite   = "datadoghq.com"
+	defaultDatadogWindow = 5 * time.Minute
+)
+
+func init() {
+	datasourceTypes["datadog"] = newDatadogDatasource
+	defaultEndpoints["datadog"] = func(group Group) string {
+		site := defaultDatadogSite
+		if group.Datadog != nil && group.Datadog.Site != "" {
+			site = group.Datadog.Site
+		}
+		return "https://api." + site
+	}
+}
+
+type datadogDatasource struct {
+	group  Group
+	config DatadogConfig
+}
+
+func newDatadogDatasource(group Group) (Datasource, error) {
+	c := group.Datadog
+	if c == nil || c.APIKey == "" || c.AppKey == "" {
+		return nil, fmt.Errorf("datadog targets need api_key and app_key")
+	}
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		if rule.Datadog != nil && rule.Datadog.Window < 0 {
+			return nil, fmt.Errorf("rule %s: window must not be negative", ruleID(rule))
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return nil, fmt.Errorf("rule %s: datadog targets only support gauge and counter rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: datadog targets don't support join", ruleID(rule))
+		}
+	}
+	return datadogDatasource{group: group, config: *c}, nil
+}
+
+func (d datadogDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return d.QueryRule(ctx, Rule{}, expr, at)
+}
+
+func (d datadogDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	window := defaultDatadogWindow
+	if rule.Datadog != nil && rule.Datadog.Window != 0 {
+		window = rule.Datadog.Window
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	endpoint := groupEndpoint(d.group)
+	params := url.Values{
+		"query": {expr},
+		"from":  {strconv.FormatInt(at.Add(-window).Unix(), 10)},
+		"to":    {strconv.FormatInt(at.Unix(), 10)},
+	}
+
+	client, err := clientFor(d.group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/api/v1/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("DD-API-KEY", d.config.APIKey)
+	req.Header.Set("DD-APPLICATION-KEY", d.config.AppKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var response struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(body, &response) == nil && len(response.Errors) > 0 {
+			return nil, responseError(resp.StatusCode, []byte(strings.Join(response.Errors, "; ")))
+		}
+		return nil, responseError(resp.StatusCode, body)
+	}
+	return parseDatadogResponse(body)
+}
+
+// parseDatadogResponse returns the latest point of every series, with the
+// tags as labels
+func parseDatadogResponse(body []byte) ([]map[string]interface{}, error) {
+	var response struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Series []struct {
+			TagSet    []string     `json:"tag_set"`
+			Pointlist [][]*float64 `json:"pointlist"`
+		} `json:"series"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, &parseError{err}
+	}
+	if response.Status == "error" {
+		return nil, fmt.Errorf("datadog: %s", response.Error)
+	}
+
+	var results []map[string]interface{}
+	for _, series := range response.Series {
+		// Points are [timestamp, value] oldest first, with null values for
+		// gaps
+		var value *float64
+		for _, point := range series.Pointlist {
+			if len(point) == 2 && point[1] != nil {
+				value = point[1]
+			}
+		}
+		if value == nil {
+			continue
+		}
+		result := map[string]interface{}{"value": strconv.FormatFloat(*value, 'g', -1, 64)}
+		for _, tag := range series.TagSet {
+			name, v, ok := strings.Cut(tag, ":")
+			if !ok || v == "" {
+				continue
+			}
+			// Tags named like the keys of the value and of the metric name
+			// are left out
+			if name = sanitizeLabelName(name); name != "value" && name != "__name__" {
+				result[name] = v
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Datasource runs the queries of the rules of a target. Results are label
+// maps with the sample value under "value", see parseQueryResponse.
+type Datasource interface {
+	Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error)
+}
+
+// ruleDatasource is implemented by datasources that need the settings of the
+// rule besides the expression
+type ruleDatasource interface {
+	QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error)
+}
+
+// ruleSettings identifies the datasource settings of a rule in query cache
+// keys, as rules with the same expression may select different results
+func ruleSettings(rule Rule) string {
+	settings := struct {
+		JSON       *JSONExtract      `yaml:"json,omitempty"`
+		Azure      *AzureMetric      `yaml:"azure,omitempty"`
+		CloudWatch *CloudWatchMetric `yaml:"cloudwatch,omitempty"`
+		GCP        *GCPQuery         `yaml:"gcp,omitempty"`
+		Datadog    *DatadogQuery     `yaml:"datadog,omitempty"`
+		NewRelic   *NewRelicQuery    `yaml:"newrelic,omitempty"`
+	}{rule.JSON, rule.Azure, rule.CloudWatch, rule.GCP, rule.Datadog, rule.NewRelic}
+	data, err := yaml.Marshal(settings)
+	if err != nil || string(data) == "{}\n" {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// queryRule runs a query of the rule on the datasource
+func queryRule(ctx context.Context, datasource Datasource, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	if d, ok := datasource.(ruleDatasource); ok {
+		return d.QueryRule(ctx, rule, expr, at)
+	}
+	return datasource.Query(ctx, expr, at)
+}
+
+// datasourceTypes maps the type of a target to the constructor of its
+// datasource, which also validates the settings of the target. prometheus is
+// used for targets without type.
+var datasourceTypes = map[string]func(group Group) (Datasource, error){
+	"prometheus": newPrometheusDatasource,
+}
+
+// defaultEndpoints return the endpoint datasources of a type query when the
+// target doesn't set one
+var defaultEndpoints = map[string]func(group Group) string{}
+
+// groupEndpoint returns the endpoint the datasource of a group queries
+func groupEndpoint(group Group) string {
+	if f, exists := defaultEndpoints[group.Type]; exists && group.Endpoint == "" {
+		return f(group)
+	}
+	return group.Endpoint
+}
+
+// newDatasource returns the datasource of a group
+func newDatasource(group Group) (Datasource, error) {
+	kind := group.Type
+	if kind == "" {
+		kind = "prometheus"
+	}
+	constructor, exists := datasourceTypes[kind]
+	if !exists {
+		var types []string
+		for t := range datasourceTypes {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return nil, fmt.Errorf("unknown type %q, expected one of %s", group.Type, strings.Join(types, ", "))
+	}
+	// Compute rules don't query the datasource
+	group.Rules = queryRules(group.Rules)
+	return constructor(group)
+}
+
+// prometheusDatasource queries the instant query API of a Prometheus
+// compatible endpoint
+type prometheusDatasource struct {
+	group Group
+}
+
+func newPrometheusDatasource(group Group) (Datasource, error) {
+	if err := validateEndpoint(group.Endpoint); err != nil {
+		return nil, err
+	}
+	return prometheusDatasource{group: group}, nil
+}
+
+func (p prometheusDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	body, err := fetchQuery(ctx, p.group, expr, at)
+	if err != nil {
+		return nil, err
+	}
+	results, warnings, err := parseQueryResponse(body)
+	if len(warnings) > 0 {
+		log.Printf("Warnings for query %s on %s: %s", expr, p.group.Endpoint, strings.Join(warnings, "; "))
+	}
+	return results, err
+}
+
+// sanitizeLabelName turns the name of a dimension or tag of another system
+// into a valid label name by replacing invalid characters with _
+func sanitizeLabelName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		valid := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || i > 0 && '0' <= c && c <= '9'
+		if !valid {
+			if i == 0 && '0' <= c && c <= '9' {
+				b.WriteRune('_')
+				b.WriteRune(c)
+				continue
+			}
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
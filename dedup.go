@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validateDedup checks the replica deduplication settings of a target
+func validateDedup(group Group) error {
+	for _, label := range group.ReplicaLabels {
+		if label == "" || label == "value" || label == "__name__" {
+			return fmt.Errorf("invalid replica label %q", label)
+		}
+	}
+	switch group.ReplicaDedup {
+	case "", "first", "max", "min":
+	default:
+		return fmt.Errorf("unknown replica_dedup %q, expected first, max or min", group.ReplicaDedup)
+	}
+	if group.ReplicaDedup != "" && len(group.ReplicaLabels) == 0 {
+		return fmt.Errorf("replica_dedup needs replica_labels")
+	}
+	return nil
+}
+
+// dedupReplicas drops the replica labels of the group from query results and
+// keeps one result of the series that only differed by them: the first one
+// in the order of the response, or the one with the highest or lowest value
+// with replica_dedup max or min. Results without a comparable value, like
+// native histograms, always keep the first one.
+func dedupReplicas(group Group, results []map[string]interface{}) []map[string]interface{} {
+	if len(group.ReplicaLabels) == 0 {
+		return results
+	}
+	deduped := make([]map[string]interface{}, 0, len(results))
+	seen := map[string]int{}
+	for _, result := range results {
+		stripped := make(map[string]interface{}, len(result))
+		for name, value := range result {
+			stripped[name] = value
+		}
+		for _, label := range group.ReplicaLabels {
+			delete(stripped, label)
+		}
+		key := seriesKey(stripped)
+		i, exists := seen[key]
+		if !exists {
+			seen[key] = len(deduped)
+			deduped = append(deduped, stripped)
+			continue
+		}
+		if replaces(group.ReplicaDedup, resultValue(stripped), resultValue(deduped[i])) {
+			deduped[i] = stripped
+		}
+	}
+	return deduped
+}
+
+// seriesKey identifies the series of a result by its string labels
+func seriesKey(result map[string]interface{}) string {
+	var names []string
+	for name, value := range result {
+		if _, ok := value.(string); ok && name != "value" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, result[name])
+	}
+	return b.String()
+}
+
+// resultValue returns the value of a result, NaN if it has none
+func resultValue(result map[string]interface{}) float64 {
+	s, ok := result["value"].(string)
+	if !ok {
+		return math.NaN()
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+// replaces tells whether a duplicate with value v replaces the kept one with
+// value kept. Values are preferred over NaN.
+func replaces(dedup string, v, kept float64) bool {
+	switch {
+	case dedup != "max" && dedup != "min", math.IsNaN(v):
+		return false
+	case math.IsNaN(kept):
+		return true
+	case dedup == "max":
+		return v > kept
+	}
+	return v < kept
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Discovery generates targets from the values of a label returned by a query
+type Discovery struct {
+	// Name identifies the discovery in logs and metrics
+	Name string `yaml:"name"`
+	// Endpoint and HTTPClient are used to run the query, as for targets
+	Endpoint   string           `yaml:"endpoint"`
+	HTTPClient HTTPClientConfig `yaml:"http_client,omitempty"`
+	Query      string           `yaml:"query"`
+	// Label is the label whose values each become a target
+	Label string `yaml:"label"`
+	// Interval is how often the query runs, 5m by default
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// TargetName is the template of the target names, <name>-{{ .Value }} by
+	// default
+	TargetName string `yaml:"target_name,omitempty"`
+	// Target is the template of the generated targets. {{ .Value }} in its
+	// settings is replaced by the label value, {{ quote .Value }} by the
+	// value as a quoted string, to use in label matchers of expressions.
+	Target Group `yaml:"target"`
+}
+
+// discoveryFuncs are the functions of the templates of discoveries
+var discoveryFuncs = template.FuncMap{
+	// quote escapes a label value for a PromQL string literal
+	"quote": strconv.Quote,
+}
+
+const defaultDiscoveryInterval = 5 * time.Minute
+
+func (d Discovery) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if err := validateEndpoint(d.Endpoint); err != nil {
+		return err
+	}
+	if d.Query == "" || d.Label == "" {
+		return fmt.Errorf("missing query or label")
+	}
+	if d.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if _, err := template.New("target_name").Funcs(discoveryFuncs).Parse(d.TargetName); err != nil {
+		return fmt.Errorf("invalid target_name: %v", err)
+	}
+	if len(d.Target.AggregateOf) > 0 {
+		return fmt.Errorf("aggregate targets can't be discovered")
+	}
+	return d.HTTPClient.validate(d.Endpoint)
+}
+
+// group returns a group querying the endpoint of the discovery
+func (d Discovery) group() Group {
+	return Group{Endpoint: d.Endpoint, HTTPClient: d.HTTPClient}
+}
+
+var (
+	discoveredTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_discovery_targets",
+		Help: "Number of targets generated by the discovery.",
+	}, []string{"discovery"})
+	discoveryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_discovery_errors_total",
+		Help: "Number of failed discovery queries.",
+	}, []string{"discovery"})
+
+	// discoveryMu guards the state below and serializes changes of the
+	// current configuration
+	discoveryMu sync.Mutex
+	// fileConfig is the configuration loaded from the file, without the
+	// discovered targets
+	fileConfig Config
+	discovered = map[string]map[string]Group{} // discovery -> target name -> group
+	// discoveryStop is closed to stop the running discoveries
+	discoveryStop chan struct{}
+)
+
+func init() {
+	prometheus.MustRegister(discoveredTargets, discoveryErrors)
+}
+
+// applyConfig makes the configuration loaded from the file current, together
+// with the targets discovered so far
+func applyConfig(config Config) error {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+	if err := replaceConfig(withDiscoveredTargets(config)); err != nil {
+		return err
+	}
+	fileConfig = config
+	return nil
+}
+
+// withDiscoveredTargets adds the discovered targets of the discoveries of
+// config. Targets of the file take precedence over discovered ones.
+func withDiscoveredTargets(config Config) Config {
+	if len(config.Discovery) == 0 {
+		return config
+	}
+	targets := make(map[string]Group, len(config.Targets))
+	for name, group := range config.Targets {
+		targets[name] = group
+	}
+	for _, d := range config.Discovery {
+		for name, group := range discovered[d.Name] {
+			if _, exists := targets[name]; exists {
+				log.Printf("Discovery %s: target %s is already configured", d.Name, name)
+				continue
+			}
+			targets[name] = group
+		}
+	}
+	config.Targets = targets
+	return config
+}
+
+// startDiscovery runs the discoveries of the configuration file in the
+// background, replacing those that were running. onChange is called with the
+// new configuration whenever the discovered targets change.
+func startDiscovery(onChange func(Config)) {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+	if discoveryStop != nil {
+		close(discoveryStop)
+	}
+	discoveryStop = make(chan struct{})
+
+	names := map[string]bool{}
+	for _, d := range fileConfig.Discovery {
+		names[d.Name] = true
+		go runDiscovery(d, discoveryStop, onChange)
+	}
+	for name := range discovered {
+		if !names[name] {
+			delete(discovered, name)
+			discoveredTargets.DeleteLabelValues(name)
+		}
+	}
+}
+
+func runDiscovery(d Discovery, stop <-chan struct{}, onChange func(Config)) {
+	interval := d.Interval
+	if interval == 0 {
+		interval = defaultDiscoveryInterval
+	}
+	for {
+		targets, err := discoverTargets(d)
+		if err != nil {
+			log.Printf("Error running discovery %s: %v", d.Name, err)
+			discoveryErrors.WithLabelValues(d.Name).Inc()
+		} else {
+			updateDiscovered(d, targets, stop, onChange)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// updateDiscovered makes the new targets of a discovery current
+func updateDiscovered(d Discovery, targets map[string]Group, stop <-chan struct{}, onChange func(Config)) {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+	select {
+	case <-stop:
+		// The discovery was replaced while it ran
+		return
+	default:
+	}
+	if previous, exists := discovered[d.Name]; exists && reflect.DeepEqual(previous, targets) {
+		return
+	}
+
+	discovered[d.Name] = targets
+	discoveredTargets.WithLabelValues(d.Name).Set(float64(len(targets)))
+	config := withDiscoveredTargets(fileConfig)
+	if err := replaceConfig(config); err != nil {
+		log.Printf("Error applying targets of discovery %s: %v", d.Name, err)
+		return
+	}
+	log.Printf("Discovery %s found %d targets", d.Name, len(targets))
+	onChange(config)
+}
+
+// discoverTargets runs the query of a discovery and generates a target for
+// every value of its label. Targets that turn out invalid are left out.
+func discoverTargets(d Discovery) (map[string]Group, error) {
+	datasource, err := newDatasource(d.group())
+	if err != nil {
+		return nil, err
+	}
+	results, err := datasource.Query(context.Background(), d.Query, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]bool{}
+	for _, result := range results {
+		if value, ok := result[d.Label].(string); ok && value != "" {
+			values[value] = true
+		}
+	}
+	var sorted []string
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Strings(sorted)
+
+	nameTemplate := d.TargetName
+	if nameTemplate == "" {
+		nameTemplate = d.Name + "-{{ .Value }}"
+	}
+	targets := map[string]Group{}
+	for _, value := range sorted {
+		data := struct{ Value string }{value}
+		name, err := expandTemplate(nameTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		group, err := expandGroup(d.Target, data)
+		if err == nil {
+			err = validateConfig(Config{Tenants: getConfig().Tenants, Targets: map[string]Group{name: group}})
+		}
+		if err != nil {
+			log.Printf("Discovery %s: skipping %s=%q: %v", d.Name, d.Label, value, err)
+			continue
+		}
+		targets[name] = activeGroupRules(group)
+	}
+	return targets, nil
+}
+
+// expandGroup returns a copy of the template group with the templates in all
+// of its settings executed
+func expandGroup(tmpl Group, data interface{}) (Group, error) {
+	out, err := yaml.Marshal(tmpl)
+	if err != nil {
+		return Group{}, err
+	}
+	var group Group
+	if err := yaml.Unmarshal(out, &group); err != nil {
+		return Group{}, err
+	}
+	if err := expandStrings(reflect.ValueOf(&group).Elem(), data); err != nil {
+		return Group{}, err
+	}
+	return group, nil
+}
+
+// expandStrings executes the templates in the settable strings of v
+func expandStrings(v reflect.Value, data interface{}) error {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() && strings.Contains(v.String(), "{{") {
+			s, err := expandTemplate(v.String(), data)
+			if err != nil {
+				return err
+			}
+			v.SetString(s)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandStrings(v.Elem(), data)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := expandStrings(v.Field(i), data); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandStrings(v.Index(i), data); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map entries can't be set, the map is rebuilt from expanded copies
+		// of its keys and values
+		if !v.CanSet() || v.IsNil() {
+			return nil
+		}
+		expanded := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := reflect.New(v.Type().Key()).Elem()
+			key.Set(iter.Key())
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			if err := expandStrings(key, data); err != nil {
+				return err
+			}
+			if err := expandStrings(value, data); err != nil {
+				return err
+			}
+			expanded.SetMapIndex(key, value)
+		}
+		v.Set(expanded)
+	}
+	return nil
+}
+
+func expandTemplate(text string, data interface{}) (string, error) {
+	t, err := template.New("").Funcs(discoveryFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const execLimitsSupported = true
+
+func init() {
+	commands["exec-limits"] = execLimitsCommand
+}
+
+// execSysProcAttr returns the attributes running exec commands as the user
+// and group, nil if neither is set
+func execSysProcAttr(userName, groupName string) (*syscall.SysProcAttr, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{
+		Uid:    uint32(syscall.Getuid()),
+		Gid:    uint32(syscall.Getgid()),
+		Groups: []uint32{},
+	}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, isID := err.(user.UnknownUserError); isID {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("exec user: %v", err)
+		}
+		if credential.Uid, err = parseID(u.Uid); err != nil {
+			return nil, fmt.Errorf("exec user: %v", err)
+		}
+		if credential.Gid, err = parseID(u.Gid); err != nil {
+			return nil, fmt.Errorf("exec user: %v", err)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, isID := err.(user.UnknownGroupError); isID {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("exec group: %v", err)
+		}
+		if credential.Gid, err = parseID(g.Gid); err != nil {
+			return nil, fmt.Errorf("exec group: %v", err)
+		}
+	}
+	return &syscall.SysProcAttr{Credential: credential}, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+// execLimitsArgs returns the arguments of the exec-limits command setting
+// the limits, to be followed by the command
+func execLimitsArgs(limits ExecLimits) []string {
+	cpuTime := uint64(limits.CPUTime.Seconds())
+	if limits.CPUTime > 0 && cpuTime == 0 {
+		cpuTime = 1
+	}
+	return []string{
+		"exec-limits",
+		"--cpu-time=" + strconv.FormatUint(cpuTime, 10),
+		"--memory-bytes=" + strconv.FormatUint(limits.MemoryBytes, 10),
+		"--open-files=" + strconv.FormatUint(limits.OpenFiles, 10),
+		"--processes=" + strconv.FormatUint(limits.Processes, 10),
+		"--",
+	}
+}
+
+// execLimitsCommand lowers its own resource limits and replaces itself with
+// the command, so that the limits apply from its start. It is run by exec
+// targets with limits.
+func execLimitsCommand(args []string) error {
+	fs := flag.NewFlagSet("exec-limits", flag.ExitOnError)
+	cpuTime := fs.Uint64("cpu-time", 0, "RLIMIT_CPU in seconds, 0 keeps the current limit.")
+	memoryBytes := fs.Uint64("memory-bytes", 0, "RLIMIT_AS in bytes, 0 keeps the current limit.")
+	openFiles := fs.Uint64("open-files", 0, "RLIMIT_NOFILE, 0 keeps the current limit.")
+	processes := fs.Uint64("processes", 0, "RLIMIT_NPROC, 0 keeps the current limit.")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("missing command")
+	}
+
+	for _, limit := range []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, *cpuTime},
+		{unix.RLIMIT_AS, *memoryBytes},
+		{unix.RLIMIT_NOFILE, *openFiles},
+		{unix.RLIMIT_NPROC, *processes},
+	} {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := unix.Rlimit{Cur: limit.value, Max: limit.value}
+		if err := unix.Setrlimit(limit.resource, &rlimit); err != nil {
+			return fmt.Errorf("setting limit %d: %v", limit.resource, err)
+		}
+	}
+
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, fs.Args(), os.Environ())
+}
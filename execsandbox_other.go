@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const execLimitsSupported = false
+
+// execSysProcAttr fails if a user or group is set, which is only supported
+// on Linux
+func execSysProcAttr(userName, groupName string) (*syscall.SysProcAttr, error) {
+	if userName != "" || groupName != "" {
+		return nil, fmt.Errorf("exec user and group are only supported on Linux")
+	}
+	return nil, nil
+}
+
+// execLimitsArgs is never called, limits are rejected on other systems
+func execLimitsArgs(limits ExecLimits) []string {
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExecConfig configures the exec datasource, which runs a command for every
+// query. The expression is passed as last argument and the command writes
+// the results to stdout as JSON, a list of objects with labels and value:
+//
+//	[{"labels": {"job": "a"}, "value": 1.5}]
+//
+// A non-zero exit status fails the query with the end of stderr as error.
+// On Linux the command can run as another user and with resource limits.
+type ExecConfig struct {
+	// Command is the program to run and its first arguments
+	Command []string `yaml:"command"`
+	// Timeout kills the command after this long, 10s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Dir is the working directory of the command
+	Dir string `yaml:"dir,omitempty"`
+	// Env is added to the environment of the command, which otherwise only
+	// has PATH of the exporter unless InheritEnv is set
+	Env        map[string]string `yaml:"env,omitempty"`
+	InheritEnv bool              `yaml:"inherit_env,omitempty"`
+	// MaxOutputBytes fails queries writing more to stdout, 1MiB by default
+	MaxOutputBytes int64 `yaml:"max_output_bytes,omitempty"`
+	// User and Group run the command as another user and group, names or
+	// numeric ids, which needs the exporter to run as root. Group is the
+	// primary group of User by default, supplementary groups are dropped.
+	User  string `yaml:"user,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Limits are resource limits of the command
+	Limits ExecLimits `yaml:"limits,omitempty"`
+}
+
+// ExecLimits are resource limits of exec commands, unlimited if 0. They are
+// set by running the command through the exporter binary, which must be
+// executable by the user of the command.
+type ExecLimits struct {
+	// CPUTime kills the command after using this much CPU time, in whole
+	// seconds (RLIMIT_CPU)
+	CPUTime time.Duration `yaml:"cpu_time,omitempty"`
+	// MemoryBytes limits the address space of the command (RLIMIT_AS)
+	MemoryBytes uint64 `yaml:"memory_bytes,omitempty"`
+	// OpenFiles limits the open file descriptors (RLIMIT_NOFILE)
+	OpenFiles uint64 `yaml:"open_files,omitempty"`
+	// Processes limits the processes of the user running the command
+	// (RLIMIT_NPROC)
+	Processes uint64 `yaml:"processes,omitempty"`
+}
+
+func (l ExecLimits) empty() bool {
+	return l == ExecLimits{}
+}
+
+const (
+	defaultExecTimeout   = 10 * time.Second
+	defaultExecMaxOutput = 1 << 20
+)
+
+func init() {
+	datasourceTypes["exec"] = newExecDatasource
+}
+
+type execDatasource struct {
+	config ExecConfig
+	// sysProcAttr runs the command as another user, nil for the exporter's
+	sysProcAttr *syscall.SysProcAttr
+}
+
+func newExecDatasource(group Group) (Datasource, error) {
+	c := group.Exec
+	if c == nil || len(c.Command) == 0 || c.Command[0] == "" {
+		return nil, fmt.Errorf("exec targets need exec.command")
+	}
+	if c.Timeout < 0 || c.MaxOutputBytes < 0 || c.Limits.CPUTime < 0 {
+		return nil, fmt.Errorf("exec timeout, max_output_bytes and cpu_time must not be negative")
+	}
+	sysProcAttr, err := execSysProcAttr(c.User, c.Group)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Limits.empty() && !execLimitsSupported {
+		return nil, fmt.Errorf("exec limits are only supported on Linux")
+	}
+	return execDatasource{config: *c, sysProcAttr: sysProcAttr}, nil
+}
+
+// environ returns the environment of the command. RULES_EXPORTER_TIME is
+// the evaluation time in unix seconds if the rule is aligned.
+func (e execDatasource) environ(at time.Time) []string {
+	var env []string
+	if e.config.InheritEnv {
+		env = os.Environ()
+	} else if path, exists := os.LookupEnv("PATH"); exists {
+		env = []string{"PATH=" + path}
+	}
+	var names []string
+	for name := range e.config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+e.config.Env[name])
+	}
+	if !at.IsZero() {
+		env = append(env, "RULES_EXPORTER_TIME="+strconv.FormatInt(at.Unix(), 10))
+	}
+	return env
+}
+
+func (e execDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	timeout := e.config.Timeout
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	maxOutput := e.config.MaxOutputBytes
+	if maxOutput == 0 {
+		maxOutput = defaultExecMaxOutput
+	}
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: 4096, truncate: true}
+
+	name := e.config.Command[0]
+	args := append(append([]string{}, e.config.Command[1:]...), expr)
+	if !e.config.Limits.empty() {
+		// The exporter itself sets the limits and then runs the command
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		name, args = self, append(append(execLimitsArgs(e.config.Limits), name), args...)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = e.config.Dir
+	cmd.Env = e.environ(at)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// Don't wait for children that keep the output open after a kill
+	cmd.WaitDelay = time.Second
+	cmd.SysProcAttr = e.sysProcAttr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", e.config.Command[0], ctx.Err())
+		}
+		if stdout.exceeded {
+			return nil, fmt.Errorf("%s: output exceeds %d bytes", e.config.Command[0], maxOutput)
+		}
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", e.config.Command[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", e.config.Command[0], err)
+	}
+	return parseExecOutput(stdout.buf.Bytes())
+}
+
+// execSample is a result written by an exec command. The value is a number
+// or a string, which allows NaN and ±Inf.
+type execSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  interface{}       `json:"value"`
+}
+
+func parseExecOutput(output []byte) ([]map[string]interface{}, error) {
+	var samples []execSample
+	if err := json.Unmarshal(output, &samples); err != nil {
+		return nil, &parseError{err}
+	}
+	results := make([]map[string]interface{}, 0, len(samples))
+	for _, sample := range samples {
+		var value float64
+		switch v := sample.Value.(type) {
+		case float64:
+			value = v
+		case string:
+			var err error
+			if value, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, &parseError{fmt.Errorf("invalid value %q", v)}
+			}
+		default:
+			return nil, &parseError{fmt.Errorf("value must be a number or string")}
+		}
+		result := make(map[string]interface{}, len(sample.Labels)+1)
+		for name, v := range sample.Labels {
+			// Empty labels are the same as missing ones
+			if v != "" {
+				result[name] = v
+			}
+		}
+		result["value"] = strconv.FormatFloat(value, 'g', -1, 64)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// limitedBuffer keeps at most max bytes. Writes beyond fail, or are dropped
+// if truncate is set.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	truncate bool
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(b.buf.Len()); int64(len(p)) > room {
+		b.exceeded = true
+		b.buf.Write(p[:max(room, 0)])
+		if b.truncate {
+			return len(p), nil
+		}
+		return 0, fmt.Errorf("output exceeds %d bytes", b.max)
+	}
+	return b.buf.Write(p)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Exemplar is an exemplar of an upstream series of a sample, like the trace
+// of a request counted in a histogram bucket
+type Exemplar struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+// attachExemplars sets the exemplar of every sample to the latest exemplar,
+// within the exemplar_window of the rule, of the upstream series whose
+// labels include those of the sample. Failing to fetch exemplars is logged
+// and leaves the samples without them.
+func attachExemplars(ctx context.Context, target string, group Group, rule Rule, samples []Sample) {
+	if rule.ExemplarWindow <= 0 || len(samples) == 0 {
+		return
+	}
+	end := time.Now()
+	series, err := fetchExemplars(ctx, group, rule.Expr, end.Add(-rule.ExemplarWindow), end)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error querying exemplars for rule %s in target %s: %v", ruleID(rule), target, err)
+		}
+		return
+	}
+	for i := range samples {
+		for _, s := range series {
+			if !includesLabels(s.labels, samples[i].Labels) {
+				continue
+			}
+			for j := range s.exemplars {
+				e := &s.exemplars[j]
+				if samples[i].Exemplar == nil || e.Timestamp.After(samples[i].Exemplar.Timestamp) {
+					samples[i].Exemplar = e
+				}
+			}
+		}
+	}
+}
+
+func includesLabels(labels map[string]string, subset map[string]string) bool {
+	for name, value := range subset {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+type exemplarSeries struct {
+	labels    map[string]string
+	exemplars []Exemplar
+}
+
+// fetchExemplars queries the exemplar API of a Prometheus compatible
+// endpoint
+func fetchExemplars(ctx context.Context, group Group, query string, start, end time.Time) ([]exemplarSeries, error) {
+	client, err := clientFor(group)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(start.Unix(), 10)},
+		"end":   {strconv.FormatInt(end.Unix(), 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v1/query_exemplars?%s", group.Endpoint, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var response struct {
+		Status string `json:"status"`
+		Data   []struct {
+			SeriesLabels map[string]string `json:"seriesLabels"`
+			Exemplars    []struct {
+				Labels    map[string]string `json:"labels"`
+				Value     string            `json:"value"`
+				Timestamp float64           `json:"timestamp"`
+			} `json:"exemplars"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, &parseError{err}
+	}
+	if response.Status != "success" {
+		return nil, responseError(http.StatusOK, body)
+	}
+	var series []exemplarSeries
+	for _, data := range response.Data {
+		s := exemplarSeries{labels: data.SeriesLabels}
+		for _, e := range data.Exemplars {
+			value, err := strconv.ParseFloat(e.Value, 64)
+			if err != nil {
+				return nil, &parseError{fmt.Errorf("invalid exemplar value %q", e.Value)}
+			}
+			sec, frac := math.Modf(e.Timestamp)
+			s.exemplars = append(s.exemplars, Exemplar{
+				Labels:    e.Labels,
+				Value:     value,
+				Timestamp: time.Unix(int64(sec), int64(frac*1e9)),
+			})
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
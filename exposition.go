@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/riclib/rules_exporter/cache"
+)
+
+// exposition is a response rendered in one of the exposition formats
+type exposition struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+var (
+	// compressionThreshold is the smallest body sent gzip compressed
+	compressionThreshold = 1024
+
+	responseCache = cache.NewCache()
+)
+
+// renderExposition gathers the collectors and encodes them in the given
+// format. Invalid series are logged and left out instead of failing.
+func renderExposition(format expfmt.Format, collectors ...prometheus.Collector) (exposition, error) {
+	registry := prometheus.NewRegistry()
+	for _, c := range collectors {
+		registry.MustRegister(c)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		log.Printf("Error gathering metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return exposition{}, err
+		}
+	}
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return exposition{}, err
+		}
+	}
+	return newExposition(buf.Bytes(), string(format)), nil
+}
+
+// newExposition tags a rendered body for conditional requests. The content
+// type is part of the tag, as the same samples differ per format.
+func newExposition(body []byte, contentType string) exposition {
+	sum := sha256.Sum256(append([]byte(contentType), body...))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	return exposition{body: body, contentType: contentType, etag: etag}
+}
+
+// cachedExposition returns the exposition cached under key in the namespace
+// of the target or renders and caches it for ttl. Concurrent requests for
+// the same key wait for a single render, so the upstream is only queried
+// once. Waiting stops when ctx is done.
+func cachedExposition(ctx context.Context, target, key string, ttl time.Duration, render func() (exposition, error)) (exposition, error) {
+	for {
+		rendered := false
+		cached, err := responseCache.Namespace(target).FetchContext(ctx, key, ttl, func(context.Context) (interface{}, error) {
+			rendered = true
+			return render()
+		})
+		if err != nil && !rendered && ctx.Err() == nil && errors.Is(err, context.Canceled) {
+			// The probe that rendered it was cancelled while this one
+			// waited for it, render again
+			continue
+		}
+		if err != nil {
+			return exposition{}, err
+		}
+		return cached.(exposition), nil
+	}
+}
+
+// expositionSize estimates the memory used by a cached exposition
+func expositionSize(key string, value interface{}) int64 {
+	e := value.(exposition)
+	return int64(len(key) + len(e.body) + len(e.contentType) + len(e.etag))
+}
+
+// writeExposition sends a rendered exposition, gzip compressed if accepted
+// and at least compressionThreshold bytes large. Requests with a matching
+// If-None-Match get 304 Not Modified.
+func writeExposition(w http.ResponseWriter, r *http.Request, e exposition) {
+	w.Header().Set("ETag", e.etag)
+	if etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(e.body) < compressionThreshold || !gzipAccepted(r.Header) {
+		w.Write(e.body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write(e.body)
+	gz.Close()
+}
+
+// etagMatches implements the weak comparison of If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipAccepted(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCollectors renders the collectors in the format negotiated with the
+// scraper
+func serveCollectors(w http.ResponseWriter, r *http.Request, collectors ...prometheus.Collector) {
+	e, err := renderExposition(expfmt.Negotiate(r.Header), collectors...)
+	if err != nil {
+		http.Error(w, "Error rendering metrics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeExposition(w, r, e)
+}
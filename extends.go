@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// targetNode keeps the YAML of a target to decode it on top of the target it
+// extends
+type targetNode struct {
+	extends   string
+	unmarshal func(interface{}) error
+}
+
+func (t *targetNode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var settings struct {
+		Extends string `yaml:"extends"`
+	}
+	if err := unmarshal(&settings); err != nil {
+		return err
+	}
+	t.extends, t.unmarshal = settings.Extends, unmarshal
+	return nil
+}
+
+// resolveExtends applies extends to the targets of config, read from data. A
+// target extending another one starts from its settings: the settings it has
+// itself override those of the other target, nested settings like
+// http_client are merged, and its rules replace the inherited rules with the
+// same record or are appended.
+func resolveExtends(data []byte, config *Config) error {
+	var raw struct {
+		Targets map[string]*targetNode `yaml:"targets"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	resolved := map[string]bool{}
+	var resolve func(name string, path []string) error
+	resolve = func(name string, path []string) error {
+		node := raw.Targets[name]
+		if resolved[name] || node == nil || node.extends == "" {
+			return nil
+		}
+		for _, seen := range path {
+			if seen == name {
+				return fmt.Errorf("target %s: extends cycle through %s", path[0], name)
+			}
+		}
+		if _, exists := raw.Targets[node.extends]; !exists {
+			return fmt.Errorf("target %s: unknown target %q in extends", name, node.extends)
+		}
+		if err := resolve(node.extends, append(path, name)); err != nil {
+			return err
+		}
+
+		group, err := extendGroup(config.Targets[node.extends], node)
+		if err != nil {
+			return fmt.Errorf("target %s: %v", name, err)
+		}
+		config.Targets[name] = group
+		resolved[name] = true
+		return nil
+	}
+	for name := range raw.Targets {
+		if err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendGroup returns the target of node decoded on top of parent
+func extendGroup(parent Group, node *targetNode) (Group, error) {
+	// Decode into a deep copy, so that settings behind pointers aren't
+	// changed for the parent
+	data, err := yaml.Marshal(parent)
+	if err != nil {
+		return Group{}, err
+	}
+	var group Group
+	if err := yaml.Unmarshal(data, &group); err != nil {
+		return Group{}, err
+	}
+	if err := node.unmarshal(&group); err != nil {
+		return Group{}, err
+	}
+
+	var own struct {
+		Rules []Rule `yaml:"rules"`
+	}
+	if err := node.unmarshal(&own); err != nil {
+		return Group{}, err
+	}
+	group.Rules = append([]Rule{}, parent.Rules...)
+	position := map[string]int{}
+	for i, rule := range group.Rules {
+		position[ruleID(rule)] = i
+	}
+	for _, rule := range own.Rules {
+		if i, exists := position[ruleID(rule)]; exists {
+			group.Rules[i] = rule
+			continue
+		}
+		group.Rules = append(group.Rules, rule)
+	}
+	return group, nil
+}
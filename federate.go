@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelMatcher is a single matcher of a series selector
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(v string) bool {
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// selector is a parsed series selector such as up{job=~"api|web"}
+type selector []labelMatcher
+
+func (s selector) matches(name string, labels prometheus.Labels) bool {
+	for _, m := range s {
+		v := labels[m.name]
+		if m.name == "__name__" {
+			v = name
+		}
+		if !m.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a series selector. Only the metric name and label
+// matchers are supported, as in the match[] parameter of Prometheus.
+func parseSelector(input string) (selector, error) {
+	s := strings.TrimSpace(input)
+	var sel selector
+
+	i := strings.IndexFunc(s, func(r rune) bool { return r == '{' || unicode.IsSpace(r) })
+	if i < 0 {
+		i = len(s)
+	}
+	if name := s[:i]; name != "" {
+		sel = append(sel, labelMatcher{name: "__name__", op: "=", value: name})
+	}
+	s = strings.TrimSpace(s[i:])
+
+	if s != "" {
+		if s[0] != '{' || s[len(s)-1] != '}' {
+			return nil, fmt.Errorf("invalid selector %q", input)
+		}
+		s = s[1 : len(s)-1]
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			m, rest, err := parseMatcher(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %v", input, err)
+			}
+			sel = append(sel, m)
+			s = strings.TrimSpace(rest)
+			if s != "" && s[0] != ',' {
+				return nil, fmt.Errorf("invalid selector %q: expected ',' before %q", input, s)
+			}
+		}
+	}
+
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("selector %q matches every series", input)
+	}
+	return sel, nil
+}
+
+// parseMatcher parses one label matcher and returns the unparsed remainder
+func parseMatcher(s string) (labelMatcher, string, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return labelMatcher{}, "", fmt.Errorf("expected matcher at %q", s)
+	}
+	m := labelMatcher{name: strings.TrimSpace(s[:i])}
+	s = s[i:]
+
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(s, op) {
+			m.op = op
+			break
+		}
+	}
+	if m.op == "" {
+		return labelMatcher{}, "", fmt.Errorf("unknown operator at %q", s)
+	}
+	s = strings.TrimSpace(s[len(m.op):])
+
+	matched, quoted, err := quotedPrefix(s)
+	if err != nil {
+		return labelMatcher{}, "", fmt.Errorf("expected quoted value at %q", s)
+	}
+	if m.value, err = strconv.Unquote(quoted); err != nil {
+		return labelMatcher{}, "", err
+	}
+
+	if m.op == "=~" || m.op == "!~" {
+		if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+			return labelMatcher{}, "", err
+		}
+	}
+	return m, s[len(matched):], nil
+}
+
+// quotedPrefix returns the quoted string at the start of s, and as a double
+// quoted Go string. Go only allows single quotes around one character, while
+// PromQL strings may use them like double quotes.
+func quotedPrefix(s string) (matched, quoted string, err error) {
+	if !strings.HasPrefix(s, "'") {
+		quoted, err = strconv.QuotedPrefix(s)
+		return quoted, quoted, err
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			if s[i+1] != '\'' {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i+1])
+			i++
+		case c == '\'':
+			b.WriteByte('"')
+			return s[:i+1], b.String(), nil
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// federateHandler serves the latest scheduled evaluations of all targets
+// matching at least one match[] selector, leaving out targets of tenants
+// whose token wasn't sent and targets whose probe_token wasn't sent. Every
+// series gets a target label, a target label returned by the query is kept
+// as exported_target.
+func federateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var selectors []selector
+		for _, s := range r.Form["match[]"] {
+			sel, err := parseSelector(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			selectors = append(selectors, sel)
+		}
+		if len(selectors) == 0 {
+			http.Error(w, "Missing match[] parameter", http.StatusBadRequest)
+			return
+		}
+
+		var targets []string
+		for target, group := range config.Targets {
+			if tenantVisible(r, config, group) && probeAllowed(r, group) {
+				targets = append(targets, target)
+			}
+		}
+		sort.Strings(targets)
+
+		// Samples of one name need the same help in the exposition, targets
+		// exporting a record with different exprs would otherwise fail the
+		// gather. Each target keeps its collector for its evaluation time.
+		help := map[string]string{}
+		var collectors []prometheus.Collector
+		for _, target := range targets {
+			eval := getEvaluation(target)
+
+			var samples []Sample
+			for _, sample := range eval.Samples {
+				labels := make(prometheus.Labels, len(sample.Labels)+1)
+				for k, v := range sample.Labels {
+					labels[k] = v
+				}
+				if v, exists := labels["target"]; exists {
+					labels["exported_target"] = v
+				}
+				labels["target"] = target
+
+				for _, sel := range selectors {
+					if sel.matches(sample.Name, labels) {
+						if h, exists := help[sample.Name]; exists {
+							sample.Help = h
+						} else {
+							help[sample.Name] = sample.Help
+						}
+						sample.Labels = labels
+						samples = append(samples, sample)
+						break
+					}
+				}
+			}
+
+			if len(samples) > 0 {
+				collectors = append(collectors, sampleCollector{samples: samples, timestamp: eval.Time})
+			}
+		}
+
+		serveCollectors(w, r, collectors...)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseSelector(t *testing.T) {
+	type series struct {
+		name   string
+		labels prometheus.Labels
+	}
+	up := series{"up", prometheus.Labels{"job": "api", "instance": "h1:9090"}}
+	upWeb := series{"up", prometheus.Labels{"job": "web", "instance": "h2:9090"}}
+	other := series{"job:up:sum", prometheus.Labels{"job": "api"}}
+	quotes := series{"up", prometheus.Labels{"job": `it's "api"`}}
+
+	tests := []struct {
+		selector string
+		matches  []series
+		misses   []series
+	}{
+		{"up", []series{up, upWeb}, []series{other}},
+		{" job:up:sum ", []series{other}, []series{up}},
+		{`up{job="api"}`, []series{up}, []series{upWeb, other}},
+		{`{job="api"}`, []series{up, other}, []series{upWeb}},
+		{`up {job!="api"}`, []series{upWeb}, []series{up}},
+		{`{__name__=~"up|job:.*", job=~"a.*"}`, []series{up, other}, []series{upWeb}},
+		{`{job!~"a.*",}`, []series{upWeb}, []series{up, other}},
+		{`up{instance=~"h1.*"}`, []series{up}, []series{upWeb}},
+		// Regexes are anchored
+		{`{job=~"p"}`, nil, []series{up, upWeb}},
+		{`up{missing=""}`, []series{up, upWeb}, nil},
+		{`up{job='api'}`, []series{up}, []series{upWeb}},
+		{`up{job="a\"pi"}`, nil, []series{up}},
+		{`up{job='it\'s "api"'}`, []series{quotes}, []series{up}},
+		{`up{job="it's \"api\""}`, []series{quotes}, []series{up}},
+		{`up{job=~'it\'s \"a.*'}`, []series{quotes}, []series{up}},
+	}
+	for _, test := range tests {
+		sel, err := parseSelector(test.selector)
+		if err != nil {
+			t.Errorf("parseSelector(%q): %v", test.selector, err)
+			continue
+		}
+		for _, s := range test.matches {
+			if !sel.matches(s.name, s.labels) {
+				t.Errorf("%s doesn't match %s%s", test.selector, s.name, formatLabels(s.labels))
+			}
+		}
+		for _, s := range test.misses {
+			if sel.matches(s.name, s.labels) {
+				t.Errorf("%s matches %s%s", test.selector, s.name, formatLabels(s.labels))
+			}
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []struct {
+		selector string
+		err      string
+	}{
+		{"", "matches every series"},
+		{"{}", "matches every series"},
+		{`up{job="api"`, "invalid selector"},
+		{`up job="api"}`, "invalid selector"},
+		{`{job}`, "expected matcher"},
+		{`{job="api" env="prod"}`, "expected ','"},
+		{`{job=api}`, "expected quoted value"},
+		{`{job=~"("}`, "missing closing )"},
+		{`{job='api}`, "expected quoted value"},
+	}
+	for _, test := range tests {
+		_, err := parseSelector(test.selector)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseSelector(%q) error = %v, want %s", test.selector, err, test.err)
+		}
+	}
+}
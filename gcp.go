@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const gcpMonitoringScope = "https://www.googleapis.com/auth/monitoring.read"
+
+// gcpCredentialsFile is a service account key or the user credentials
+// written by gcloud auth application-default login
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcpToken returns an access token of Google Application Default
+// Credentials: the credentials file if given, else the file in
+// GOOGLE_APPLICATION_CREDENTIALS, else the gcloud application default
+// credentials, else the service account of the metadata server.
+func gcpToken(ctx context.Context, client *http.Client, credentialsFile string) (string, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(path); err == nil {
+				credentialsFile = path
+			}
+		}
+	}
+	if credentialsFile == "" {
+		return cachedToken("gcp metadata", func() (oauthToken, error) {
+			return gcpMetadataToken(ctx, client)
+		})
+	}
+	return cachedToken("gcp "+credentialsFile, func() (oauthToken, error) {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return oauthToken{}, err
+		}
+		var creds gcpCredentialsFile
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return oauthToken{}, fmt.Errorf("%s: %v", credentialsFile, err)
+		}
+		tokenURL := creds.TokenURI
+		if tokenURL == "" {
+			tokenURL = "https://oauth2.googleapis.com/token"
+		}
+		switch creds.Type {
+		case "service_account":
+			assertion, err := creds.assertion(tokenURL, time.Now())
+			if err != nil {
+				return oauthToken{}, fmt.Errorf("%s: %v", credentialsFile, err)
+			}
+			return postTokenRequest(ctx, client, tokenURL, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		case "authorized_user":
+			return postTokenRequest(ctx, client, tokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}
+		return oauthToken{}, fmt.Errorf("%s: unsupported credentials type %q", credentialsFile, creds.Type)
+	})
+}
+
+// assertion returns the signed JWT a service account exchanges for a token
+func (c gcpCredentialsFile) assertion(audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return "", errors.New("no PEM private key")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return "", errors.New("private key is not an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("private key: %v", err)
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": gcpMonitoringScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// gcpMetadataToken gets a token of the service account of the instance from
+// the metadata server, or GCE_METADATA_HOST if set
+func gcpMetadataToken(ctx context.Context, client *http.Client) (oauthToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcpMonitoringScope), nil)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, err := requestToken(client, req)
+	if err != nil {
+		return oauthToken{}, fmt.Errorf("no credentials file and metadata server: %w", err)
+	}
+	return token, nil
+}
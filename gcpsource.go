@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCPConfig configures the gcp datasource, which queries Google Cloud
+// Monitoring with Application Default Credentials
+type GCPConfig struct {
+	Project string `yaml:"project"`
+	// CredentialsFile is a service account key or user credentials file,
+	// used instead of the default credentials
+	CredentialsFile string `yaml:"credentials_file,omitempty"`
+}
+
+// GCPQuery configures how a rule of a gcp target is queried. The expression
+// is a monitoring filter like metric.type="compute.googleapis.com/..." or,
+// with mql, an MQL query.
+type GCPQuery struct {
+	MQL bool `yaml:"mql,omitempty"`
+	// AlignmentPeriod, Aligner, Reducer and GroupBy aggregate the time series
+	// of filters. The defaults are 5m and ALIGN_MEAN without reducer.
+	AlignmentPeriod time.Duration `yaml:"alignment_period,omitempty"`
+	Aligner         string        `yaml:"aligner,omitempty"`
+	Reducer         string        `yaml:"reducer,omitempty"`
+	GroupBy         []string      `yaml:"group_by,omitempty"`
+	// Labels maps label names to the metric and resource labels of the time
+	// series, e.g. instance: resource.instance_id. By default every metric
+	// and resource label is a label of the same name.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+func (q GCPQuery) validate() error {
+	if q.MQL && (q.AlignmentPeriod != 0 || q.Aligner != "" || q.Reducer != "" || len(q.GroupBy) > 0) {
+		return fmt.Errorf("MQL queries aggregate themselves, without alignment_period, aligner, reducer and group_by")
+	}
+	if q.AlignmentPeriod != 0 && (q.AlignmentPeriod < time.Minute || q.AlignmentPeriod%time.Second != 0) {
+		return fmt.Errorf("alignment_period must be whole seconds and at least 1m")
+	}
+	if q.Aligner != "" && !strings.HasPrefix(q.Aligner, "ALIGN_") {
+		return fmt.Errorf("unknown aligner %q", q.Aligner)
+	}
+	if q.Reducer != "" && !strings.HasPrefix(q.Reducer, "REDUCE_") {
+		return fmt.Errorf("unknown reducer %q", q.Reducer)
+	}
+	for name := range q.Labels {
+		if name == "" || sanitizeLabelName(name) != name {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+const (
+	defaultGCPEndpoint        = "https://monitoring.googleapis.com"
+	defaultGCPAlignmentPeriod = 5 * time.Minute
+)
+
+func init() {
+	datasourceTypes["gcp"] = newGCPDatasource
+	defaultEndpoints["gcp"] = func(Group) string { return defaultGCPEndpoint }
+}
+
+type gcpDatasource struct {
+	group  Group
+	config GCPConfig
+}
+
+func newGCPDatasource(group Group) (Datasource, error) {
+	if group.GCP == nil || group.GCP.Project == "" {
+		return nil, fmt.Errorf("gcp targets need gcp.project")
+	}
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		if rule.GCP != nil {
+			if err := rule.GCP.validate(); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", ruleID(rule), err)
+			}
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return nil, fmt.Errorf("rule %s: gcp targets only support gauge and counter rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: gcp targets don't support join", ruleID(rule))
+		}
+	}
+	return gcpDatasource{group: group, config: *group.GCP}, nil
+}
+
+// Query lists the time series of a filter with the default aggregation
+func (g gcpDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return g.QueryRule(ctx, Rule{}, expr, at)
+}
+
+func (g gcpDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	query := GCPQuery{}
+	if rule.GCP != nil {
+		query = *rule.GCP
+	}
+	var series []gcpSeries
+	var err error
+	if query.MQL {
+		series, err = g.queryMQL(ctx, expr)
+	} else {
+		series, err = g.listTimeSeries(ctx, query, expr, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(series))
+	for _, s := range series {
+		result := map[string]interface{}{"value": strconv.FormatFloat(s.value, 'g', -1, 64)}
+		if query.Labels != nil {
+			for name, key := range query.Labels {
+				if value := s.labels[key]; value != "" {
+					result[name] = value
+				}
+			}
+		} else {
+			// Metric labels win over resource labels of the same name
+			for _, prefix := range []string{"resource.", "metric."} {
+				for key, value := range s.labels {
+					if name, ok := strings.CutPrefix(key, prefix); ok && value != "" {
+						result[sanitizeLabelName(name)] = value
+					}
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// gcpSeries is the latest value of a time series, with the labels named like
+// in MQL: metric.<name> and resource.<name>
+type gcpSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// gcpValue is a TypedValue of the Cloud Monitoring API
+type gcpValue struct {
+	DoubleValue       *float64 `json:"doubleValue"`
+	Int64Value        *string  `json:"int64Value"`
+	BoolValue         *bool    `json:"boolValue"`
+	StringValue       *string  `json:"stringValue"`
+	DistributionValue *struct {
+		Mean float64 `json:"mean"`
+	} `json:"distributionValue"`
+}
+
+// number returns the value of numbers, booleans and the mean of
+// distributions
+func (v gcpValue) number() (float64, bool) {
+	switch {
+	case v.DoubleValue != nil:
+		return *v.DoubleValue, true
+	case v.Int64Value != nil:
+		f, err := strconv.ParseFloat(*v.Int64Value, 64)
+		return f, err == nil
+	case v.BoolValue != nil:
+		if *v.BoolValue {
+			return 1, true
+		}
+		return 0, true
+	case v.DistributionValue != nil:
+		return v.DistributionValue.Mean, true
+	}
+	return 0, false
+}
+
+// label returns the value as label value
+func (v gcpValue) label() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.Int64Value != nil:
+		return *v.Int64Value
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	}
+	return ""
+}
+
+// listTimeSeries returns the latest points of the time series of a filter
+func (g gcpDatasource) listTimeSeries(ctx context.Context, query GCPQuery, filter string, at time.Time) ([]gcpSeries, error) {
+	period := query.AlignmentPeriod
+	if period == 0 {
+		period = defaultGCPAlignmentPeriod
+	}
+	aligner := query.Aligner
+	if aligner == "" {
+		aligner = "ALIGN_MEAN"
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	// Ask for a few periods to get the latest complete point
+	params := url.Values{
+		"filter":                         {filter},
+		"interval.startTime":             {at.Add(-3 * period).UTC().Format(time.RFC3339)},
+		"interval.endTime":               {at.UTC().Format(time.RFC3339)},
+		"aggregation.alignmentPeriod":    {strconv.Itoa(int(period/time.Second)) + "s"},
+		"aggregation.perSeriesAligner":   {aligner},
+		"aggregation.groupByFields":      query.GroupBy,
+		"aggregation.crossSeriesReducer": {query.Reducer},
+	}
+	if query.Reducer == "" {
+		params.Del("aggregation.crossSeriesReducer")
+	}
+
+	var series []gcpSeries
+	for {
+		var response struct {
+			TimeSeries []struct {
+				Metric struct {
+					Labels map[string]string `json:"labels"`
+				} `json:"metric"`
+				Resource struct {
+					Labels map[string]string `json:"labels"`
+				} `json:"resource"`
+				Points []struct {
+					Value gcpValue `json:"value"`
+				} `json:"points"`
+			} `json:"timeSeries"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := g.call(ctx, http.MethodGet, "/timeSeries?"+params.Encode(), nil, &response); err != nil {
+			return nil, err
+		}
+		for _, ts := range response.TimeSeries {
+			// The points are newest first
+			if len(ts.Points) == 0 {
+				continue
+			}
+			value, ok := ts.Points[0].Value.number()
+			if !ok {
+				continue
+			}
+			labels := map[string]string{}
+			for name, v := range ts.Resource.Labels {
+				labels["resource."+name] = v
+			}
+			for name, v := range ts.Metric.Labels {
+				labels["metric."+name] = v
+			}
+			series = append(series, gcpSeries{labels: labels, value: value})
+		}
+		if response.NextPageToken == "" {
+			return series, nil
+		}
+		params.Set("pageToken", response.NextPageToken)
+	}
+}
+
+// queryMQL returns the latest points of the time series of an MQL query
+func (g gcpDatasource) queryMQL(ctx context.Context, query string) ([]gcpSeries, error) {
+	request := map[string]string{"query": query}
+	var series []gcpSeries
+	for {
+		var response struct {
+			Descriptor struct {
+				LabelDescriptors []struct {
+					Key string `json:"key"`
+				} `json:"labelDescriptors"`
+			} `json:"timeSeriesDescriptor"`
+			Data []struct {
+				LabelValues []gcpValue `json:"labelValues"`
+				PointData   []struct {
+					Values []gcpValue `json:"values"`
+				} `json:"pointData"`
+			} `json:"timeSeriesData"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		body, _ := json.Marshal(request)
+		if err := g.call(ctx, http.MethodPost, "/timeSeries:query", bytes.NewReader(body), &response); err != nil {
+			return nil, err
+		}
+		for _, data := range response.Data {
+			// The points are newest first, the first value is the value
+			if len(data.PointData) == 0 || len(data.PointData[0].Values) == 0 {
+				continue
+			}
+			value, ok := data.PointData[0].Values[0].number()
+			if !ok {
+				continue
+			}
+			labels := map[string]string{}
+			for i, v := range data.LabelValues {
+				if i < len(response.Descriptor.LabelDescriptors) {
+					labels[response.Descriptor.LabelDescriptors[i].Key] = v.label()
+				}
+			}
+			series = append(series, gcpSeries{labels: labels, value: value})
+		}
+		if response.NextPageToken == "" {
+			return series, nil
+		}
+		request["pageToken"] = response.NextPageToken
+	}
+}
+
+// call sends a request to the project API and decodes the response
+func (g gcpDatasource) call(ctx context.Context, method, path string, body io.Reader, response interface{}) error {
+	client, err := clientFor(g.group)
+	if err != nil {
+		return err
+	}
+	token, err := gcpToken(ctx, client, g.config.CredentialsFile)
+	if err != nil {
+		return err
+	}
+	endpoint := groupEndpoint(g.group)
+	req, err := http.NewRequestWithContext(ctx, method,
+		strings.TrimSuffix(endpoint, "/")+"/v3/projects/"+url.PathEscape(g.config.Project)+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return responseError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return &parseError{err}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// GraphiteSink sends samples to Carbon over TCP
+type GraphiteSink struct {
+	// Address is the host:port of Carbon, 2003 for plaintext and 2004 for
+	// pickle by default
+	Address string `yaml:"address"`
+	// Protocol is plaintext (default) or pickle
+	Protocol string `yaml:"protocol,omitempty"`
+	// Path is a template of the metric path with .Target, .Name, .Labels and
+	// .LabelValues, whose values have dots and spaces replaced by _. The
+	// default is the target, the name and the label values sorted by label
+	// name, or without the label values with tags.
+	Path string `yaml:"path,omitempty"`
+	// Tags appends the labels as Graphite tags, path;name=value
+	Tags bool `yaml:"tags,omitempty"`
+	// Timeout of connecting and sending, 10s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+const (
+	defaultGraphitePath    = "{{ .Target }}.{{ .Name }}{{ range .LabelValues }}.{{ . }}{{ end }}"
+	defaultGraphiteTimeout = 10 * time.Second
+	// graphitePickleBatch is the number of points per pickle message
+	graphitePickleBatch = 500
+)
+
+func init() {
+	sinkTypes["graphite"] = newGraphiteWriter
+}
+
+type graphiteWriter struct {
+	config GraphiteSink
+	path   *template.Template
+	conn   net.Conn
+}
+
+func newGraphiteWriter(s Sink) (sinkWriter, error) {
+	c := s.Graphite
+	if c == nil || c.Address == "" {
+		return nil, fmt.Errorf("graphite sinks need graphite.address")
+	}
+	config := *c
+	switch config.Protocol {
+	case "", "plaintext", "pickle":
+	default:
+		return nil, fmt.Errorf("unknown graphite protocol %q, expected plaintext or pickle", config.Protocol)
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		port := "2003"
+		if config.Protocol == "pickle" {
+			port = "2004"
+		}
+		config.Address = net.JoinHostPort(config.Address, port)
+	}
+	if config.Path == "" {
+		config.Path = defaultGraphitePath
+		if config.Tags {
+			config.Path = "{{ .Target }}.{{ .Name }}"
+		}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultGraphiteTimeout
+	}
+	path, err := template.New("path").Option("missingkey=error").Parse(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("graphite path: %v", err)
+	}
+	return &graphiteWriter{config: config, path: path}, nil
+}
+
+// graphitePoint is a value of a metric path at a time
+type graphitePoint struct {
+	path  string
+	value float64
+}
+
+func (g *graphiteWriter) write(target string, eval evaluation) error {
+	var points []graphitePoint
+	for _, sample := range eval.Samples {
+		for _, flat := range flattenSample(sample) {
+			// Carbon has no representation of NaN and infinities
+			if !isFinite(flat.Value) {
+				continue
+			}
+			path, err := g.metricPath(target, flat)
+			if err != nil {
+				return err
+			}
+			points = append(points, graphitePoint{path: path, value: flat.Value})
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	var messages [][]byte
+	if g.config.Protocol == "pickle" {
+		for start := 0; start < len(points); start += graphitePickleBatch {
+			messages = append(messages, picklePoints(points[start:min(start+graphitePickleBatch, len(points))], eval.Time))
+		}
+	} else {
+		var buf bytes.Buffer
+		for _, point := range points {
+			fmt.Fprintf(&buf, "%s %s %d\n", point.path, formatFloat(point.value), eval.Time.Unix())
+		}
+		messages = append(messages, buf.Bytes())
+	}
+	return g.send(messages)
+}
+
+// send writes the messages, reconnecting once if the connection was lost
+func (g *graphiteWriter) send(messages [][]byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if g.conn == nil {
+			if g.conn, err = net.DialTimeout("tcp", g.config.Address, g.config.Timeout); err != nil {
+				g.conn = nil
+				return err
+			}
+		}
+		g.conn.SetWriteDeadline(time.Now().Add(g.config.Timeout))
+		for _, message := range messages {
+			if _, err = g.conn.Write(message); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
+
+func (g *graphiteWriter) close() {
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+// metricPath renders the path of a sample
+func (g *graphiteWriter) metricPath(target string, flat flatSample) (string, error) {
+	data := struct {
+		Target      string
+		Name        string
+		Labels      map[string]string
+		LabelValues []string
+	}{Target: graphiteEscape(target), Name: graphiteEscape(flat.Name), Labels: map[string]string{}}
+	names := sortedLabelNames(flat.Labels)
+	for _, name := range names {
+		value := graphiteEscape(flat.Labels[name])
+		data.Labels[name] = value
+		data.LabelValues = append(data.LabelValues, value)
+	}
+	var b strings.Builder
+	if err := g.path.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("graphite path: %v", err)
+	}
+	if g.config.Tags {
+		for _, name := range names {
+			// Tag values must not be empty or start with ~
+			value := graphiteTagEscape(flat.Labels[name], ";")
+			if strings.HasPrefix(value, "~") {
+				value = "_" + value[1:]
+			}
+			if value != "" {
+				fmt.Fprintf(&b, ";%s=%s", graphiteTagEscape(name, ";!^="), value)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// graphiteEscape makes a value usable as a node of a metric path
+func graphiteEscape(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\t', '\n', '\r', ';', '/':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// graphiteTagEscape makes a value usable as the name or value of a tag,
+// replacing whitespace, which ends the path in the plaintext protocol, and
+// the forbidden characters
+func graphiteTagEscape(value, forbidden string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || strings.ContainsRune(forbidden, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// picklePoints encodes points as Carbon pickle message: a length header and
+// a protocol 2 pickle of a list of (path, (timestamp, value)) tuples
+func picklePoints(points []graphitePoint, at time.Time) []byte {
+	var p bytes.Buffer
+	p.WriteString("\x80\x02") // PROTO 2
+	p.WriteString("](")       // EMPTY_LIST, MARK
+	for _, point := range points {
+		p.WriteByte('X') // BINUNICODE
+		binary.Write(&p, binary.LittleEndian, uint32(len(point.path)))
+		p.WriteString(point.path)
+		p.WriteByte('J') // BININT
+		binary.Write(&p, binary.LittleEndian, int32(at.Unix()))
+		p.WriteByte('G') // BINFLOAT
+		binary.Write(&p, binary.BigEndian, math.Float64bits(point.value))
+		p.WriteString("\x86\x86") // TUPLE2 twice
+	}
+	p.WriteString("e.") // APPENDS, STOP
+
+	message := make([]byte, 4, 4+p.Len())
+	binary.BigEndian.PutUint32(message, uint32(p.Len()))
+	return append(message, p.Bytes()...)
+}
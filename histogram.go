@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistogramValue holds the cumulative buckets of a reconstructed histogram.
+// The +Inf bucket is implied by Count.
+type HistogramValue struct {
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+// evaluateHistogram builds histograms from a query returning le-labelled
+// bucket series. Series with the same labels apart from le form one
+// histogram. The _sum and _count come from the optional sum_expr and
+// count_expr queries, matched on the same labels; without count_expr the
+// +Inf bucket is used and without sum_expr the sum is NaN. Bucket counts are
+// rounded to integers, so the queries should return cumulative counts (for
+// example sum by (le) (x_bucket)) rather than rates.
+func evaluateHistogram(ctx context.Context, target string, group Group, rule Rule) ([]Sample, error) {
+	at := queryTime(rule)
+	results, err := runQuery(ctx, target, group, rule, rule.Expr, at)
+	if err != nil {
+		return nil, err
+	}
+
+	histograms := map[string]*Sample{}
+	var order []string
+	for _, result := range results {
+		labels, value := resultToSample(result)
+		le, err := strconv.ParseFloat(labels["le"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket series %s has no valid le label", formatLabels(labels))
+		}
+		delete(labels, "le")
+
+		series := formatLabels(labels)
+		sample, exists := histograms[series]
+		if !exists {
+			sample = &Sample{
+				Name:      rule.Record,
+				Help:      fmt.Sprintf("Histogram of Prometheus query: %s", rule.Expr),
+				Type:      prometheus.UntypedValue,
+				Labels:    labels,
+				Histogram: &HistogramValue{Buckets: map[float64]uint64{}, Sum: math.NaN()},
+			}
+			histograms[series] = sample
+			order = append(order, series)
+		}
+
+		count := uint64(math.Round(value))
+		if math.IsInf(le, 1) {
+			sample.Histogram.Count = count
+		} else {
+			sample.Histogram.Buckets[le] = count
+		}
+	}
+
+	// Without a +Inf bucket the largest bucket holds all observations
+	for _, sample := range histograms {
+		for _, count := range sample.Histogram.Buckets {
+			if count > sample.Histogram.Count {
+				sample.Histogram.Count = count
+			}
+		}
+	}
+
+	if rule.CountExpr != "" {
+		err := applySeriesQuery(ctx, target, group, rule, at, rule.CountExpr, histograms, func(s *Sample, v float64) {
+			s.Histogram.Count = uint64(math.Round(v))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rule.SumExpr != "" {
+		err := applySeriesQuery(ctx, target, group, rule, at, rule.SumExpr, histograms, func(s *Sample, v float64) {
+			s.Histogram.Sum = v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(order)
+	samples := make([]Sample, 0, len(order))
+	for _, series := range order {
+		samples = append(samples, *histograms[series])
+	}
+	return samples, nil
+}
+
+// applySeriesQuery runs expr and passes each value to set for the sample
+// with the same labels. Results without a matching sample are ignored.
+func applySeriesQuery(ctx context.Context, target string, group Group, rule Rule, at time.Time, expr string, series map[string]*Sample, set func(*Sample, float64)) error {
+	results, err := runQuery(ctx, target, group, rule, expr, at)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		labels, value := resultToSample(result)
+		if sample, exists := series[formatLabels(labels)]; exists {
+			set(sample, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+)
+
+// exampleConfig documents every configuration option
+var exampleConfig = template.Must(template.New("config").Parse(`# rules_exporter configuration
+#
+# Every target is probed with /probe?target=<name>. The rules of the target
+# are evaluated as instant queries against its endpoint and each result is
+# exported as a gauge named after the rule's record. Probes with
+# rules=<record>,<record> only evaluate the given rules of the target.
+# Several targets can be probed at once with target=<name>,<name>, their
+# series get a target label. target=* probes all targets apart from aggregate
+# targets that the probe has the tokens for.
+#
+# A --config.file ending in .jsonnet is evaluated with the jsonnet command
+# instead, see --config.jsonnet-command and --config.jsonnet-ext-var. One
+# ending in .cue, without package clause, is evaluated with the cue command
+# together with the schema printed by the schema command. One ending in .toml
+# has the same structure, e.g. [targets.example] and [[targets.example.rules]].
+# YAML files encrypted with SOPS are decrypted with the sops command, which
+# takes the keys from its environment, see --config.sops-command. With
+# --config.signature-public-key the file must have a detached minisign or
+# cosign signature, see --config.signature-file.
+
+# Teams sharing the exporter. Probes of the targets of a tenant must send its
+# token in the X-Tenant-Token header and are limited per tenant.
+tenants:
+  example-team:
+    token: change-me
+    # Probes running at the same time, omit for no limit
+    max_concurrent_probes: 10
+    # Probes per second and the burst allowed above it, omit for no limit
+    rate_limit: 5
+    rate_burst: 10
+
+# PromQL fragments used as $name in the expressions of rules, joins and
+# discovery, expanded when the configuration is loaded. Macros may use other
+# macros. Write $$ for a literal $, a $ not followed by a name is kept.
+# Without macros the expressions are used as they are, with macros a $name
+# that is no macro, like a group of label_replace, has to be written $$name.
+macros:
+  api_jobs: job=~"api|web"
+  error_selector: $api_jobs, code=~"5.."
+
+# Generate targets from the values of a label returned by a query, one target
+# per value, kept up to date by running the query periodically
+discovery:
+  - name: clusters
+    endpoint: {{ .Endpoint }}
+    query: group by (cluster) (up)
+    label: cluster
+    # How often the query runs
+    interval: 5m
+    # Name of the generated targets, {{"{{"}} .Value {{"}}"}} is the label value.
+    # The default is <name>-{{"{{"}} .Value {{"}}"}}.
+    target_name: "cluster-{{"{{"}} .Value {{"}}"}}"
+    # Settings of the generated targets as for targets below. {{"{{"}} .Value {{"}}"}}
+    # is replaced by the label value everywhere, {{"{{"}} quote .Value {{"}}"}} by the
+    # value as a quoted and escaped string for label matchers. Configured
+    # targets of the same name take precedence.
+    target:
+      endpoint: {{ .Endpoint }}
+      rules:
+        - record: cluster:up:sum
+          expr: sum(up{cluster={{"{{"}} quote .Value {{"}}"}}})
+
+# Send the results of scheduled evaluations (--scheduler.interval) to other
+# systems. Every sink has a queue of queue_size evaluations (default 100),
+# further evaluations are dropped while it is full.
+sinks:
+  - name: carbon
+    type: graphite
+    # All targets by default
+    targets: [example]
+    graphite:
+      address: localhost:2003
+      # plaintext or pickle
+      protocol: plaintext
+      # Metric path, by default the target, the name and the label values
+      # sorted by label name. Dots and spaces in the values become _.
+      path: "rules.{{"{{"}} .Target {{"}}"}}.{{"{{"}} .Name {{"}}"}}{{"{{"}} range .LabelValues {{"}}"}}.{{"{{"}} . {{"}}"}}{{"{{"}} end {{"}}"}}"
+      # Append the labels as tags, path;name=value
+      tags: false
+  - name: edge
+    type: mqtt
+    mqtt:
+      # tcp://host:1883 or ssl://host:8883
+      url: ssl://broker.example.com:8883
+      tls_config:
+        min_version: TLS12
+      client_id: rules_exporter
+      username: rules_exporter
+      password: change-me
+      # Samples with the same topic are published together as JSON like
+      # format=json probes. The default topic is rules_exporter/<target>/<rule>,
+      # this one publishes every series separately.
+      topic: "edge/{{"{{"}} .Target {{"}}"}}/{{"{{"}} .Name {{"}}"}}/{{"{{"}} .Labels.instance {{"}}"}}"
+      # 0 or 1, which waits for the broker to acknowledge every message
+      qos: 1
+      # Keep the last message of every topic for new subscribers
+      retain: true
+      keep_alive: 60s
+  - name: bus
+    type: nats
+    targets: [example]
+    nats:
+      # nats://host:4222 or tls://host:4222
+      url: nats://nats.example.com:4222
+      token: change-me
+      # Like the topics of mqtt sinks, by default rules_exporter.<target>.<rule>
+      subject: "rules.{{"{{"}} .Target {{"}}"}}.{{"{{"}} .Rule {{"}}"}}"
+      # Wait for a JetStream stream to store every message
+      jetstream: true
+  - name: longterm
+    type: remote_write
+    # What to do while the queue of queue_size evaluations is full:
+    # drop_newest (default), drop_oldest or block the evaluations
+    queue_size: 1000
+    overflow: drop_oldest
+    # Send up to this many queued evaluations in one request
+    batch_size: 50
+    # Attempts of failed writes after the first one, with a backoff
+    # doubling from retry_backoff
+    max_retries: 2
+    retry_backoff: 5s
+    # Rewrite the samples sent to the sink like the relabel_configs of
+    # Prometheus, probes are not affected. __name__ is the metric name,
+    # __target__ and __rule__ the target and rule of the sample.
+    write_relabel_configs:
+      - source_labels: [__rule__]
+        regex: debug:.*
+        action: drop
+      - regex: pod|container_id
+        action: labeldrop
+    remote_write:
+      # Samples get a target label with the name of their target, their own
+      # target label is kept as exported_target
+      url: https://mimir.example.com/api/v1/push
+      headers:
+        X-Scope-OrgID: monitoring
+      # Attempts after the first one, with a backoff doubling from 1s
+      retries: 3
+      # Keep requests that failed in wal_dir/<sink name> and send them once
+      # the endpoint is back, dropping the oldest above wal_max_size bytes
+      wal_dir: /var/lib/rules_exporter/wal
+      wal_max_size: 67108864
+      # Send the exemplars of rules with exemplar_window, and the type and
+      # help of every metric (default true)
+      send_exemplars: true
+      send_metadata: true
+
+targets:
+  example:
+    # Kind of datasource the rules are queried from: prometheus (default)
+    type: prometheus
+    # Base URL of the Prometheus compatible API to query
+    endpoint: {{ .Endpoint }}
+    # Connection settings for the endpoint, targets with the same endpoint
+    # and settings share their connections
+    http_client:
+      # "1.1" forces HTTP/1.1, "2" always uses HTTP/2 (h2c for http://
+      # endpoints, which can't go through a proxy), omit to negotiate
+      # HTTP/2 for https:// endpoints
+      http_version: "2"
+      # Ping idle HTTP/2 connections to detect broken ones
+      http2_read_idle_timeout: 30s
+      # TLS settings for https:// endpoints
+      tls_config:
+        # Accept any certificate, e.g. a self-signed one
+        insecure_skip_verify: false
+        # TLS10, TLS11, TLS12 or TLS13
+        min_version: TLS12
+        max_version: TLS13
+        # Allowed TLS 1.0-1.2 cipher suites, omit for all secure ones
+        cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+    # Token required to probe this target, sent as bearer token or in the
+    # X-Probe-Token header
+    probe_token: change-me
+    # Tenant owning the target, see tenants
+    tenant: example-team
+    # Serve the same rendered response to all probes within this time, so
+    # HA scrapers get identical results from a single evaluation
+    response_cache: 10s
+    # Return the error of a failed query for this long instead of sending it
+    # to the endpoint again on every probe
+    error_cache: 5s
+    # How long query results of the rules are reused, overriding --cache.ttl.
+    # Omit it and --cache.ttl to query on every probe.
+    cache_ttl: 15s
+    # What to export if rules fail: partial (default) leaves them out, fail
+    # fails the probe with status 500 and stale exports the last successful
+    # results of the failing rules
+    on_error: partial
+    # Only evaluate rules with one of the tags and none of the tags prefixed
+    # with !, overriding --rules.tag-filter. Here rules tagged debug are
+    # left out.
+    tag_filter: ["!debug"]
+    # Drop the replica labels of HA pairs queried directly, like Thanos
+    # sidecars or Cortex replicas, and keep one of the series that only
+    # differed by them: first (default), max or min
+    replica_labels: [replica, prometheus_replica]
+    replica_dedup: max
+    # POST the results of every scheduled evaluation as JSON, with the
+    # samples like format=json probes and the failed rules. Webhooks are
+    # sinks of the target, see sinks.
+    webhooks:
+      - url: https://hooks.example.com/rules
+        headers:
+          X-Team: example-team
+        # Sign the body with HMAC-SHA256, sent as sha256=<hex> in the
+        # X-Rules-Exporter-Signature header
+        secret: change-me
+        # Only the samples of these rules
+        rules: [job:availability:ok]
+        # Only the samples comparing true against the threshold, and nothing
+        # if there are none
+        breach:
+          operator: "<"
+          threshold: 1
+        # Retries of failed deliveries, apart from 4xx responses other than
+        # 429, waiting retry_backoff doubled after every attempt
+        retries: 3
+        retry_backoff: 1s
+        timeout: 10s
+    rules:
+      # Name of the exported metric
+      - record: job:up:sum
+        # PromQL expression evaluated at probe time
+        expr: sum by (job) (up)
+        # Tags matched by tag_filter
+        tags: [availability, slo]
+        # Set to false to leave the rule out
+        enabled: true
+        # How long a query result is reused, overriding cache_ttl of the
+        # target and --cache.ttl. 0 queries on every probe.
+        cache_ttl: 1m
+        # Evaluate at the start of the current interval instead of the
+        # current time, so replicas and retries get the same result
+        align: 1m
+        # Metric type, gauge (default), counter, histogram, summary or info.
+        # Counters are tracked across evaluations and never decrease in the
+        # exposition.
+        type: gauge
+        # Fail the probe with status 500 if this rule fails, whatever the
+        # on_error of the target
+        fail_on_error: true
+        # Set rules_exporter_rule_assertion_failed if the query returns fewer
+        # or more series, e.g. because a selector stopped matching
+        expect_min_series: 1
+        expect_max_series: 100
+        # Export a single series without labels if the query returns nothing:
+        # skip (default), zero or value: N. Only for gauge rules.
+        on_empty: zero
+        # Also export job:up:sum_present, 1 if the query returned any series
+        # and 0 otherwise, to tell missing data from a zero value
+        present: true
+        # Copy labels from the series of another query with the same values
+        # of the on labels, like group_left. Results without a match are kept
+        # unchanged.
+        join:
+          expr: job_owner_info
+          # Query another endpoint than the target's
+          endpoint: {{ .Endpoint }}
+          on: [job]
+          labels: [team]
+      - record: job:availability:ok
+        expr: avg by (job) (avg_over_time(up[1h]))
+        # Evaluate this expensive rule every 15m in scheduled mode instead of
+        # every --scheduler.interval, exporting its last results in between
+        interval: 15m
+        # Probes share the scrape timeout Prometheus sends, minus
+        # --web.timeout-offset, between the rules not evaluated yet. This rule
+        # may take twice the share of every following one (default 1).
+        budget_weight: 2
+        # Rules with a higher priority (default 0) are evaluated first and
+        # share the scrape timeout among themselves, lower ones get the rest
+        priority: 1
+        # Export 1 if the value compares true against the threshold and 0
+        # otherwise. Operators are ==, !=, >, >=, < and <=.
+        bool:
+          operator: ">="
+          threshold: 0.99
+      - record: instance:memory_used_bytes
+        expr: node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes
+        # Convert the value and rename the metric accordingly, here to
+        # instance:memory_used_gibibytes. Supported are bytes_to_mebibytes,
+        # bytes_to_gibibytes, seconds_to_milliseconds and ratio_to_percent.
+        unit: bytes_to_gibibytes
+        # Round the value to a number of decimals or significant_digits
+        precision:
+          decimals: 2
+      - record: job:http_requests:total
+        expr: sum by (job) (http_requests_total)
+        type: counter
+        # What a decreasing upstream value means: accumulate (default) adds
+        # it as the increase since the reset, ignore only adopts it as the
+        # new baseline.
+        counter_reset: accumulate
+      - record: job:http_errors:rate5m
+        # $error_selector is replaced by the macro of that name
+        expr: sum by (job) (rate(http_requests_total{$error_selector}[5m]))
+      - record: job:http_requests:per_instance
+        # Computed after the gauge and counter rules of this target it uses,
+        # instead of a query. Series are matched on the on labels (default
+        # all) and keep the labels of left, a side with a single series
+        # without labels matches every series. Operators are +, -, *, / and
+        # the comparisons, which keep the left series they hold for.
+        compute:
+          left: job:http_requests:total
+          op: /
+          right: job:up:sum
+          on: [job]
+      - record: job:http_request_duration_seconds
+        # Histogram rules query le-labelled cumulative bucket counts, series
+        # with the same labels apart from le form one histogram
+        expr: sum by (job, le) (http_request_duration_seconds_bucket)
+        type: histogram
+        # Optional queries for _sum and _count, the count defaults to the
+        # +Inf bucket
+        sum_expr: sum by (job) (http_request_duration_seconds_sum)
+        count_expr: sum by (job) (http_request_duration_seconds_count)
+        # Attach the latest exemplar of the last 5m of the queried series,
+        # for remote_write sinks with send_exemplars
+        exemplar_window: 5m
+      - record: job:rpc_duration_seconds
+        # Summary rules query quantile-labelled series, sum_expr and
+        # count_expr are optional as for histograms
+        expr: max by (job, quantile) (rpc_duration_seconds)
+        type: summary
+        count_expr: sum by (job) (rpc_duration_seconds_count)
+      - record: job:build_info
+        # Info rules export 1 with the labels of every result, their record
+        # has to end in _info
+        expr: count by (job, version) (prometheus_build_info)
+        type: info
+      # Keep the upstream metric name of the results in a source_metric
+      # label, or without record as here export them under that name
+      - expr: up{job="node"}
+        keep_metric_name: true
+  # A target running a command for every query instead of querying an
+  # endpoint. The expression is passed as last argument and the command has
+  # to write the results as JSON to stdout, e.g.
+  # [{"labels": {"queue": "mail"}, "value": 12}]
+  example-exec:
+    type: exec
+    exec:
+      command: [/usr/local/bin/queue-stats, --format=json]
+      # Kill the command after this long
+      timeout: 10s
+      # Working directory of the command
+      dir: /tmp
+      # Environment of the command, which otherwise only gets PATH. The time
+      # of aligned rules is passed as RULES_EXPORTER_TIME.
+      env:
+        QUEUE_HOST: localhost
+      # Pass on the whole environment of the exporter
+      inherit_env: false
+      # Fail queries writing more than this to stdout
+      max_output_bytes: 1048576
+      # Run the command as this user and group, names or ids, which needs
+      # the exporter to run as root (Linux only)
+      user: nobody
+      group: nogroup
+      # Resource limits of the command, omit or 0 for none (Linux only)
+      limits:
+        cpu_time: 5s
+        memory_bytes: 536870912
+        open_files: 64
+        processes: 16
+    rules:
+      - record: queue:length
+        expr: length
+  # A target turning the JSON responses of a REST API into metrics. The
+  # expression of a rule is the URL to get, relative to the endpoint unless
+  # it is absolute. http_client settings apply as for prometheus targets.
+  example-json:
+    type: json
+    endpoint: https://billing.example.com/api
+    http_client:
+      # Proxy for the requests, omit to use HTTP_PROXY and HTTPS_PROXY
+      proxy_url: http://proxy.example.com:3128
+      # Use the proxy of the environment when no proxy_url is given
+      proxy_from_environment: true
+      # Hosts, domains and CIDR ranges connected to directly, in addition
+      # to those in NO_PROXY if the proxy is taken from the environment
+      no_proxy: [.svc.cluster.local, 10.0.0.0/8]
+    json:
+      # Headers sent with every request
+      headers:
+        Authorization: Bearer change-me
+    rules:
+      - record: billing:invoice_amount
+        expr: /invoices?status=open
+        # JSONPath expressions: items selects the objects that each become a
+        # series, the whole response by default. value and labels are
+        # evaluated on every item, which is $ for them. Supported are .name,
+        # ['name'], [index] and the wildcards .* and [*].
+        json:
+          items: $.invoices[*]
+          value: $.amount
+          labels:
+            customer: $.customer.name
+  # A target querying Azure Monitor Metrics with the credentials of an app
+  # registration that has the Monitoring Reader role. The expression is the
+  # metric name and the endpoint https://management.azure.com by default.
+  example-azure:
+    type: azure_monitor
+    azure_monitor:
+      tenant_id: 00000000-0000-0000-0000-000000000000
+      client_id: 00000000-0000-0000-0000-000000000000
+      client_secret: change-me
+      subscription_id: 00000000-0000-0000-0000-000000000000
+      resource_group: example
+      # Resource of rules without a resource of their own, relative to the
+      # resource group unless it is a full resource ID
+      resource: providers/Microsoft.Compute/virtualMachines/example-vm
+    rules:
+      - record: azure:vm_cpu_percent:max
+        expr: Percentage CPU
+        # The latest data point with the aggregation (Average, Total,
+        # Minimum, Maximum or Count) and interval is the value. Dimensions
+        # split by the filter become labels.
+        azure:
+          aggregation: Maximum
+          interval: 5m
+      - record: azure:disk_read_bytes:sum
+        expr: Disk Read Bytes
+        azure:
+          aggregation: Total
+          filter: "LUN eq '*'"
+  # A target querying AWS CloudWatch GetMetricData. Without access keys the
+  # AWS_* environment variables are used, with role_arn the role is assumed.
+  # The expression is the metric name and the endpoint
+  # https://monitoring.<region>.amazonaws.com by default.
+  example-cloudwatch:
+    type: cloudwatch
+    cloudwatch:
+      region: eu-west-1
+      role_arn: arn:aws:iam::123456789012:role/rules-exporter
+    rules:
+      - record: aws:ec2_cpu_utilization:p99
+        expr: CPUUtilization
+        # The dimensions select the metric and become labels. The latest data
+        # point of the period (1s, 5s, 10s, 30s or a multiple of 1m, 5m by
+        # default) and statistic (Average by default, Sum, Minimum, Maximum,
+        # SampleCount or percentiles like p99) is the value.
+        cloudwatch:
+          namespace: AWS/EC2
+          dimensions:
+            InstanceId: i-0123456789abcdef0
+          period: 1m
+          statistic: p99
+  # A target querying Google Cloud Monitoring with Application Default
+  # Credentials: credentials_file, GOOGLE_APPLICATION_CREDENTIALS, the gcloud
+  # default credentials or the metadata server. The expression is a
+  # monitoring filter, or an MQL query with mql.
+  example-gcp:
+    type: gcp
+    gcp:
+      project: example-project
+    rules:
+      - record: gcp:instance_cpu_utilization:mean
+        expr: metric.type="compute.googleapis.com/instance/cpu/utilization"
+        # The latest aligned point is the value. Metric and resource labels
+        # become labels of the same name unless labels maps them.
+        gcp:
+          alignment_period: 1m
+          aligner: ALIGN_MEAN
+          reducer: REDUCE_MEAN
+          group_by: [resource.zone]
+          labels:
+            zone: resource.zone
+      - record: gcp:lb_request_count:rate
+        expr: "fetch https_lb_rule | metric 'loadbalancing.googleapis.com/https/request_count' | align rate(5m) | every 5m | within 10m"
+        gcp:
+          mql: true
+  # A target running Datadog metric queries. The endpoint is
+  # https://api.<site> by default.
+  example-datadog:
+    type: datadog
+    datadog:
+      api_key: change-me
+      app_key: change-me
+      site: datadoghq.eu
+    rules:
+      # The latest point within the window is the value, tags of the group
+      # by become labels
+      - record: datadog:system_cpu_user:avg
+        expr: avg:system.cpu.user{env:prod} by {host}
+        datadog:
+          window: 5m
+  # A target running NRQL queries with the NerdGraph API and a user key.
+  # FACET attributes become labels, the latest row of TIMESERIES queries is
+  # the value.
+  example-newrelic:
+    type: newrelic
+    newrelic:
+      account_id: 1234567
+      api_key: change-me
+      region: us
+    rules:
+      - record: newrelic:transaction_duration:p95
+        expr: SELECT percentile(duration, 95) FROM Transaction FACET appName SINCE 5 minutes ago
+        # The result column of the value, needed if there is more than one
+        newrelic:
+          value: percentile.duration.95
+  # A target inheriting the settings and rules of another target. Settings
+  # given here override the inherited ones, nested settings are merged and
+  # rules replace the inherited rule with the same record or are added.
+  example-staging:
+    extends: example
+    endpoint: {{ .Endpoint }}
+    cache_ttl: 1m
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up{env="staging"})
+  # A target combining the results of other targets, which have to belong to
+  # the same tenant. Without aggregate their series are distinguished by a
+  # target label, sum or avg combine series with the same name and labels.
+  example-rollup:
+    aggregate_of: [example]
+    aggregate: sum
+    tenant: example-team
+`))
+
+// initCommand writes an example configuration file
+func initCommand(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", "rules_exporter.yaml", "File to write the example config to, - for stdout.")
+	endpoint := fs.String("endpoint", "http://localhost:9090", "Endpoint of the example target.")
+	force := fs.Bool("force", false, "Overwrite an existing file.")
+	fs.Parse(args)
+
+	var buf bytes.Buffer
+	if err := exampleConfig.Execute(&buf, struct{ Endpoint string }{*endpoint}); err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if _, err := os.Stat(*output); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite", *output)
+	}
+	if err := ioutil.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *output)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Join enriches the results of a rule with labels of a second query, like
+// group_left in PromQL but possibly across endpoints
+type Join struct {
+	// Expr is the query returning the series holding the labels
+	Expr string `yaml:"expr"`
+	// Endpoint runs the query against another endpoint than the target's,
+	// with the same client settings
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// On are the labels matching a result to a series of the join query
+	On []string `yaml:"on"`
+	// Labels are copied from the matching series, replacing existing ones
+	Labels []string `yaml:"labels"`
+}
+
+func (j Join) validate() error {
+	if j.Expr == "" {
+		return fmt.Errorf("join needs an expr")
+	}
+	if len(j.On) == 0 || len(j.Labels) == 0 {
+		return fmt.Errorf("join needs on and labels")
+	}
+	if j.Endpoint != "" {
+		if err := validateEndpoint(j.Endpoint); err != nil {
+			return fmt.Errorf("join: %v", err)
+		}
+	}
+	return nil
+}
+
+// joinKey identifies the series with the same values of the on labels
+func joinKey(on []string, labels map[string]string) string {
+	values := make([]string, len(on))
+	for i, name := range on {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, "\xff")
+}
+
+// applyJoin runs the join query of the rule and copies the join labels of
+// the matching series into the samples. Samples without a matching series
+// are kept as they are. Several join series matching the same sample are an
+// error, as in PromQL.
+func applyJoin(ctx context.Context, target string, group Group, rule Rule, at time.Time, samples []Sample) error {
+	join := rule.Join
+	if join.Endpoint != "" {
+		group.Endpoint = join.Endpoint
+	}
+	results, err := runQuery(ctx, target, group, rule, join.Expr, at)
+	if err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+
+	series := map[string]map[string]string{}
+	for _, result := range results {
+		labels, _ := resultToSample(result)
+		key := joinKey(join.On, labels)
+		if _, exists := series[key]; exists {
+			return fmt.Errorf("join: several series of %s match %s", join.Expr, formatLabels(labels))
+		}
+		series[key] = labels
+	}
+
+	for _, sample := range samples {
+		match, exists := series[joinKey(join.On, sample.Labels)]
+		if !exists {
+			continue
+		}
+		for _, name := range join.Labels {
+			if value, found := match[name]; found {
+				sample.Labels[name] = value
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// jsonSample is the JSON representation of a sample. Numbers are strings, as
+// in the Prometheus API, so NaN and infinities can be represented.
+type jsonSample struct {
+	Name            string               `json:"name"`
+	Labels          map[string]string    `json:"labels"`
+	Value           string               `json:"value,omitempty"`
+	Histogram       *jsonHistogram       `json:"histogram,omitempty"`
+	Summary         *jsonSummary         `json:"summary,omitempty"`
+	NativeHistogram *jsonNativeHistogram `json:"native_histogram,omitempty"`
+	Timestamp       float64              `json:"timestamp"`
+}
+
+type jsonHistogram struct {
+	Buckets map[string]string `json:"buckets"`
+	Count   string            `json:"count"`
+	Sum     string            `json:"sum"`
+}
+
+type jsonSummary struct {
+	Quantiles map[string]string `json:"quantiles"`
+	Count     string            `json:"count"`
+	Sum       string            `json:"sum"`
+}
+
+// jsonNativeHistogram lists buckets as [lower, upper, count] like the API
+type jsonNativeHistogram struct {
+	Count   string      `json:"count"`
+	Sum     string      `json:"sum"`
+	Buckets [][3]string `json:"buckets"`
+}
+
+type jsonResponse struct {
+	Target  string       `json:"target"`
+	Samples []jsonSample `json:"samples"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// renderJSON encodes the samples of a target evaluated at the given time
+func renderJSON(target string, samples []Sample, at time.Time) (exposition, error) {
+	response := jsonResponse{Target: target, Samples: make([]jsonSample, 0, len(samples))}
+	timestamp := float64(at.UnixMilli()) / 1000
+	for _, sample := range samples {
+		response.Samples = append(response.Samples, toJSONSample(sample, timestamp))
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return exposition{}, err
+	}
+	return newExposition(body, "application/json"), nil
+}
+
+func toJSONSample(sample Sample, timestamp float64) jsonSample {
+	s := jsonSample{Name: sample.Name, Labels: sample.Labels, Timestamp: timestamp}
+	switch {
+	case sample.Histogram != nil:
+		h := sample.Histogram
+		s.Histogram = &jsonHistogram{Buckets: map[string]string{}, Count: strconv.FormatUint(h.Count, 10), Sum: formatFloat(h.Sum)}
+		for le, count := range h.Buckets {
+			s.Histogram.Buckets[formatFloat(le)] = strconv.FormatUint(count, 10)
+		}
+		s.Histogram.Buckets["+Inf"] = s.Histogram.Count
+	case sample.Summary != nil:
+		q := sample.Summary
+		s.Summary = &jsonSummary{Quantiles: map[string]string{}, Count: strconv.FormatUint(q.Count, 10), Sum: formatFloat(q.Sum)}
+		for quantile, value := range q.Quantiles {
+			s.Summary.Quantiles[formatFloat(quantile)] = formatFloat(value)
+		}
+	case sample.NativeHistogram != nil:
+		s.NativeHistogram = toJSONNativeHistogram(sample.NativeHistogram)
+	default:
+		s.Value = formatFloat(sample.Value)
+	}
+	return s
+}
+
+// toJSONNativeHistogram maps the bucket indexes back to their boundaries,
+// from the most negative bucket to the most positive one
+func toJSONNativeHistogram(h *NativeHistogramValue) *jsonNativeHistogram {
+	j := &jsonNativeHistogram{Count: formatFloat(h.Count), Sum: formatFloat(h.Sum), Buckets: [][3]string{}}
+	bound := func(i int32) float64 {
+		return math.Exp2(float64(i) / math.Exp2(float64(h.Schema)))
+	}
+	indexes := func(buckets map[int32]float64) []int32 {
+		var sorted []int32
+		for i := range buckets {
+			sorted = append(sorted, i)
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		return sorted
+	}
+
+	negative := indexes(h.Negative)
+	for n := len(negative) - 1; n >= 0; n-- {
+		i := negative[n]
+		j.Buckets = append(j.Buckets, [3]string{formatFloat(-bound(i)), formatFloat(-bound(i - 1)), formatFloat(h.Negative[i])})
+	}
+	if h.ZeroCount > 0 {
+		j.Buckets = append(j.Buckets, [3]string{formatFloat(-h.ZeroThreshold), formatFloat(h.ZeroThreshold), formatFloat(h.ZeroCount)})
+	}
+	for _, i := range indexes(h.Positive) {
+		j.Buckets = append(j.Buckets, [3]string{formatFloat(bound(i - 1)), formatFloat(bound(i)), formatFloat(h.Positive[i])})
+	}
+	return j
+}
@@ -0,0 +1,24 @@
+package main
+
+import "path/filepath"
+
+var (
+	// jsonnetCommand evaluates .jsonnet configuration files, set by
+	// --config.jsonnet-command
+	jsonnetCommand = "jsonnet"
+	// jsonnetExtVars are passed to jsonnetCommand as --ext-str, name=value
+	// or name for the environment variable, set by --config.jsonnet-ext-var
+	jsonnetExtVars stringsFlag
+)
+
+// evaluateJsonnet returns the configuration the data of a .jsonnet file
+// evaluates to. Its imports are still looked up next to the file.
+func evaluateJsonnet(configFile string, data []byte) ([]byte, error) {
+	args := []string{"--jpath", filepath.Dir(configFile)}
+	for _, v := range jsonnetExtVars {
+		args = append(args, "--ext-str", v)
+	}
+	return withConfigCopy(configFile, data, func(file string) ([]byte, error) {
+		return runConfigCommand(jsonnetCommand, append(args, file)...)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{
+		"status": "ok",
+		"data": {
+			"items": [
+				{"name": "a", "value": 1, "tags": {"env": "prod"}},
+				{"name": "b", "value": 2, "tags": {"env": "dev"}},
+				{"name": "c", "value": 3}
+			],
+			"odd key": {"x.y": 4}
+		}
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"$", []interface{}{doc}},
+		{"$.status", []interface{}{"ok"}},
+		{"$.data.items[0].name", []interface{}{"a"}},
+		{"$.data.items[-1].value", []interface{}{3.0}},
+		{"$.data.items[*].value", []interface{}{1.0, 2.0, 3.0}},
+		{"$.data.items.*.name", []interface{}{"a", "b", "c"}},
+		{"$.data.items[*].tags.env", []interface{}{"prod", "dev"}},
+		{"$['data']['odd key'][\"x.y\"]", []interface{}{4.0}},
+		{" $.data.items[ 1 ].name ", []interface{}{"b"}},
+		{"$.missing", nil},
+		{"$.data.items[3]", nil},
+		{"$.data.items[-4]", nil},
+		{"$.status[0]", nil},
+		{"$.data.items.name", nil},
+	}
+	for _, test := range tests {
+		path, err := parseJSONPath(test.path)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q): %v", test.path, err)
+			continue
+		}
+		if got := path.eval(doc); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v, want %v", test.path, got, test.want)
+		}
+	}
+
+	// Map wildcards match the values in any order
+	path, _ := parseJSONPath("$.data.items[0].*")
+	got := path.eval(doc)
+	var names []string
+	for _, v := range got {
+		if s, ok := v.(string); ok {
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+	if len(got) != 3 || !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("$.data.items[0].* = %v", got)
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"data.items", "must start with $"},
+		{"$.", "empty name"},
+		{"$..a", "empty name"},
+		{"$[0", "missing ]"},
+		{"$[a]", `invalid index "a"`},
+		{"$x", `unexpected "x"`},
+	}
+	for _, test := range tests {
+		_, err := parseJSONPath(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseJSONPath(%q) error = %v, want %s", test.path, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONConfig configures the json datasource, which turns the responses of
+// REST APIs into samples. The expression of a rule is the URL to get,
+// relative to the endpoint of the target unless it is absolute, and the
+// json settings of the rule select the values.
+type JSONConfig struct {
+	// Headers are sent with every request, e.g. for authentication
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// JSONExtract selects the samples of a rule of a json target from the
+// response. Items selects the objects that each become a sample, the whole
+// response by default. Value and Labels are evaluated on each item, where $
+// is the item.
+type JSONExtract struct {
+	Items  string            `yaml:"items,omitempty"`
+	Value  string            `yaml:"value"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+func (e JSONExtract) validate() error {
+	if e.Value == "" {
+		return fmt.Errorf("json needs a value")
+	}
+	paths := []string{e.Value}
+	if e.Items != "" {
+		paths = append(paths, e.Items)
+	}
+	for name, path := range e.Labels {
+		if name == "" || sanitizeLabelName(name) != name {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if name == "value" {
+			return fmt.Errorf("label name value is reserved for the value")
+		}
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if _, err := parseJSONPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	datasourceTypes["json"] = newJSONDatasource
+}
+
+type jsonDatasource struct {
+	group Group
+}
+
+func newJSONDatasource(group Group) (Datasource, error) {
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		if rule.JSON == nil {
+			return nil, fmt.Errorf("rule %s: json targets need json settings per rule", ruleID(rule))
+		}
+		if err := rule.JSON.validate(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", ruleID(rule), err)
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" && rule.Type != "info" {
+			return nil, fmt.Errorf("rule %s: json targets only support gauge, counter and info rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: json targets don't support join", ruleID(rule))
+		}
+	}
+	return jsonDatasource{group: group}, nil
+}
+
+// Query returns the whole response as a single sample, with its value if it
+// is a number
+func (j jsonDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return j.QueryRule(ctx, Rule{JSON: &JSONExtract{Value: "$"}}, expr, at)
+}
+
+func (j jsonDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	url := expr
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		if j.group.Endpoint == "" {
+			return nil, fmt.Errorf("relative URL %q without endpoint", expr)
+		}
+		url = strings.TrimSuffix(j.group.Endpoint, "/") + "/" + strings.TrimPrefix(url, "/")
+	}
+
+	client, err := clientFor(j.group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if j.group.JSON != nil {
+		for name, value := range j.group.JSON.Headers {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, &parseError{err}
+	}
+	return extractJSON(*rule.JSON, doc)
+}
+
+// extractJSON turns the items of a response into results
+func extractJSON(extract JSONExtract, doc interface{}) ([]map[string]interface{}, error) {
+	items := []interface{}{doc}
+	if extract.Items != "" {
+		path, _ := parseJSONPath(extract.Items)
+		items = path.eval(doc)
+	}
+	valuePath, _ := parseJSONPath(extract.Value)
+	labelPaths := map[string]jsonPath{}
+	for name, p := range extract.Labels {
+		labelPaths[name], _ = parseJSONPath(p)
+	}
+
+	results := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		values := valuePath.eval(item)
+		if len(values) != 1 {
+			return nil, &parseError{fmt.Errorf("value %s matches %d values", extract.Value, len(values))}
+		}
+		value, ok := jsonNumber(values[0])
+		if !ok {
+			return nil, &parseError{fmt.Errorf("value %s is not a number: %v", extract.Value, values[0])}
+		}
+		result := map[string]interface{}{"value": strconv.FormatFloat(value, 'g', -1, 64)}
+		for name, path := range labelPaths {
+			if matches := path.eval(item); len(matches) > 0 {
+				if label := jsonLabel(matches[0]); label != "" {
+					result[name] = label
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// jsonNumber converts numbers, numeric strings and booleans to a value
+func jsonNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// jsonLabel converts a scalar JSON value to a label value
+func jsonLabel(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
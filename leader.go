@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// leaseTimeFormat is the MicroTime format of the times of leases
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "rules_exporter_leader",
+	Help: "Whether this replica holds the leader election lease and performs the scheduled evaluations.",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// leaderElector holds a Kubernetes coordination.k8s.io/v1 Lease while this
+// replica is the leader, like the leader election of client-go
+type leaderElector struct {
+	client        *http.Client
+	url           string // of the lease
+	token         string
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+
+	leader     bool
+	renewed    time.Time // last successful renewal as leader
+	observed   string    // holder and renew time of the lease last seen
+	observedAt time.Time
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Metadata is kept as is, its resourceVersion makes updates fail if
+	// another replica changed the lease in the meantime
+	Metadata map[string]interface{} `json:"metadata"`
+	Spec     leaseSpec              `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// newLeaderElector uses the service account of the pod to hold the lease
+// given as name or namespace/name, in the namespace of the pod by default
+func newLeaderElector(leaseName, identity string, leaseDuration, retryPeriod time.Duration) (*leaderElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("leader election needs to run in Kubernetes, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	if leaseDuration < time.Second || retryPeriod <= 0 || retryPeriod >= leaseDuration {
+		return nil, fmt.Errorf("the lease duration must be at least 1s and longer than the positive retry period")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+
+	namespace, name, found := strings.Cut(leaseName, "/")
+	if !found {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace, name = strings.TrimSpace(string(data)), leaseName
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid lease %q", leaseName)
+	}
+	if identity == "" {
+		// The hostname of pods is their name
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &leaderElector{
+		client:        &http.Client{Transport: transport, Timeout: retryPeriod},
+		url:           fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), namespace),
+		token:         strings.TrimSpace(string(token)),
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+	}, nil
+}
+
+// run tries to acquire or renew the lease every retry period and calls
+// onChange when this replica becomes or stops being the leader. It releases
+// the lease when ctx is done.
+func (e *leaderElector) run(ctx context.Context, onChange func(leader bool)) {
+	log.Printf("Waiting to become the leader as %s with lease %s/%s", e.identity, e.namespace, e.name)
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+	for {
+		leader, err := e.tryAcquireOrRenew()
+		switch {
+		case err != nil && e.leader && time.Since(e.renewed) < e.leaseDuration*2/3:
+			// Keep leading until the renewals failed for too long
+			log.Printf("Error renewing lease %s/%s: %v", e.namespace, e.name, err)
+			leader = true
+		case err != nil:
+			log.Printf("Error in leader election with lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if leader && err == nil {
+			e.renewed = time.Now()
+		}
+		if leader != e.leader {
+			e.leader = leader
+			if leader {
+				log.Printf("Became the leader")
+				leaderGauge.Set(1)
+			} else {
+				log.Printf("Stopped being the leader")
+				leaderGauge.Set(0)
+			}
+			onChange(leader)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if e.leader {
+				e.release()
+			}
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew updates the lease if this replica holds it or it
+// expired, and tells whether this replica holds it now. The lease expires a
+// lease duration after it was last seen changing, so the clocks of the
+// replicas don't matter.
+func (e *leaderElector) tryAcquireOrRenew() (bool, error) {
+	now := time.Now()
+	current, err := e.get()
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		l := &lease{Metadata: map[string]interface{}{"name": e.name, "namespace": e.namespace}, Spec: e.spec(now, now, 0)}
+		return e.put(http.MethodPost, e.url, l)
+	}
+
+	if record := current.Spec.HolderIdentity + " " + current.Spec.RenewTime; record != e.observed {
+		e.observed, e.observedAt = record, now
+	}
+	holder := current.Spec.HolderIdentity
+	duration := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+	if holder != "" && holder != e.identity && now.Before(e.observedAt.Add(duration)) {
+		return false, nil
+	}
+
+	acquired, transitions := now, current.Spec.LeaseTransitions
+	if holder == e.identity {
+		if t, err := time.Parse(leaseTimeFormat, current.Spec.AcquireTime); err == nil {
+			acquired = t
+		}
+	} else {
+		transitions++
+	}
+	current.Spec = e.spec(acquired, now, transitions)
+	return e.put(http.MethodPut, e.url+"/"+e.name, current)
+}
+
+func (e *leaderElector) spec(acquired, renewed time.Time, transitions int) leaseSpec {
+	return leaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.leaseDuration / time.Second),
+		AcquireTime:          acquired.UTC().Format(leaseTimeFormat),
+		RenewTime:            renewed.UTC().Format(leaseTimeFormat),
+		LeaseTransitions:     transitions,
+	}
+}
+
+// release hands the lease over to the other replicas by expiring it
+func (e *leaderElector) release() {
+	current, err := e.get()
+	if err != nil || current == nil || current.Spec.HolderIdentity != e.identity {
+		return
+	}
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	current.Spec.RenewTime = time.Now().UTC().Format(leaseTimeFormat)
+	if _, err := e.put(http.MethodPut, e.url+"/"+e.name, current); err != nil {
+		log.Printf("Error releasing lease %s/%s: %v", e.namespace, e.name, err)
+	}
+}
+
+// get returns the lease, or nil if it doesn't exist
+func (e *leaderElector) get() (*lease, error) {
+	resp, data, err := e.do(http.MethodGet, e.url+"/"+e.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, responseError(resp.StatusCode, data)
+	}
+	var l lease
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, &parseError{err}
+	}
+	return &l, nil
+}
+
+// put creates or updates the lease. It returns false without error if
+// another replica changed the lease first.
+func (e *leaderElector) put(method, url string, l *lease) (bool, error) {
+	l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	resp, data, err := e.do(method, url, body)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, responseError(resp.StatusCode, data)
+}
+
+func (e *leaderElector) do(method, url string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp, data, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// listTargetsCommand prints a table of the configured targets
+func listTargetsCommand(args []string) error {
+	fs := flag.NewFlagSet("list-targets", flag.ExitOnError)
+	configFile := configFlags(fs)
+	noHeader := fs.Bool("no-header", false, "Omit the header line.")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range config.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*noHeader {
+		fmt.Fprintln(w, "TARGET\tENDPOINT\tRULES")
+	}
+	for _, name := range names {
+		group := config.Targets[name]
+		if len(group.AggregateOf) > 0 {
+			fmt.Fprintf(w, "%s\taggregate of %s\t-\n", name, strings.Join(group.AggregateOf, ","))
+			continue
+		}
+		endpoint := group.Endpoint
+		if endpoint == "" {
+			// Datasources without endpoint, e.g. exec
+			endpoint = group.Type
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", name, endpoint, len(group.Rules))
+	}
+	return w.Flush()
+}
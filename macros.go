@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandMacros replaces $name in the expressions of config, those of rules,
+// joins and discovery, by the macro of that name, after extends are
+// resolved. Macros may use other macros. $$ stands for a literal $, a $ not
+// followed by a name, like the anchor in =~"api$", is kept. Configurations
+// without macros are left as they are, so their expressions may use $name,
+// e.g. in the replacement of label_replace.
+func expandMacros(config *Config) error {
+	if len(config.Macros) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range config.Macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isMacroName(name) {
+			return fmt.Errorf("macro %q: names may only contain letters, digits and _ and not start with a digit", name)
+		}
+	}
+	m := macroExpander{macros: config.Macros, expanded: map[string]string{}}
+	for _, name := range names {
+		// Also those no expression uses yet
+		if _, err := m.macro(name, nil); err != nil {
+			return fmt.Errorf("macro %s: %v", name, err)
+		}
+	}
+
+	expandRules := func(rules []Rule) error {
+		for i := range rules {
+			rule := &rules[i]
+			for _, expr := range []*string{&rule.Expr, &rule.SumExpr, &rule.CountExpr} {
+				var err error
+				if *expr, err = m.expand(*expr, nil); err != nil {
+					return fmt.Errorf("rule %s: %v", ruleID(*rule), err)
+				}
+			}
+			if rule.Join != nil {
+				join := *rule.Join
+				var err error
+				if join.Expr, err = m.expand(join.Expr, nil); err != nil {
+					return fmt.Errorf("rule %s: join: %v", ruleID(*rule), err)
+				}
+				rule.Join = &join
+			}
+		}
+		return nil
+	}
+
+	for name, group := range config.Targets {
+		// The rules may be shared with the target extended
+		group.Rules = append([]Rule{}, group.Rules...)
+		if err := expandRules(group.Rules); err != nil {
+			return fmt.Errorf("target %s, %v", name, err)
+		}
+		config.Targets[name] = group
+	}
+	for i := range config.Discovery {
+		d := &config.Discovery[i]
+		var err error
+		if d.Query, err = m.expand(d.Query, nil); err != nil {
+			return fmt.Errorf("discovery %s: %v", d.Name, err)
+		}
+		if err := expandRules(d.Target.Rules); err != nil {
+			return fmt.Errorf("discovery %s, %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// macroExpander expands expressions, remembering the expansion of every
+// macro
+type macroExpander struct {
+	macros   map[string]string
+	expanded map[string]string
+}
+
+// expand replaces the macros in s, stack holds the macros being expanded to
+// detect cycles
+func (m macroExpander) expand(s string, stack []string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(s) && isMacroChar(s[end], end == i+1) {
+			end++
+		}
+		if end == i+1 {
+			b.WriteByte('$')
+			continue
+		}
+		name := s[i+1 : end]
+		value, err := m.macro(name, stack)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i = end - 1
+	}
+	return b.String(), nil
+}
+
+func (m macroExpander) macro(name string, stack []string) (string, error) {
+	if value, done := m.expanded[name]; done {
+		return value, nil
+	}
+	for _, n := range stack {
+		if n == name {
+			return "", fmt.Errorf("macro cycle $%s", strings.Join(append(stack, name), " -> $"))
+		}
+	}
+	body, exists := m.macros[name]
+	if !exists {
+		return "", fmt.Errorf("unknown macro $%s", name)
+	}
+	value, err := m.expand(body, append(stack, name))
+	if err != nil {
+		return "", err
+	}
+	m.expanded[name] = value
+	return value, nil
+}
+
+func isMacroName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isMacroChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isMacroChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// metricMetadata is an entry of the metadata API of Prometheus
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// ruleMetadata returns the metadata of the metrics a rule exports, by name.
+// Rules exporting the upstream metric names have no names known in advance.
+func ruleMetadata(rule Rule) map[string]metricMetadata {
+	name := ruleMetricName(rule)
+	if name == "" {
+		return nil
+	}
+	unit := ""
+	if conversion, exists := unitConversions[rule.Unit]; exists {
+		unit = conversion.to
+	}
+	metadata := map[string]metricMetadata{}
+	switch rule.Type {
+	case "histogram":
+		metadata[name] = metricMetadata{"histogram", fmt.Sprintf("Histogram of Prometheus query: %s", rule.Expr), unit}
+	case "summary":
+		metadata[name] = metricMetadata{"summary", fmt.Sprintf("Summary of Prometheus query: %s", rule.Expr), unit}
+	case "info":
+		metadata[name] = metricMetadata{"info", fmt.Sprintf("Information from Prometheus query: %s", rule.Expr), unit}
+	case "counter":
+		metadata[name] = metricMetadata{"counter", ruleHelp(rule), unit}
+	default:
+		metadata[name] = metricMetadata{"gauge", ruleHelp(rule), unit}
+	}
+	if rule.Present {
+		metadata[name+"_present"] = metricMetadata{"gauge", fmt.Sprintf("Whether Prometheus query returned any series: %s", rule.Expr), ""}
+	}
+	return metadata
+}
+
+// metadataHandler serves the type, help and unit of the metrics of all
+// configured rules like /api/v1/metadata of Prometheus, so tools like
+// Grafana can describe them. ?metric=, ?limit= and ?limit_per_metric= are
+// supported. Rules of tenants and of targets with a probe_token are only
+// included with their tokens.
+func metadataHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		query := r.URL.Query()
+		limit, limitPerMetric := -1, -1
+		for param, value := range map[string]*int{"limit": &limit, "limit_per_metric": &limitPerMetric} {
+			if s := query.Get(param); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid %s %q", param, s))
+					return
+				}
+				*value = n
+			}
+		}
+		metric := query.Get("metric")
+
+		var targets []string
+		for target := range config.Targets {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+
+		data := map[string][]metricMetadata{}
+		for _, target := range targets {
+			group := config.Targets[target]
+			if !tenantVisible(r, config, group) || !probeAllowed(r, group) {
+				continue
+			}
+			for _, rule := range group.Rules {
+				for name, m := range ruleMetadata(rule) {
+					if metric != "" && name != metric {
+						continue
+					}
+					if containsMetadata(data[name], m) {
+						continue
+					}
+					if _, exists := data[name]; !exists && limit >= 0 && len(data) >= limit {
+						continue
+					}
+					if limitPerMetric >= 0 && len(data[name]) >= limitPerMetric {
+						continue
+					}
+					data[name] = append(data[name], m)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string                      `json:"status"`
+			Data   map[string][]metricMetadata `json:"data"`
+		}{"success", data})
+	}
+}
+
+func containsMetadata(metadata []metricMetadata, m metricMetadata) bool {
+	for _, existing := range metadata {
+		if existing == m {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAPIError writes an error response of the Prometheus API
+func writeAPIError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": "error", "errorType": errorType, "error": message})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// MQTTSink publishes samples to an MQTT broker with MQTT 3.1.1. Samples with
+// the same topic are published together as JSON like the format=json
+// response of probes.
+type MQTTSink struct {
+	// URL of the broker, tcp://host:1883 or ssl://host:8883 (also mqtt://,
+	// mqtts:// and tls://)
+	URL       string     `yaml:"url"`
+	TLSConfig *TLSConfig `yaml:"tls_config,omitempty"`
+	// ClientID is rules_exporter-<hostname> by default
+	ClientID string `yaml:"client_id,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Topic is a template with .Target, .Name, .Rule and .Labels, by default
+	// rules_exporter/<target>/<rule>
+	Topic string `yaml:"topic,omitempty"`
+	// QoS is 0 (default) or 1, which waits for the broker to acknowledge
+	QoS    byte `yaml:"qos,omitempty"`
+	Retain bool `yaml:"retain,omitempty"`
+	// KeepAlive of the connection, 60s by default
+	KeepAlive time.Duration `yaml:"keep_alive,omitempty"`
+	// Timeout of connecting and of acknowledgements, 10s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+const (
+	defaultMQTTTopic     = "rules_exporter/{{ .Target }}/{{ .Rule }}"
+	defaultMQTTKeepAlive = 60 * time.Second
+	defaultMQTTTimeout   = 10 * time.Second
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+func init() {
+	sinkTypes["mqtt"] = newMQTTWriter
+}
+
+type mqttWriter struct {
+	config  MQTTSink
+	address string
+	tls     *tls.Config
+	topic   *template.Template
+	conn    *mqttConn
+}
+
+func newMQTTWriter(s Sink) (sinkWriter, error) {
+	c := s.MQTT
+	if c == nil || c.URL == "" {
+		return nil, fmt.Errorf("mqtt sinks need mqtt.url")
+	}
+	config := *c
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt url: %v", err)
+	}
+	w := &mqttWriter{config: config, address: u.Host}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+		w.tls = &tls.Config{}
+		if config.TLSConfig != nil {
+			tlsConfig, err := config.TLSConfig.tlsClientConfig()
+			if err != nil {
+				return nil, err
+			}
+			if tlsConfig != nil {
+				w.tls = tlsConfig
+			}
+		}
+	default:
+		return nil, fmt.Errorf("mqtt url: unknown scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		w.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if config.QoS > 1 {
+		return nil, fmt.Errorf("mqtt qos must be 0 or 1")
+	}
+	if config.KeepAlive < 0 || config.KeepAlive > 18*time.Hour {
+		return nil, fmt.Errorf("mqtt keep_alive must be between 0 and 18h")
+	}
+	if config.ClientID == "" {
+		hostname, _ := os.Hostname()
+		config.ClientID = "rules_exporter-" + hostname
+	}
+	if config.Topic == "" {
+		config.Topic = defaultMQTTTopic
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaultMQTTKeepAlive
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultMQTTTimeout
+	}
+	if w.topic, err = template.New("topic").Option("missingkey=error").Parse(config.Topic); err != nil {
+		return nil, fmt.Errorf("mqtt topic: %v", err)
+	}
+	w.config = config
+	return w, nil
+}
+
+func (w *mqttWriter) write(target string, eval evaluation) error {
+	// Wildcards are not allowed in the topics of messages
+	messages, err := topicMessages(w.topic, target, eval, strings.NewReplacer("+", "_", "#", "_").Replace)
+	if err != nil {
+		return fmt.Errorf("mqtt topic: %v", err)
+	}
+	var topics []string
+	for topic := range messages {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for attempt := 0; ; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = dialMQTT(w.address, w.tls, w.config); err != nil {
+				w.conn = nil
+				return err
+			}
+		}
+		for len(topics) > 0 {
+			if err = w.conn.publish(topics[0], messages[topics[0]], w.config.QoS, w.config.Retain, w.config.Timeout); err != nil {
+				break
+			}
+			topics = topics[1:]
+		}
+		if err == nil {
+			return nil
+		}
+		// Retry the remaining topics once on a new connection
+		w.conn.close()
+		w.conn = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+func (w *mqttWriter) close() {
+	if w.conn != nil {
+		w.conn.close()
+	}
+}
+
+// mqttConn is a connection to a broker. A goroutine reads the packets of the
+// broker and another one pings it.
+type mqttConn struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	packetID uint16
+	acks     chan uint16
+	done     chan struct{}
+	err      error // set before done is closed
+}
+
+func dialMQTT(address string, tlsConfig *tls.Config, config MQTTSink) (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var payload bytes.Buffer
+	writeMQTTString(&payload, "MQTT")
+	flags := byte(0x02) // clean session
+	if config.Username != "" {
+		flags |= 0x80
+		if config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	payload.WriteByte(4) // protocol level of 3.1.1
+	payload.WriteByte(flags)
+	binary.Write(&payload, binary.BigEndian, uint16(config.KeepAlive/time.Second))
+	writeMQTTString(&payload, config.ClientID)
+	if config.Username != "" {
+		writeMQTTString(&payload, config.Username)
+		if config.Password != "" {
+			writeMQTTString(&payload, config.Password)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	reader := bufio.NewReader(conn)
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, payload.Bytes())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	header, body, err := readMQTTPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: %v", err)
+	}
+	if header>>4 != mqttConnAck || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: unexpected packet type %d", header>>4)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: refused with return code %d", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttConn{conn: conn, acks: make(chan uint16, 16), done: make(chan struct{})}
+	go c.read(reader, config.KeepAlive)
+	go c.ping(config.KeepAlive)
+	return c, nil
+}
+
+// read handles the packets of the broker until the connection fails. The
+// broker has to answer within one and a half keep alive intervals.
+func (c *mqttConn) read(reader *bufio.Reader, keepAlive time.Duration) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			c.err = err
+			close(c.done)
+			return
+		}
+		if header>>4 == mqttPubAck && len(body) == 2 {
+			select {
+			case c.acks <- binary.BigEndian.Uint16(body):
+			default:
+			}
+		}
+	}
+}
+
+// ping pings the broker every half keep alive interval, so it keeps the
+// connection and the reader hears from it even if QoS 0 messages are sent
+func (c *mqttConn) ping(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMu.Lock()
+			c.send(mqttPacket(mqttPingReq<<4, nil))
+			c.writeMu.Unlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send writes a packet, with writeMu held
+func (c *mqttConn) send(packet []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(defaultMQTTTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttConn) publish(topic string, payload []byte, qos byte, retain bool, timeout time.Duration) error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	var body bytes.Buffer
+	writeMQTTString(&body, topic)
+	header := byte(mqttPublish<<4) | qos<<1
+	if retain {
+		header |= 1
+	}
+
+	c.writeMu.Lock()
+	var id uint16
+	if qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		id = c.packetID
+		binary.Write(&body, binary.BigEndian, id)
+	}
+	body.Write(payload)
+	err := c.send(mqttPacket(header, body.Bytes()))
+	c.writeMu.Unlock()
+	if err != nil || qos == 0 {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-c.acks:
+			if ack == id {
+				return nil
+			}
+		case <-c.done:
+			return c.err
+		case <-timer.C:
+			return fmt.Errorf("mqtt: no acknowledgement of %s within %s", topic, timeout)
+		}
+	}
+}
+
+func (c *mqttConn) close() {
+	c.writeMu.Lock()
+	c.send(mqttPacket(mqttDisconnect<<4, nil))
+	c.writeMu.Unlock()
+	c.conn.Close()
+}
+
+// mqttPacket prefixes a packet body with the fixed header
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func writeMQTTString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// readMQTTPacket returns the first byte and the body of the next packet
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed packet length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// probeConcurrency is the number of targets evaluated at the same time by a
+// probe of several targets
+var probeConcurrency = 4
+
+// probeAllTargets returns the targets probed with target=*: all targets the
+// request has the probe and tenant tokens of, apart from aggregate targets,
+// which repeat the series of their members
+func probeAllTargets(r *http.Request, config Config) []string {
+	var names []string
+	for name, group := range config.Targets {
+		if len(group.AggregateOf) == 0 && probeAllowed(r, group) && tenantVisible(r, config, group) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// probeTargets answers a probe of several targets. Their series are kept
+// apart by a target label, as for an aggregate target without aggregate.
+// The targets are evaluated probeConcurrency at a time. Every target needs
+// its probe and tenant token, and response_cache and the rules parameter
+// don't apply.
+func probeTargets(w http.ResponseWriter, r *http.Request, config Config, names []string, scheduled bool) {
+	if r.URL.Query().Get("rules") != "" {
+		http.Error(w, "The rules parameter is not supported for several targets", http.StatusBadRequest)
+		return
+	}
+
+	var members []string
+	seen := map[string]bool{}
+	// The probe counts once against the limits of every tenant whose targets
+	// it evaluates
+	admitted := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		group, exists := config.Targets[name]
+		if !exists {
+			http.Error(w, fmt.Sprintf("Target %s not found", name), http.StatusNotFound)
+			return
+		}
+		if _, shared := peerEvaluation(name); scheduled && !ownsTarget(name) && !shared {
+			http.Error(w, fmt.Sprintf("Target %s is evaluated by shard %d", name, shardOf(name)), http.StatusNotFound)
+			return
+		}
+		if !checkProbeToken(w, r, group) {
+			return
+		}
+		if !admitted[group.Tenant] {
+			release, ok := admitTenant(w, r, config, group)
+			if !ok {
+				return
+			}
+			defer release()
+			admitted[group.Tenant] = true
+		}
+		members = append(members, name)
+	}
+
+	evals := make(map[string]evaluation, len(members))
+	if scheduled {
+		for _, member := range members {
+			evals[member] = getEvaluation(member)
+		}
+	} else {
+		ctx, cancel := probeContext(r)
+		defer cancel()
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, max(probeConcurrency, 1))
+		for _, member := range members {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				memberEval := evaluateTarget(ctx, member, config.Targets[member])
+				mu.Lock()
+				evals[member] = memberEval
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+	}
+
+	var failed *RuleError
+	eval := aggregateEvaluation(Group{AggregateOf: members}, func(member string) evaluation {
+		memberEval := evals[member]
+		if f := probeFailure(config.Targets[member], memberEval); f != nil && failed == nil {
+			failed = &RuleError{Rule: member + "/" + f.Rule, Error: f.Error}
+		}
+		return memberEval
+	})
+	if r.Context().Err() != nil {
+		// The scraper is gone, there is no one to answer
+		return
+	}
+	if failed != nil {
+		http.Error(w, fmt.Sprintf("Error rendering metrics: rule %s failed: %s", failed.Rule, failed.Error), http.StatusInternalServerError)
+		return
+	}
+
+	var e exposition
+	var err error
+	if r.URL.Query().Get("format") == "json" {
+		e, err = renderJSON(strings.Join(members, ","), eval.Samples, eval.Time)
+	} else {
+		e, err = renderExposition(expfmt.Negotiate(r.Header), sampleCollector{samples: eval.Samples})
+	}
+	if err != nil {
+		http.Error(w, "Error rendering metrics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeExposition(w, r, e)
+}
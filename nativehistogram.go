@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// NativeHistogramValue is a native histogram returned by the query API with
+// its buckets mapped back to their index in the exponential schema
+type NativeHistogramValue struct {
+	Count         float64
+	Sum           float64
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	Positive      map[int32]float64
+	Negative      map[int32]float64
+}
+
+func (h *NativeHistogramValue) String() string {
+	return fmt.Sprintf("native histogram count=%g sum=%g schema=%d zero_count=%g buckets=%d",
+		h.Count, h.Sum, h.Schema, h.ZeroCount, len(h.Positive)+len(h.Negative))
+}
+
+// parseNativeHistogram converts the histogram field of a query result,
+// [<time>, {"count": "..", "sum": "..", "buckets": [[<boundary>, "<lower>", "<upper>", "<count>"], ..]}]
+func parseNativeHistogram(v interface{}) (*NativeHistogramValue, error) {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, fmt.Errorf("unexpected histogram value %v", v)
+	}
+	fields, ok := pair[1].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected histogram value %v", v)
+	}
+
+	h := &NativeHistogramValue{Positive: map[int32]float64{}, Negative: map[int32]float64{}}
+	var err error
+	if h.Count, err = parseFloatField(fields["count"]); err != nil {
+		return nil, fmt.Errorf("histogram count: %v", err)
+	}
+	if h.Sum, err = parseFloatField(fields["sum"]); err != nil {
+		return nil, fmt.Errorf("histogram sum: %v", err)
+	}
+
+	type bucket struct{ lower, upper, count float64 }
+	var buckets []bucket
+	rawBuckets, _ := fields["buckets"].([]interface{})
+	for _, raw := range rawBuckets {
+		b, ok := raw.([]interface{})
+		if !ok || len(b) != 4 {
+			return nil, fmt.Errorf("unexpected histogram bucket %v", raw)
+		}
+		var parsed bucket
+		for i, f := range []*float64{&parsed.lower, &parsed.upper, &parsed.count} {
+			if *f, err = parseFloatField(b[i+1]); err != nil {
+				return nil, fmt.Errorf("histogram bucket %v: %v", raw, err)
+			}
+		}
+		buckets = append(buckets, parsed)
+	}
+
+	// The schema follows from the width of any regular bucket, as the upper
+	// bound of bucket i is 2^(i * 2^-schema)
+	schemaFound := false
+	for _, b := range buckets {
+		if b.lower > 0 || b.upper < 0 {
+			ratio := math.Abs(b.upper / b.lower)
+			if b.upper < 0 {
+				ratio = math.Abs(b.lower / b.upper)
+			}
+			h.Schema = int32(math.Round(-math.Log2(math.Log2(ratio))))
+			schemaFound = true
+			break
+		}
+	}
+	if schemaFound && (h.Schema < -4 || h.Schema > 8) {
+		return nil, fmt.Errorf("unsupported histogram schema %d", h.Schema)
+	}
+
+	scale := math.Exp2(float64(h.Schema))
+	for _, b := range buckets {
+		switch {
+		case b.lower <= 0 && b.upper >= 0:
+			h.ZeroThreshold = b.upper
+			h.ZeroCount = b.count
+		case b.lower > 0:
+			h.Positive[int32(math.Round(math.Log2(b.upper)*scale))] = b.count
+		default:
+			h.Negative[int32(math.Round(math.Log2(-b.lower)*scale))] = b.count
+		}
+	}
+	return h, nil
+}
+
+func parseFloatField(v interface{}) (float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("expected a string, got %v", v)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// nativeHistogramMetric exposes a NativeHistogramValue as a float histogram.
+// Only the protobuf exposition carries the buckets, the text formats fall
+// back to _sum and _count.
+type nativeHistogramMetric struct {
+	desc      *prometheus.Desc
+	labels    []*dto.LabelPair
+	histogram *NativeHistogramValue
+}
+
+func newNativeHistogramMetric(desc *prometheus.Desc, h *NativeHistogramValue, labelNames, labelValues []string) prometheus.Metric {
+	labels := make([]*dto.LabelPair, len(labelNames))
+	for i := range labelNames {
+		labels[i] = &dto.LabelPair{Name: proto.String(labelNames[i]), Value: proto.String(labelValues[i])}
+	}
+	return nativeHistogramMetric{desc: desc, labels: labels, histogram: h}
+}
+
+func (m nativeHistogramMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m nativeHistogramMetric) Write(out *dto.Metric) error {
+	h := m.histogram
+	positiveSpans, positiveCounts := bucketSpans(h.Positive)
+	negativeSpans, negativeCounts := bucketSpans(h.Negative)
+
+	out.Label = m.labels
+	out.Histogram = &dto.Histogram{
+		SampleCount:      proto.Uint64(uint64(math.Round(h.Count))),
+		SampleCountFloat: proto.Float64(h.Count),
+		SampleSum:        proto.Float64(h.Sum),
+		Schema:           proto.Int32(h.Schema),
+		ZeroThreshold:    proto.Float64(h.ZeroThreshold),
+		ZeroCountFloat:   proto.Float64(h.ZeroCount),
+		PositiveSpan:     positiveSpans,
+		PositiveCount:    positiveCounts,
+		NegativeSpan:     negativeSpans,
+		NegativeCount:    negativeCounts,
+	}
+	return nil
+}
+
+// bucketSpans encodes buckets by index as spans of consecutive buckets and
+// their absolute counts
+func bucketSpans(buckets map[int32]float64) ([]*dto.BucketSpan, []float64) {
+	var indexes []int
+	for i := range buckets {
+		indexes = append(indexes, int(i))
+	}
+	sort.Ints(indexes)
+
+	var spans []*dto.BucketSpan
+	var counts []float64
+	next := 0
+	for n, i := range indexes {
+		if n == 0 || i != next {
+			offset := i
+			if n > 0 {
+				offset = i - next
+			}
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(int32(offset)), Length: proto.Uint32(0)})
+		}
+		span := spans[len(spans)-1]
+		*span.Length++
+		counts = append(counts, buckets[int32(i)])
+		next = i + 1
+	}
+	return spans, counts
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// NATSSink publishes samples to NATS subjects. Samples with the same
+// subject are published together as JSON like the format=json response of
+// probes.
+type NATSSink struct {
+	// URL of the server, nats://host:4222 or tls://host:4222
+	URL       string     `yaml:"url"`
+	TLSConfig *TLSConfig `yaml:"tls_config,omitempty"`
+	Username  string     `yaml:"username,omitempty"`
+	Password  string     `yaml:"password,omitempty"`
+	Token     string     `yaml:"token,omitempty"`
+	// Subject is a template with .Target, .Name, .Rule and .Labels, by
+	// default rules_exporter.<target>.<rule>
+	Subject string `yaml:"subject,omitempty"`
+	// JetStream waits for a stream to store every message
+	JetStream bool `yaml:"jetstream,omitempty"`
+	// Timeout of connecting and of acknowledgements, 10s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+const (
+	defaultNATSSubject = "rules_exporter.{{ .Target }}.{{ .Rule }}"
+	defaultNATSTimeout = 10 * time.Second
+)
+
+func init() {
+	sinkTypes["nats"] = newNATSWriter
+}
+
+type natsWriter struct {
+	config  NATSSink
+	address string
+	tls     *tls.Config
+	subject *template.Template
+	conn    *natsConn
+}
+
+func newNATSWriter(s Sink) (sinkWriter, error) {
+	c := s.NATS
+	if c == nil || c.URL == "" {
+		return nil, fmt.Errorf("nats sinks need nats.url")
+	}
+	config := *c
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("nats url: %v", err)
+	}
+	w := &natsWriter{address: u.Host}
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		w.tls = &tls.Config{}
+	default:
+		return nil, fmt.Errorf("nats url: unknown scheme %q", u.Scheme)
+	}
+	if config.TLSConfig != nil {
+		tlsConfig, err := config.TLSConfig.tlsClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			w.tls = tlsConfig
+		}
+	}
+	if u.Port() == "" {
+		w.address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil && config.Username == "" {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+	if config.Subject == "" {
+		config.Subject = defaultNATSSubject
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultNATSTimeout
+	}
+	if w.subject, err = template.New("subject").Option("missingkey=error").Parse(config.Subject); err != nil {
+		return nil, fmt.Errorf("nats subject: %v", err)
+	}
+	w.config = config
+	return w, nil
+}
+
+// natsSubjectEscape replaces whitespace and wildcards, which subjects of
+// messages can't contain
+var natsSubjectEscape = strings.NewReplacer(" ", "_", "\t", "_", "\r", "_", "\n", "_", "*", "_", ">", "_")
+
+func (w *natsWriter) write(target string, eval evaluation) error {
+	messages, err := topicMessages(w.subject, target, eval, natsSubjectEscape.Replace)
+	if err != nil {
+		return fmt.Errorf("nats subject: %v", err)
+	}
+	var subjects []string
+	for subject := range messages {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	for attempt := 0; ; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = dialNATS(w.address, w.tls, w.config); err != nil {
+				w.conn = nil
+				return err
+			}
+		}
+		if w.config.JetStream {
+			for len(subjects) > 0 {
+				if err = w.conn.request(subjects[0], messages[subjects[0]], w.config.Timeout); err != nil {
+					break
+				}
+				subjects = subjects[1:]
+			}
+		} else {
+			for _, subject := range subjects {
+				if err = w.conn.publish(subject, "", messages[subject]); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				// The server answers the ping after processing the messages,
+				// or reports an error like a permissions violation first
+				err = w.conn.flush(w.config.Timeout)
+			}
+		}
+		if err == nil || !w.conn.failed() {
+			return err
+		}
+		// Retry once on a new connection if the connection was lost
+		w.conn.close()
+		w.conn = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+func (w *natsWriter) close() {
+	if w.conn != nil {
+		w.conn.close()
+	}
+}
+
+// natsConn is a connection to a NATS server with a goroutine reading what
+// the server sends
+type natsConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	inbox   string
+	nextID  int
+	pongs   chan struct{}
+	errs    chan error
+	replies chan natsReply
+	done    chan struct{}
+	err     error // set before done is closed
+}
+
+// natsReply is a message received on the inbox. Status is set for replies
+// of the server like 503 when no stream stores the subject.
+type natsReply struct {
+	subject string
+	status  string
+	data    []byte
+}
+
+func dialNATS(address string, tlsConfig *tls.Config, config NATSSink) (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	if rest, ok := strings.CutPrefix(line, "INFO "); !ok || json.Unmarshal([]byte(rest), &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	if info.TLSRequired && tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("nats: %v", err)
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"tls_required":  tlsConfig != nil,
+		"name":          "rules_exporter",
+		"lang":          "go",
+		"version":       "rules_exporter",
+		"protocol":      1,
+		"headers":       info.Headers,
+		"no_responders": info.Headers,
+		"user":          config.Username,
+		"pass":          config.Password,
+		"auth_token":    config.Token,
+	})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server answers the ping once the connection is authorized
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("nats connect: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("nats connect: %s", natsError(line))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &natsConn{
+		conn:    conn,
+		inbox:   "_INBOX." + hex.EncodeToString(id),
+		pongs:   make(chan struct{}, 1),
+		errs:    make(chan error, 1),
+		replies: make(chan natsReply, 1),
+		done:    make(chan struct{}),
+	}
+	if config.JetStream {
+		if _, err := fmt.Fprintf(conn, "SUB %s.* 1\r\n", c.inbox); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go c.read(reader)
+	return c, nil
+}
+
+// read handles what the server sends until the connection fails
+func (c *natsConn) read(reader *bufio.Reader) {
+	fail := func(err error) {
+		c.err = err
+		close(c.done)
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			fail(err)
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			c.writeMu.Lock()
+			_, err = io.WriteString(c.conn, "PONG\r\n")
+			c.writeMu.Unlock()
+		case "PONG":
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			select {
+			case c.errs <- errors.New("nats: " + natsError(line)):
+			default:
+			}
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size> and HMSG <subject> <sid>
+			// [reply] <header size> <total size>
+			var reply natsReply
+			reply, err = readNATSMessage(reader, fields)
+			if err == nil {
+				select {
+				case c.replies <- reply:
+				default:
+				}
+			}
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+}
+
+func readNATSMessage(reader *bufio.Reader, fields []string) (natsReply, error) {
+	headerSize := 0
+	if fields[0] == "HMSG" {
+		if len(fields) < 5 {
+			return natsReply{}, fmt.Errorf("nats: malformed %s", fields[0])
+		}
+		headerSize, _ = strconv.Atoi(fields[len(fields)-2])
+	}
+	if len(fields) < 4 {
+		return natsReply{}, fmt.Errorf("nats: malformed %s", fields[0])
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < headerSize {
+		return natsReply{}, fmt.Errorf("nats: malformed %s", fields[0])
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return natsReply{}, err
+	}
+	reply := natsReply{subject: fields[1], data: data[headerSize:size]}
+	if headerSize > 0 {
+		// The first header line is NATS/1.0 followed by an optional status
+		status := strings.Fields(string(bytes.SplitN(data[:headerSize], []byte("\r\n"), 2)[0]))
+		if len(status) > 1 {
+			reply.status = strings.Join(status[1:], " ")
+		}
+	}
+	return reply, nil
+}
+
+// natsError returns the message of an -ERR line
+func natsError(line string) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "-ERR")), "'")
+}
+
+func (c *natsConn) publish(subject, reply string, payload []byte) error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	var b bytes.Buffer
+	if reply != "" {
+		fmt.Fprintf(&b, "PUB %s %s %d\r\n", subject, reply, len(payload))
+	} else {
+		fmt.Fprintf(&b, "PUB %s %d\r\n", subject, len(payload))
+	}
+	b.Write(payload)
+	b.WriteString("\r\n")
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(defaultNATSTimeout))
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+// flush waits for the server to answer a ping
+func (c *natsConn) flush(timeout time.Duration) error {
+	c.writeMu.Lock()
+	_, err := io.WriteString(c.conn, "PING\r\n")
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.pongs:
+		return nil
+	case err := <-c.errs:
+		return err
+	case <-c.done:
+		return c.err
+	case <-timer.C:
+		return fmt.Errorf("nats: no answer to ping within %s", timeout)
+	}
+}
+
+// request publishes a message to JetStream and waits for the stream to
+// acknowledge it
+func (c *natsConn) request(subject string, payload []byte, timeout time.Duration) error {
+	c.nextID++
+	reply := fmt.Sprintf("%s.%d", c.inbox, c.nextID)
+	if err := c.publish(subject, reply, payload); err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-c.replies:
+			if r.subject != reply {
+				// A late reply to an earlier message
+				continue
+			}
+			if strings.HasPrefix(r.status, "503") {
+				return fmt.Errorf("nats: no stream for subject %s", subject)
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(r.data, &ack); err != nil {
+				return fmt.Errorf("nats: invalid acknowledgement: %v", err)
+			}
+			if ack.Error != nil {
+				return fmt.Errorf("nats: %s", ack.Error.Description)
+			}
+			return nil
+		case err := <-c.errs:
+			return err
+		case <-c.done:
+			return c.err
+		case <-timer.C:
+			return fmt.Errorf("nats: no acknowledgement of %s within %s", subject, timeout)
+		}
+	}
+}
+
+// failed tells whether the connection is broken
+func (c *natsConn) failed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *natsConn) close() {
+	c.conn.Close()
+}
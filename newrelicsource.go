@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewRelicConfig configures the newrelic datasource, which runs NRQL queries
+// with the NerdGraph API. The FACET attributes of a query become labels.
+type NewRelicConfig struct {
+	AccountID int `yaml:"account_id"`
+	// APIKey is a user key
+	APIKey string `yaml:"api_key"`
+	// Region is us (default) or eu. The endpoint of the target overrides it.
+	Region string `yaml:"region,omitempty"`
+}
+
+// NewRelicQuery configures a rule of a newrelic target
+type NewRelicQuery struct {
+	// Value is the result column of the value, e.g. average.duration or
+	// percentile.duration.95, needed if there is more than one
+	Value string `yaml:"value,omitempty"`
+}
+
+var newRelicEndpoints = map[string]string{
+	"":   "https://api.newrelic.com/graphql",
+	"us": "https://api.newrelic.com/graphql",
+	"eu": "https://api.eu.newrelic.com/graphql",
+}
+
+const newRelicQuery = `query($accountId: Int!, $nrql: Nrql!) {
+  actor { account(id: $accountId) { nrql(query: $nrql) { results metadata { facets } } } }
+}`
+
+func init() {
+	datasourceTypes["newrelic"] = newNewRelicDatasource
+	defaultEndpoints["newrelic"] = func(group Group) string {
+		if group.NewRelic == nil {
+			return newRelicEndpoints[""]
+		}
+		return newRelicEndpoints[group.NewRelic.Region]
+	}
+}
+
+type newRelicDatasource struct {
+	group  Group
+	config NewRelicConfig
+}
+
+func newNewRelicDatasource(group Group) (Datasource, error) {
+	c := group.NewRelic
+	if c == nil || c.AccountID == 0 || c.APIKey == "" {
+		return nil, fmt.Errorf("newrelic targets need account_id and api_key")
+	}
+	if _, exists := newRelicEndpoints[c.Region]; !exists {
+		return nil, fmt.Errorf("unknown newrelic region %q, expected us or eu", c.Region)
+	}
+	if group.Endpoint != "" {
+		if err := validateEndpoint(group.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range group.Rules {
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return nil, fmt.Errorf("rule %s: newrelic targets only support gauge and counter rules", ruleID(rule))
+		}
+		if rule.Join != nil {
+			return nil, fmt.Errorf("rule %s: newrelic targets don't support join", ruleID(rule))
+		}
+	}
+	return newRelicDatasource{group: group, config: *c}, nil
+}
+
+func (n newRelicDatasource) Query(ctx context.Context, expr string, at time.Time) ([]map[string]interface{}, error) {
+	return n.QueryRule(ctx, Rule{}, expr, at)
+}
+
+func (n newRelicDatasource) QueryRule(ctx context.Context, rule Rule, expr string, at time.Time) ([]map[string]interface{}, error) {
+	endpoint := groupEndpoint(n.group)
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":     newRelicQuery,
+		"variables": map[string]interface{}{"accountId": n.config.AccountID, "nrql": expr},
+	})
+
+	client, err := clientFor(n.group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("API-Key", n.config.APIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp.StatusCode, data)
+	}
+
+	var response struct {
+		Data struct {
+			Actor struct {
+				Account struct {
+					NRQL *struct {
+						Results  []map[string]interface{} `json:"results"`
+						Metadata struct {
+							Facets []string `json:"facets"`
+						} `json:"metadata"`
+					} `json:"nrql"`
+				} `json:"account"`
+			} `json:"actor"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, &parseError{err}
+	}
+	if len(response.Errors) > 0 {
+		var messages []string
+		for _, e := range response.Errors {
+			messages = append(messages, e.Message)
+		}
+		return nil, fmt.Errorf("nrql: %s", strings.Join(messages, "; "))
+	}
+	nrql := response.Data.Actor.Account.NRQL
+	if nrql == nil {
+		return nil, &parseError{fmt.Errorf("no nrql results in response")}
+	}
+	valueColumn := ""
+	if rule.NewRelic != nil {
+		valueColumn = rule.NewRelic.Value
+	}
+	return nrqlResults(nrql.Results, nrql.Metadata.Facets, valueColumn)
+}
+
+// nrqlResults turns the result rows into results. Nested values like those
+// of percentile are flattened to percentile.duration.95. Rows of TIMESERIES
+// queries are oldest first, so the last row of every facet wins.
+func nrqlResults(rows []map[string]interface{}, facets []string, valueColumn string) ([]map[string]interface{}, error) {
+	skip := map[string]bool{"facet": true, "beginTimeSeconds": true, "endTimeSeconds": true, "timestamp": true}
+	for _, facet := range facets {
+		skip[facet] = true
+	}
+
+	byLabels := map[string]map[string]interface{}{}
+	var order []string
+	for _, row := range rows {
+		result := map[string]interface{}{}
+		var facetValues []interface{}
+		switch facet := row["facet"].(type) {
+		case []interface{}:
+			facetValues = facet
+		case nil:
+		default:
+			facetValues = []interface{}{facet}
+		}
+		for i, name := range facets {
+			v, exists := row[name]
+			if !exists && i < len(facetValues) {
+				v = facetValues[i]
+			}
+			if label := jsonLabel(v); label != "" {
+				result[sanitizeLabelName(name)] = label
+			}
+		}
+
+		columns := map[string]float64{}
+		flattenNRQL("", row, skip, columns)
+		column := valueColumn
+		if column == "" {
+			if len(columns) != 1 {
+				var names []string
+				for name := range columns {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return nil, fmt.Errorf("nrql: choose the value with newrelic.value, one of %s", strings.Join(names, ", "))
+			}
+			for name := range columns {
+				column = name
+			}
+		}
+		value, exists := columns[column]
+		if !exists {
+			continue
+		}
+		result["value"] = strconv.FormatFloat(value, 'g', -1, 64)
+
+		key := resultKey(result)
+		if _, seen := byLabels[key]; !seen {
+			order = append(order, key)
+		}
+		byLabels[key] = result
+	}
+
+	results := make([]map[string]interface{}, 0, len(order))
+	for _, key := range order {
+		results = append(results, byLabels[key])
+	}
+	return results, nil
+}
+
+// flattenNRQL collects the numeric columns of a row
+func flattenNRQL(prefix string, v map[string]interface{}, skip map[string]bool, columns map[string]float64) {
+	for name, value := range v {
+		if prefix == "" && skip[name] {
+			continue
+		}
+		switch value := value.(type) {
+		case float64:
+			columns[prefix+name] = value
+		case map[string]interface{}:
+			flattenNRQL(prefix+name+".", value, skip, columns)
+		}
+	}
+}
+
+// resultKey identifies a result by its labels
+func resultKey(result map[string]interface{}) string {
+	var names []string
+	for name := range result {
+		if name != "value" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, result[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthToken is an access token and the time it expires
+type oauthToken struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	oauthTokensMu sync.Mutex
+	oauthTokens   = map[string]oauthToken{}
+)
+
+// cachedToken returns the cached token for key, or fetches a new one if it
+// expires within a minute
+func cachedToken(key string, fetch func() (oauthToken, error)) (string, error) {
+	oauthTokensMu.Lock()
+	token, exists := oauthTokens[key]
+	oauthTokensMu.Unlock()
+	if exists && time.Until(token.expires) > time.Minute {
+		return token.value, nil
+	}
+	token, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	oauthTokensMu.Lock()
+	oauthTokens[key] = token
+	oauthTokensMu.Unlock()
+	return token.value, nil
+}
+
+// clientCredentialsToken returns an access token of the OAuth 2.0 client
+// credentials grant
+func clientCredentialsToken(ctx context.Context, client *http.Client, tokenURL, clientID, clientSecret, scope string) (string, error) {
+	secret := sha256.Sum256([]byte(clientSecret))
+	key := strings.Join([]string{tokenURL, clientID, hex.EncodeToString(secret[:]), scope}, " ")
+	return cachedToken(key, func() (oauthToken, error) {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		return postTokenRequest(ctx, client, tokenURL, form)
+	})
+}
+
+// postTokenRequest posts a form to a token endpoint
+func postTokenRequest(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (oauthToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(client, req)
+}
+
+// requestToken sends a request for an access token and parses the response
+func requestToken(client *http.Client, req *http.Request) (oauthToken, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	if resp.StatusCode >= 400 {
+		return oauthToken{}, fmt.Errorf("token request: %w", responseError(resp.StatusCode, body))
+	}
+
+	var response struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.AccessToken == "" {
+		return oauthToken{}, fmt.Errorf("token request: %w", &parseError{fmt.Errorf("no access token in response")})
+	}
+	expiresIn, _ := response.ExpiresIn.Int64()
+	return oauthToken{value: response.AccessToken, expires: time.Now().Add(time.Duration(expiresIn) * time.Second)}, nil
+}
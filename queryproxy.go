@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queryProxyHandler answers instant queries of the Prometheus API naming the
+// record of a configured rule, like job:up:sum{job="api"}, by running the
+// expression of the rule against its endpoint. Grafana can then query the
+// rules as if they were recording rules of a Prometheus. The results get the
+// record as name, the conversions of the rule and a target label, a target
+// label returned by the query is kept as exported_target. Histogram,
+// summary and compute rules and rules without record can't be queried.
+// Targets of tenants and with a probe_token are only queried with their
+// token, and the query counts against the limits of their tenants.
+func queryProxyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		sel, err := parseSelector(r.Form.Get("query"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		record := ""
+		for _, m := range sel {
+			if m.name == "__name__" && m.op == "=" {
+				record = m.value
+			}
+		}
+		if record == "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", "the query must select the record of a rule by name")
+			return
+		}
+		var at time.Time
+		if s := r.Form.Get("time"); s != "" {
+			if at, err = parseAPITime(s); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+				return
+			}
+		}
+
+		var targets []string
+		for target, group := range config.Targets {
+			if tenantVisible(r, config, group) && probeAllowed(r, group) {
+				targets = append(targets, target)
+			}
+		}
+		sort.Strings(targets)
+
+		type match struct {
+			target string
+			rule   Rule
+		}
+		var matches []match
+		tenants := map[string]bool{}
+		for _, target := range targets {
+			group := config.Targets[target]
+			for _, rule := range group.Rules {
+				if rule.Record == "" || ruleMetricName(rule) != record {
+					continue
+				}
+				switch {
+				case rule.Type == "histogram" || rule.Type == "summary":
+					writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("%s rules can't be queried", rule.Type))
+					return
+				case rule.Compute != nil:
+					writeAPIError(w, http.StatusBadRequest, "bad_data", "compute rules can't be queried")
+					return
+				}
+				matches = append(matches, match{target: target, rule: rule})
+				tenants[group.Tenant] = true
+			}
+		}
+		if len(matches) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("no rule records %q", record))
+			return
+		}
+
+		// The query counts as a probe against the limits of every tenant
+		// whose targets it runs on
+		for _, target := range targets {
+			group := config.Targets[target]
+			if !tenants[group.Tenant] {
+				continue
+			}
+			delete(tenants, group.Tenant)
+			release, admitted := admitTenant(w, r, config, group)
+			if !admitted {
+				return
+			}
+			defer release()
+		}
+
+		type result struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		}
+		results := []result{}
+		for _, m := range matches {
+			target, rule := m.target, m.rule
+			group := config.Targets[target]
+			ruleAt := at
+			if ruleAt.IsZero() {
+				ruleAt = queryTime(rule)
+			}
+			samples, err := proxyRule(r.Context(), target, group, rule, ruleAt)
+			if err != nil {
+				writeAPIError(w, http.StatusUnprocessableEntity, "execution", fmt.Sprintf("target %s: %v", target, err))
+				return
+			}
+			evaluated := ruleAt
+			if evaluated.IsZero() {
+				evaluated = time.Now()
+			}
+			for _, sample := range samples {
+				labels := make(prometheus.Labels, len(sample.Labels)+2)
+				for k, v := range sample.Labels {
+					labels[k] = v
+				}
+				if v, exists := labels["target"]; exists {
+					labels["exported_target"] = v
+				}
+				labels["target"] = target
+				if !sel.matches(sample.Name, labels) {
+					continue
+				}
+				labels["__name__"] = sample.Name
+				results = append(results, result{
+					Metric: labels,
+					Value:  [2]interface{}{float64(evaluated.UnixMilli()) / 1000, formatAPIFloat(sample.Value)},
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": results},
+		})
+	}
+}
+
+// proxyRule runs the expression of a gauge, counter or info rule at the
+// given time and converts the results like evaluateRule, without the state
+// kept for counters across evaluations
+func proxyRule(ctx context.Context, target string, group Group, rule Rule, at time.Time) ([]Sample, error) {
+	results, err := runQuery(ctx, target, group, rule, rule.Expr, at)
+	if err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, result := range results {
+		labels, value := resultToSample(result)
+		if source, _ := result["__name__"].(string); rule.KeepMetricName && source != "" {
+			labels["source_metric"] = source
+		}
+		value = transformValue(rule, value)
+		if rule.Type == "info" {
+			value = 1
+		}
+		samples = append(samples, Sample{Name: ruleMetricName(rule), Labels: labels, Value: value})
+	}
+	if rule.Join != nil && len(samples) > 0 {
+		if err := applyJoin(ctx, target, group, rule, at, samples); err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// parseAPITime parses a time parameter of the Prometheus API, a Unix
+// timestamp or RFC 3339
+func parseAPITime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// formatAPIFloat formats a sample value like the Prometheus API
+func formatAPIFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
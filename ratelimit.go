@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var probesRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rules_exporter_probes_rate_limited_total",
+	Help: "Number of probes rejected by the client or target rate limit.",
+}, []string{"limit"})
+
+func init() {
+	prometheus.MustRegister(probesRateLimited)
+}
+
+// rateLimiter is a set of token buckets, one per key
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64
+	mu    sync.Mutex
+	keys  map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: math.Max(1, float64(burst)), keys: map[string]*tokenBucket{}}
+}
+
+// allow takes a token for key. If none is left it returns false and the time
+// until the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.keys) > 10000 {
+		l.forgetIdle(now)
+	}
+
+	b, exists := l.keys[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.keys[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// forgetIdle drops buckets that have refilled completely, as a new bucket
+// for their key would be identical
+func (l *rateLimiter) forgetIdle(now time.Time) {
+	for key, b := range l.keys {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// probeLimits rejects probes exceeding the per-client or per-target rate
+type probeLimits struct {
+	client *rateLimiter
+	target *rateLimiter
+}
+
+func (p probeLimits) wrap(h http.Handler) http.Handler {
+	if p.client == nil && p.target == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.client != nil {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if ok, wait := p.client.allow(host); !ok {
+				tooManyRequests(w, "client", wait)
+				return
+			}
+		}
+		if p.target != nil {
+			// A probe of several targets counts for each of them
+			for _, target := range splitList(strings.Join(r.URL.Query()["target"], ",")) {
+				if ok, wait := p.target.allow(target); !ok {
+					tooManyRequests(w, "target", wait)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, limit string, wait time.Duration) {
+	probesRateLimited.WithLabelValues(limit).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many probes for this "+limit, http.StatusTooManyRequests)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RelabelConfig rewrites the labels of samples like the relabel_configs of
+// Prometheus. The metric name is the __name__ label, meta labels starting
+// with __, like __target__ and __rule__, are removed afterwards.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,omitempty"`
+	// Separator joins the values of the source labels, ; by default
+	Separator *string `yaml:"separator,omitempty"`
+	// Regex is anchored at both ends, (.*) by default
+	Regex   string `yaml:"regex,omitempty"`
+	Modulus uint64 `yaml:"modulus,omitempty"`
+	// TargetLabel and Replacement may refer to the groups of the regex,
+	// Replacement is $1 by default
+	TargetLabel string  `yaml:"target_label,omitempty"`
+	Replacement *string `yaml:"replacement,omitempty"`
+	// Action is replace (default), keep, drop, keepequal, dropequal,
+	// hashmod, labelmap, labeldrop, labelkeep, lowercase or uppercase
+	Action string `yaml:"action,omitempty"`
+}
+
+// relabeler is a compiled RelabelConfig
+type relabeler struct {
+	RelabelConfig
+	regex       *regexp.Regexp
+	separator   string
+	replacement string
+}
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func compileRelabelConfigs(configs []RelabelConfig) ([]relabeler, error) {
+	var relabelers []relabeler
+	for i, c := range configs {
+		r := relabeler{RelabelConfig: c, separator: ";", replacement: "$1"}
+		if c.Separator != nil {
+			r.separator = *c.Separator
+		}
+		if c.Replacement != nil {
+			r.replacement = *c.Replacement
+		}
+		if r.Action == "" {
+			r.Action = "replace"
+		}
+		pattern := c.Regex
+		if pattern == "" {
+			pattern = "(.*)"
+		}
+		var err error
+		if r.regex, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex: %v", i+1, err)
+		}
+		switch r.Action {
+		case "replace", "hashmod", "lowercase", "uppercase", "keepequal", "dropequal":
+			if r.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: %s needs target_label", i+1, r.Action)
+			}
+		case "keep", "drop", "labelmap", "labeldrop", "labelkeep":
+		default:
+			return nil, fmt.Errorf("relabel config %d: unknown action %q", i+1, r.Action)
+		}
+		if r.Action == "hashmod" && r.Modulus == 0 {
+			return nil, fmt.Errorf("relabel config %d: hashmod needs a modulus", i+1)
+		}
+		if r.Action != "replace" && r.Action != "labelmap" && r.TargetLabel != "" && !labelNamePattern.MatchString(r.TargetLabel) {
+			return nil, fmt.Errorf("relabel config %d: invalid target_label %q", i+1, r.TargetLabel)
+		}
+		relabelers = append(relabelers, r)
+	}
+	return relabelers, nil
+}
+
+// relabel applies the relabelers to labels in place and tells whether the
+// labels are kept
+func relabel(relabelers []relabeler, labels map[string]string) bool {
+	for _, r := range relabelers {
+		values := make([]string, len(r.SourceLabels))
+		for i, name := range r.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, r.separator)
+
+		switch r.Action {
+		case "keep":
+			if !r.regex.MatchString(value) {
+				return false
+			}
+		case "drop":
+			if r.regex.MatchString(value) {
+				return false
+			}
+		case "keepequal":
+			if value != labels[r.TargetLabel] {
+				return false
+			}
+		case "dropequal":
+			if value == labels[r.TargetLabel] {
+				return false
+			}
+		case "replace":
+			match := r.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.TargetLabel, value, match))
+			if !labelNamePattern.MatchString(target) {
+				continue
+			}
+			if replaced := string(r.regex.ExpandString(nil, r.replacement, value, match)); replaced != "" {
+				labels[target] = replaced
+			} else {
+				delete(labels, target)
+			}
+		case "lowercase":
+			labels[r.TargetLabel] = strings.ToLower(value)
+		case "uppercase":
+			labels[r.TargetLabel] = strings.ToUpper(value)
+		case "hashmod":
+			labels[r.TargetLabel] = fmt.Sprint(hashmod(value, r.Modulus))
+		case "labelmap":
+			mapped := map[string]string{}
+			for name, v := range labels {
+				if match := r.regex.FindStringSubmatchIndex(name); match != nil {
+					mapped[string(r.regex.ExpandString(nil, r.replacement, name, match))] = v
+				}
+			}
+			for name, v := range mapped {
+				labels[name] = v
+			}
+		case "labeldrop", "labelkeep":
+			for name := range labels {
+				if r.regex.MatchString(name) == (r.Action == "labeldrop") {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// hashmod is the hash of the hashmod relabel action of Prometheus
+func hashmod(value string, modulus uint64) uint64 {
+	sum := md5.Sum([]byte(value))
+	return binary.BigEndian.Uint64(sum[8:]) % modulus
+}
+
+// relabelEvaluation returns the evaluation with the relabelers applied to
+// the samples, leaving the samples of eval untouched. The meta labels
+// __target__ and __rule__ hold the target and the rule of the sample.
+func relabelEvaluation(relabelers []relabeler, target string, eval evaluation) evaluation {
+	if len(relabelers) == 0 {
+		return eval
+	}
+	samples := make([]Sample, 0, len(eval.Samples))
+	for _, sample := range eval.Samples {
+		labels := make(map[string]string, len(sample.Labels)+3)
+		for name, value := range sample.Labels {
+			labels[name] = value
+		}
+		labels["__name__"] = sample.Name
+		labels["__target__"] = target
+		labels["__rule__"] = sample.Rule
+		if !relabel(relabelers, labels) || labels["__name__"] == "" {
+			continue
+		}
+		sample.Name = labels["__name__"]
+		sample.Labels = prometheus.Labels{}
+		for name, value := range labels {
+			if !strings.HasPrefix(name, "__") && value != "" {
+				sample.Labels[name] = value
+			}
+		}
+		samples = append(samples, sample)
+	}
+	eval.Samples = samples
+	return eval
+}
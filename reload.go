@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rules_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rules_exporter_config_last_reload_time_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_config_info",
+		Help: "Hash of the current configuration, identical on replicas running the same configuration.",
+	}, []string{"hash"})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccessful, configReloadTime, configInfo)
+}
+
+// configState is a loaded configuration. Requests use the state that was
+// current when they started, so a reload never changes the configuration
+// under a running probe.
+type configState struct {
+	config  Config
+	version int
+	hash    string
+}
+
+var currentConfig atomic.Pointer[configState]
+
+// getConfig returns the current configuration
+func getConfig() Config {
+	return currentConfig.Load().config
+}
+
+// setConfig makes config the current configuration
+func setConfig(config Config) {
+	version := 1
+	if previous := currentConfig.Load(); previous != nil {
+		version = previous.version + 1
+	}
+	hash := configHash(config)
+	currentConfig.Store(&configState{config: config, version: version, hash: hash})
+
+	configReloadSuccessful.Set(1)
+	configReloadTime.Set(float64(time.Now().Unix()))
+	configInfo.Reset()
+	configInfo.WithLabelValues(hash).Set(1)
+}
+
+// configHash identifies a configuration by its content, independent of
+// comments and formatting of the file
+func configHash(config Config) string {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// reloadConfig loads the configuration file and makes it current if it is
+// valid
+func reloadConfig(file string) error {
+	config, err := loadConfig(file)
+	if err == nil {
+		err = applyConfig(config)
+	}
+	if err != nil {
+		configReloadSuccessful.Set(0)
+		return err
+	}
+	state := currentConfig.Load()
+	log.Printf("Reloaded configuration version %d (%s) with %d targets", state.version, state.hash, len(state.config.Targets))
+	return nil
+}
+
+// replaceConfig sets up the clients and sinks of config and makes it current.
+// Cached results of targets that changed or were removed are dropped, as is
+// everything kept about removed targets.
+func replaceConfig(config Config) error {
+	if err := setupClients(config); err != nil {
+		return err
+	}
+	if err := startSinks(config); err != nil {
+		return err
+	}
+	previous := currentConfig.Load()
+	setConfig(config)
+	if previous == nil {
+		return nil
+	}
+	for name, group := range previous.config.Targets {
+		if updated, exists := config.Targets[name]; !exists || !reflect.DeepEqual(group, updated) {
+			queryCache.Namespace(name).Flush()
+			responseCache.Namespace(name).Flush()
+		}
+		if _, exists := config.Targets[name]; !exists {
+			forgetTarget(name)
+		}
+	}
+	return nil
+}
+
+// forgetTarget drops the counter totals, stale samples and rule metrics of a
+// removed target, so discovery churn doesn't grow them without bound and
+// alerts on its failed assertions resolve
+func forgetTarget(name string) {
+	prefix := name + "/"
+	countersMu.Lock()
+	for key := range counters {
+		if strings.HasPrefix(key, prefix) {
+			delete(counters, key)
+		}
+	}
+	countersMu.Unlock()
+	lastSamplesMu.Lock()
+	for key := range lastSamples {
+		if strings.HasPrefix(key, prefix) {
+			delete(lastSamples, key)
+		}
+	}
+	lastSamplesMu.Unlock()
+
+	labels := prometheus.Labels{"target": name}
+	ruleAssertionFailed.DeletePartialMatch(labels)
+	ruleErrors.DeletePartialMatch(labels)
+	ruleQueryDuration.DeletePartialMatch(labels)
+	slowQueries.DeletePartialMatch(labels)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteSink sends samples with the Prometheus remote write protocol
+// 1.0. Every sample gets a target label with the name of its target, a
+// target label of its own is kept as exported_target.
+type RemoteWriteSink struct {
+	URL       string            `yaml:"url"`
+	Headers   map[string]string `yaml:"headers,omitempty"`
+	TLSConfig *TLSConfig        `yaml:"tls_config,omitempty"`
+	// Retries of failed requests, 3 by default, waiting RetryBackoff (1s by
+	// default) doubled after every attempt. Responses with status 4xx apart
+	// from 429 are not retried.
+	Retries      *int          `yaml:"retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// Timeout of every request, 30s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// WALDir keeps the requests that failed in <wal_dir>/<sink name> and
+	// sends them before any new one once the endpoint is back
+	WALDir string `yaml:"wal_dir,omitempty"`
+	// WALMaxSize is the size in bytes the WAL may grow to before the oldest
+	// requests are dropped, 64MiB by default
+	WALMaxSize int64 `yaml:"wal_max_size,omitempty"`
+	// SendExemplars adds the exemplars of rules with exemplar_window to
+	// their series
+	SendExemplars bool `yaml:"send_exemplars,omitempty"`
+	// SendMetadata adds the type and help of every metric, true by default
+	SendMetadata *bool `yaml:"send_metadata,omitempty"`
+}
+
+const (
+	defaultRemoteWriteTimeout = 30 * time.Second
+	defaultWALMaxSize         = 64 << 20
+)
+
+func init() {
+	sinkTypes["remote_write"] = newRemoteWriter
+}
+
+type remoteWriter struct {
+	config RemoteWriteSink
+	client *http.Client
+	wal    *writeAheadLog
+}
+
+func newRemoteWriter(s Sink) (sinkWriter, error) {
+	c := s.RemoteWrite
+	if c == nil {
+		return nil, fmt.Errorf("remote_write sinks need remote_write settings")
+	}
+	config := *c
+	if err := validateEndpoint(config.URL); err != nil {
+		return nil, fmt.Errorf("remote_write url: %v", err)
+	}
+	if config.Retries != nil && *config.Retries < 0 || config.RetryBackoff < 0 || config.Timeout < 0 || config.WALMaxSize < 0 {
+		return nil, fmt.Errorf("remote_write retries, retry_backoff, timeout and wal_max_size must not be negative")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultRemoteWriteTimeout
+	}
+	if config.WALMaxSize == 0 {
+		config.WALMaxSize = defaultWALMaxSize
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TLSConfig != nil {
+		tlsConfig, err := config.TLSConfig.tlsClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	w := &remoteWriter{config: config, client: &http.Client{Transport: transport, Timeout: config.Timeout}}
+	if config.WALDir != "" {
+		w.wal = &writeAheadLog{sink: s.Name, dir: filepath.Join(config.WALDir, s.Name), maxSize: config.WALMaxSize}
+	}
+	return w, nil
+}
+
+func (w *remoteWriter) write(target string, eval evaluation) error {
+	return w.send(snappyEncode(w.encode(target, eval)))
+}
+
+// writeBatch sends several evaluations in one request. Encoded write
+// requests concatenate into one with the series of all of them.
+func (w *remoteWriter) writeBatch(items []sinkItem) error {
+	var request []byte
+	for _, item := range items {
+		request = append(request, w.encode(item.target, item.eval)...)
+	}
+	return w.send(snappyEncode(request))
+}
+
+func (w *remoteWriter) encode(target string, eval evaluation) []byte {
+	metadata := w.config.SendMetadata == nil || *w.config.SendMetadata
+	return encodeWriteRequest(target, eval, w.config.SendExemplars, metadata)
+}
+
+// send sends a request after those waiting in the WAL, buffering it in the
+// WAL if that fails
+func (w *remoteWriter) send(body []byte) error {
+	if w.wal != nil {
+		// Requests waiting in the WAL are sent first, remote write needs the
+		// samples of a series in order
+		if err := w.wal.replay(w.post); err != nil {
+			return w.buffer(body, err)
+		}
+	}
+
+	retries := defaultWebhookRetries
+	if w.config.Retries != nil {
+		retries = *w.config.Retries
+	}
+	backoff := w.config.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultWebhookBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return noRetryError{err}
+		}
+		if attempt >= retries {
+			if w.wal != nil {
+				return w.buffer(body, err)
+			}
+			return err
+		}
+		time.Sleep(backoff << attempt)
+	}
+}
+
+// buffer appends a request that could not be sent to the WAL
+func (w *remoteWriter) buffer(body []byte, err error) error {
+	if walErr := w.wal.append(body); walErr != nil {
+		return fmt.Errorf("%v, and writing the WAL failed: %v", err, walErr)
+	}
+	return noRetryError{fmt.Errorf("%v, %d requests wait in the WAL", err, w.wal.len())}
+}
+
+// post sends a request once and tells whether a failure may be retried
+func (w *remoteWriter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "rules_exporter")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, responseError(resp.StatusCode, data)
+}
+
+func (w *remoteWriter) close() {
+	w.client.CloseIdleConnections()
+}
+
+// encodeWriteRequest encodes the samples of an evaluation as protobuf
+// prometheus.WriteRequest, with the exemplars of the samples and the
+// metadata of their metrics if asked to
+func encodeWriteRequest(target string, eval evaluation, exemplars, metadata bool) []byte {
+	timestamp := eval.Time.UnixMilli()
+	var request []byte
+	families := map[string]bool{}
+	for _, sample := range eval.Samples {
+		flats := flattenSample(sample)
+		exemplarIndex := -1
+		if exemplars && sample.Exemplar != nil {
+			exemplarIndex = exemplarSeriesIndex(sample, flats)
+		}
+		for i, flat := range flats {
+			labels := make(map[string]string, len(flat.Labels)+2)
+			for name, value := range flat.Labels {
+				if value != "" {
+					labels[name] = value
+				}
+			}
+			if value, exists := labels["target"]; exists {
+				// As on /federate
+				labels["exported_target"] = value
+			}
+			labels["__name__"] = flat.Name
+			labels["target"] = target
+
+			series := appendLabels(nil, 1, labels)
+			var point []byte
+			point = protowire.AppendTag(point, 1, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, math.Float64bits(flat.Value))
+			point = protowire.AppendTag(point, 2, protowire.VarintType)
+			point = protowire.AppendVarint(point, uint64(timestamp))
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, point)
+
+			if i == exemplarIndex {
+				e := sample.Exemplar
+				exemplar := appendLabels(nil, 1, e.Labels)
+				exemplar = protowire.AppendTag(exemplar, 2, protowire.Fixed64Type)
+				exemplar = protowire.AppendFixed64(exemplar, math.Float64bits(e.Value))
+				exemplar = protowire.AppendTag(exemplar, 3, protowire.VarintType)
+				exemplar = protowire.AppendVarint(exemplar, uint64(e.Timestamp.UnixMilli()))
+				series = protowire.AppendTag(series, 3, protowire.BytesType)
+				series = protowire.AppendBytes(series, exemplar)
+			}
+
+			request = protowire.AppendTag(request, 1, protowire.BytesType)
+			request = protowire.AppendBytes(request, series)
+		}
+
+		if metadata && !families[sample.Name] {
+			families[sample.Name] = true
+			var m []byte
+			m = protowire.AppendTag(m, 1, protowire.VarintType)
+			m = protowire.AppendVarint(m, remoteWriteMetricType(sample))
+			m = protowire.AppendTag(m, 2, protowire.BytesType)
+			m = protowire.AppendString(m, sample.Name)
+			m = protowire.AppendTag(m, 4, protowire.BytesType)
+			m = protowire.AppendString(m, sample.Help)
+			request = protowire.AppendTag(request, 3, protowire.BytesType)
+			request = protowire.AppendBytes(request, m)
+		}
+	}
+	return request
+}
+
+// appendLabels appends labels in order as repeated prometheus.Label field
+func appendLabels(b []byte, field protowire.Number, labels map[string]string) []byte {
+	for _, name := range sortedLabelNames(labels) {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, label)
+	}
+	return b
+}
+
+// exemplarSeriesIndex returns which of the flat samples of a sample gets
+// its exemplar: the first bucket the exemplar falls into for histograms,
+// the sample itself otherwise
+func exemplarSeriesIndex(sample Sample, flats []flatSample) int {
+	if sample.Histogram == nil {
+		return 0
+	}
+	for i, flat := range flats {
+		if flat.Name != sample.Name+"_bucket" {
+			continue
+		}
+		if le, err := strconv.ParseFloat(flat.Labels["le"], 64); err == nil && sample.Exemplar.Value <= le {
+			return i
+		}
+	}
+	return -1
+}
+
+// remoteWriteMetricType returns the prometheus.MetricMetadata.MetricType of
+// the metric of a sample
+func remoteWriteMetricType(sample Sample) uint64 {
+	switch {
+	case sample.Histogram != nil, sample.NativeHistogram != nil:
+		return 3
+	case sample.Summary != nil:
+		return 5
+	case sample.Type == prometheus.CounterValue:
+		return 1
+	case sample.Type == prometheus.GaugeValue:
+		return 2
+	}
+	return 0
+}
+
+// snappyEncode encodes data in the snappy block format. It only uses
+// literals, which every snappy decoder accepts, as there is no snappy
+// library in the dependencies.
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 1<<16)
+		if n <= 60 {
+			out = append(out, byte(n-1)<<2)
+		} else if n <= 1<<8 {
+			out = append(out, 60<<2, byte(n-1))
+		} else {
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// replicaPath serves the evaluations of a replica to its peers
+const replicaPath = "/api/v1/replica/evaluations"
+
+// peerState holds the evaluations last fetched from a peer
+type peerState struct {
+	fetched     time.Time
+	evaluations map[string]evaluation
+}
+
+var (
+	peersMu sync.RWMutex
+	peers   = map[string]peerState{}
+	// peerMaxAge is how long the evaluations of a peer are used after the
+	// last successful fetch
+	peerMaxAge time.Duration
+
+	replicaSyncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_replica_sync_errors_total",
+		Help: "Number of failed fetches of the evaluations of a peer.",
+	}, []string{"peer"})
+	replicaSyncTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_replica_sync_targets",
+		Help: "Number of targets evaluated by a peer in its last fetched evaluations.",
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(replicaSyncErrors, replicaSyncTargets)
+}
+
+// loadReplicaToken reads the token shared by the replicas
+func loadReplicaToken(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s: empty token", file)
+	}
+	return token, nil
+}
+
+// replicaHandler serves the evaluations of this replica, leaving out those
+// fetched from peers, gob encoded. Requests need the token as bearer token.
+func replicaHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		evaluationsMu.RLock()
+		local := make(map[string]evaluation, len(evaluations))
+		for target, eval := range evaluations {
+			local[target] = eval
+		}
+		evaluationsMu.RUnlock()
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(local); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-gob")
+		w.Write(buf.Bytes())
+	}
+}
+
+// startReplicaSync fetches the evaluations of the peers every interval, so
+// probes of targets evaluated by another replica, like the leader or the
+// owner of a shard, are answered with its results
+func startReplicaSync(urls []string, interval time.Duration, token string) {
+	peerMaxAge = 3 * interval
+	client := &http.Client{Timeout: interval}
+	for _, url := range urls {
+		url := strings.TrimSuffix(url, "/")
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				if err := fetchPeer(client, url, token); err != nil {
+					log.Printf("Error fetching evaluations of peer %s: %v", url, err)
+					replicaSyncErrors.WithLabelValues(url).Inc()
+				}
+				<-ticker.C
+			}
+		}()
+	}
+	log.Printf("Sharing evaluations with %d peers every %s", len(urls), interval)
+}
+
+func fetchPeer(client *http.Client, url, token string) error {
+	req, err := http.NewRequest(http.MethodGet, url+replicaPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return responseError(resp.StatusCode, data)
+	}
+	var fetched map[string]evaluation
+	if err := gob.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		return &parseError{err}
+	}
+	peersMu.Lock()
+	peers[url] = peerState{fetched: time.Now(), evaluations: fetched}
+	peersMu.Unlock()
+	replicaSyncTargets.WithLabelValues(url).Set(float64(len(fetched)))
+	return nil
+}
+
+// peerEvaluation returns the newest evaluation of a target by a peer that
+// answered recently
+func peerEvaluation(target string) (evaluation, bool) {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	var newest evaluation
+	found := false
+	for _, peer := range peers {
+		if time.Since(peer.fetched) > peerMaxAge {
+			continue
+		}
+		if eval, exists := peer.evaluations[target]; exists && eval.Time.After(newest.Time) {
+			newest, found = eval, true
+		}
+	}
+	return newest, found
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ruleTagFilter selects the rules of targets without tag_filter, set by
+// --rules.tag-filter
+var ruleTagFilter []string
+
+// splitList splits a comma separated list, leaving out empty elements
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func validateTagFilter(filter []string) error {
+	for _, tag := range filter {
+		if strings.TrimPrefix(tag, "!") == "" {
+			return fmt.Errorf("empty tag in tag_filter")
+		}
+	}
+	return nil
+}
+
+// matchTags reports whether a rule with the given tags passes the filter. A
+// rule passes if it has one of the tags of the filter, or the filter only
+// has excluded tags, and it has none of the tags prefixed with !.
+func matchTags(tags, filter []string) bool {
+	included, hasIncluded := false, false
+	for _, f := range filter {
+		tag, excluded := strings.CutPrefix(f, "!")
+		has := false
+		for _, t := range tags {
+			has = has || t == tag
+		}
+		if excluded {
+			if has {
+				return false
+			}
+			continue
+		}
+		hasIncluded = true
+		included = included || has
+	}
+	return included || !hasIncluded
+}
+
+// activeRules removes the rules that are disabled or don't pass the tag
+// filter of their target, or ruleTagFilter if it has none
+func activeRules(config Config) Config {
+	targets := make(map[string]Group, len(config.Targets))
+	for name, group := range config.Targets {
+		targets[name] = activeGroupRules(group)
+	}
+	config.Targets = targets
+	return config
+}
+
+// activeGroupRules is activeRules for a single group
+func activeGroupRules(group Group) Group {
+	filter := group.TagFilter
+	if filter == nil {
+		filter = ruleTagFilter
+	}
+	var rules []Rule
+	for _, rule := range group.Rules {
+		if (rule.Enabled == nil || *rule.Enabled) && matchTags(rule.Tags, filter) {
+			rules = append(rules, rule)
+		}
+	}
+	group.Rules = rules
+	return group
+}
+
+// selectRules returns the rules of the group with the given ruleIDs, in the
+// order of the group
+func selectRules(group Group, ids []string) ([]Rule, error) {
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var rules []Rule
+	for _, rule := range group.Rules {
+		if wanted[ruleID(rule)] {
+			rules = append(rules, rule)
+			delete(wanted, ruleID(rule))
+		}
+	}
+	for _, id := range ids {
+		if wanted[id] {
+			return nil, fmt.Errorf("unknown rule %q", id)
+		}
+	}
+	return rules, nil
+}
+
+// withDependencies returns the rules of group needed to evaluate the
+// selected ones, which are among them, with the rules compute rules depend
+// on, transitively, in the order of group
+func withDependencies(group, selected []Rule) []Rule {
+	byRecord := map[string][]Rule{}
+	for _, rule := range group {
+		if rule.Record != "" {
+			byRecord[rule.Record] = append(byRecord[rule.Record], rule)
+		}
+	}
+	needed := map[string]bool{}
+	var add func(rule Rule)
+	add = func(rule Rule) {
+		if needed[ruleID(rule)] {
+			return
+		}
+		needed[ruleID(rule)] = true
+		for _, dependency := range rule.dependencies() {
+			for _, rule := range byRecord[dependency] {
+				add(rule)
+			}
+		}
+	}
+	for _, rule := range selected {
+		add(rule)
+	}
+
+	var rules []Rule
+	for _, rule := range group {
+		if needed[ruleID(rule)] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// filterEvaluation keeps the samples and errors of the given rules
+func filterEvaluation(eval evaluation, rules []Rule) evaluation {
+	keep := map[string]bool{}
+	for _, rule := range rules {
+		keep[ruleID(rule)] = true
+	}
+	filtered := evaluation{Time: eval.Time}
+	for _, sample := range eval.Samples {
+		if keep[sample.Rule] {
+			filtered.Samples = append(filtered.Samples, sample)
+		}
+	}
+	for _, ruleErr := range eval.Errors {
+		if keep[ruleErr.Rule] {
+			filtered.Errors = append(filtered.Errors, ruleErr)
+		}
+	}
+	return filtered
+}
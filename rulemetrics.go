@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ruleQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rules_exporter_rule_query_duration_seconds",
+		Help:    "Duration of the queries of a rule sent to the endpoint, including parsing the response.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target", "rule"})
+	ruleAssertionFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_rule_assertion_failed",
+		Help: "Whether the last successful evaluation of the rule returned fewer than expect_min_series or more than expect_max_series series.",
+	}, []string{"target", "rule"})
+)
+
+func init() {
+	prometheus.MustRegister(ruleQueryDuration, ruleAssertionFailed)
+}
+
+// checkSeriesCount updates the assertion metric of a rule with series
+// count expectations
+func checkSeriesCount(target string, rule Rule, series int) {
+	if rule.ExpectMinSeries == 0 && rule.ExpectMaxSeries == 0 {
+		return
+	}
+	value := 0.0
+	switch {
+	case series < rule.ExpectMinSeries:
+		log.Printf("Rule %s of target %s returned %d series, expected at least %d", ruleID(rule), target, series, rule.ExpectMinSeries)
+		value = 1
+	case rule.ExpectMaxSeries > 0 && series > rule.ExpectMaxSeries:
+		log.Printf("Rule %s of target %s returned %d series, expected at most %d", ruleID(rule), target, series, rule.ExpectMaxSeries)
+		value = 1
+	}
+	ruleAssertionFailed.WithLabelValues(target, ruleID(rule)).Set(value)
+}
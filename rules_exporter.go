@@ -1,47 +1,187 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/riclib/rules_exporter/cache"
 	"gopkg.in/yaml.v2"
 )
 
 // Define the structure to match the YAML file
 type Rule struct {
-	Record string        `yaml:"record"`
-	Expr   string        `yaml:"expr"`
-	Cache  time.Duration `yaml:"cache"`
+	Record string `yaml:"record"`
+	Expr   string `yaml:"expr"`
+	// CacheTTL reuses query results for this long, overriding the cache_ttl
+	// of the target, 0 queries on every probe. Cache is the former name of
+	// the setting.
+	CacheTTL *time.Duration `yaml:"cache_ttl,omitempty"`
+	Cache    time.Duration  `yaml:"cache,omitempty"`
+	// Type is gauge (default), counter, histogram, summary or info
+	Type string `yaml:"type,omitempty"`
+	// CounterReset selects how counter resets are handled, see updateCounters
+	CounterReset string `yaml:"counter_reset,omitempty"`
+	// SumExpr and CountExpr provide the _sum and _count of histogram and
+	// summary rules
+	SumExpr   string `yaml:"sum_expr,omitempty"`
+	CountExpr string `yaml:"count_expr,omitempty"`
+	// Bool maps the value of gauge and counter rules to 0 or 1
+	Bool *BoolMapping `yaml:"bool,omitempty"`
+	// Unit converts the value of gauge and counter rules, see unitConversions
+	Unit string `yaml:"unit,omitempty"`
+	// Precision rounds the value of gauge and counter rules
+	Precision *Precision `yaml:"precision,omitempty"`
+	// Align truncates the evaluation time to a multiple of this duration
+	Align time.Duration `yaml:"align,omitempty"`
+	// Priority evaluates rules with a higher priority first, 0 by default.
+	// They share the probe deadline among themselves, rules with a lower
+	// priority get the time left.
+	Priority int `yaml:"priority,omitempty"`
+	// BudgetWeight is the share of the remaining probe deadline the rule may
+	// take, relative to the rules evaluated after it, 1 by default
+	BudgetWeight float64 `yaml:"budget_weight,omitempty"`
+	// Interval evaluates the rule this often in scheduled mode instead of
+	// every --scheduler.interval, reusing its last results in between
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// FailOnError fails the probe with status 500 if the rule fails,
+	// regardless of the on_error of the target
+	FailOnError bool `yaml:"fail_on_error,omitempty"`
+	// ExpectMinSeries and ExpectMaxSeries set
+	// rules_exporter_rule_assertion_failed if the rule returns fewer or more
+	// series, 0 disables the check
+	ExpectMinSeries int `yaml:"expect_min_series,omitempty"`
+	ExpectMaxSeries int `yaml:"expect_max_series,omitempty"`
+	// OnEmpty exports a default value when the query returns no series
+	OnEmpty *OnEmpty `yaml:"on_empty,omitempty"`
+	// Present also exports <name>_present, 1 if the query returned any
+	// series and 0 if it returned none
+	Present bool `yaml:"present,omitempty"`
+	// Join copies labels from the series of another query
+	Join *Join `yaml:"join,omitempty"`
+	// Compute derives the rule from other rules of the target instead of
+	// querying, it has no expr
+	Compute *Compute `yaml:"compute,omitempty"`
+	// ExemplarWindow attaches the latest exemplar of the upstream series of
+	// every sample within this long, which remote_write sinks with
+	// send_exemplars forward. Only Prometheus targets have exemplars.
+	ExemplarWindow time.Duration `yaml:"exemplar_window,omitempty"`
+	// KeepMetricName keeps the upstream metric name of the results in a
+	// source_metric label, or exports them under it if record is omitted
+	KeepMetricName bool `yaml:"keep_metric_name,omitempty"`
+	// Enabled false leaves the rule out, as if it wasn't configured
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Tags are matched by the tag_filter of the target or --rules.tag-filter
+	Tags []string `yaml:"tags,omitempty"`
+	// JSON selects the values of the response for json targets
+	JSON *JSONExtract `yaml:"json,omitempty"`
+	// Azure selects the resource and aggregation for azure_monitor targets
+	Azure *AzureMetric `yaml:"azure,omitempty"`
+	// CloudWatch selects the metric and statistic for cloudwatch targets
+	CloudWatch *CloudWatchMetric `yaml:"cloudwatch,omitempty"`
+	// GCP configures the aggregation and labels for gcp targets
+	GCP *GCPQuery `yaml:"gcp,omitempty"`
+	// Datadog configures the window of the query for datadog targets
+	Datadog *DatadogQuery `yaml:"datadog,omitempty"`
+	// NewRelic selects the value column for newrelic targets
+	NewRelic *NewRelicQuery `yaml:"newrelic,omitempty"`
 }
 
 type Group struct {
-	Target   string `yaml:"target"`
-	Rules    []Rule `yaml:"rules"`
-	Endpoint string `yaml:"endpoint"`
+	// Type selects the datasource of the target, see datasourceTypes
+	Type string `yaml:"type,omitempty"`
+	// Exec configures the exec datasource
+	Exec *ExecConfig `yaml:"exec,omitempty"`
+	// JSON configures the json datasource
+	JSON *JSONConfig `yaml:"json,omitempty"`
+	// AzureMonitor configures the azure_monitor datasource
+	AzureMonitor *AzureMonitorConfig `yaml:"azure_monitor,omitempty"`
+	// CloudWatch configures the region and credentials of the cloudwatch
+	// datasource
+	CloudWatch *AWSAuth `yaml:"cloudwatch,omitempty"`
+	// GCP configures the project and credentials of the gcp datasource
+	GCP *GCPConfig `yaml:"gcp,omitempty"`
+	// Datadog configures the keys and site of the datadog datasource
+	Datadog *DatadogConfig `yaml:"datadog,omitempty"`
+	// NewRelic configures the account and key of the newrelic datasource
+	NewRelic *NewRelicConfig `yaml:"newrelic,omitempty"`
+	// Extends is the name of a target whose settings and rules this target
+	// inherits, see resolveExtends
+	Extends    string           `yaml:"extends,omitempty"`
+	Target     string           `yaml:"target,omitempty"`
+	Rules      []Rule           `yaml:"rules"`
+	Endpoint   string           `yaml:"endpoint"`
+	HTTPClient HTTPClientConfig `yaml:"http_client,omitempty"`
+	// ProbeToken is required on probes of the target if set
+	ProbeToken string `yaml:"probe_token,omitempty"`
+	// Tenant is the name of the tenant owning the target
+	Tenant string `yaml:"tenant,omitempty"`
+	// ResponseCache serves the same rendered probe response for this long
+	ResponseCache time.Duration `yaml:"response_cache,omitempty"`
+	// ErrorCache returns the error of a failed query for this long instead
+	// of sending the query again
+	ErrorCache time.Duration `yaml:"error_cache,omitempty"`
+	// CacheTTL reuses query results of the rules for this long, overriding
+	// --cache.ttl, 0 queries on every probe
+	CacheTTL *time.Duration `yaml:"cache_ttl,omitempty"`
+	// AggregateOf makes this target a combination of other targets, whose
+	// series are merged or, with Aggregate sum or avg, combined
+	AggregateOf []string `yaml:"aggregate_of,omitempty"`
+	Aggregate   string   `yaml:"aggregate,omitempty"`
+	// OnError is partial (default) to leave out failing rules, fail to fail
+	// the probe with status 500, or stale to export the last successful
+	// results of failing rules
+	OnError string `yaml:"on_error,omitempty"`
+	// ReplicaLabels are dropped from the query results, which merges the
+	// series of HA replicas queried directly. ReplicaDedup picks the kept one
+	// of the duplicates: first (default), max or min.
+	ReplicaLabels []string `yaml:"replica_labels,omitempty"`
+	ReplicaDedup  string   `yaml:"replica_dedup,omitempty"`
+	// TagFilter selects the rules by tags, overriding --rules.tag-filter
+	TagFilter []string `yaml:"tag_filter,omitempty"`
+	// Webhooks receive the results of the scheduled evaluations
+	Webhooks []Webhook `yaml:"webhooks,omitempty"`
 }
 
 type Config struct {
-	Targets map[string]Group `yaml:"targets"`
+	Tenants map[string]Tenant `yaml:"tenants,omitempty"`
+	// Macros are PromQL fragments used as $name in expressions, see
+	// expandMacros
+	Macros  map[string]string `yaml:"macros,omitempty"`
+	Targets map[string]Group  `yaml:"targets"`
+	// Discovery generates further targets from query results
+	Discovery []Discovery `yaml:"discovery,omitempty"`
+	// Sinks receive the results of scheduled evaluations
+	Sinks []Sink `yaml:"sinks,omitempty"`
 }
 
 var (
-	ruleMetrics = map[string]*prometheus.GaugeVec{}
-	queryCache  = cache.NewCache()
-	registry    = prometheus.NewRegistry() // Create a new registry for custom metrics
+	queryCache = cache.NewCache()
+
+	// defaultCacheTTL is the query cache TTL of targets without cache_ttl
+	defaultCacheTTL time.Duration
 )
 
 func loadConfig(configFile string) (Config, error) {
-	data, err := ioutil.ReadFile(configFile)
+	data, err := readConfigFile(configFile)
 	if err != nil {
 		return Config{}, err
 	}
@@ -51,53 +191,820 @@ func loadConfig(configFile string) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	if err := resolveExtends(data, &config); err != nil {
+		return Config{}, err
+	}
+	if err := expandMacros(&config); err != nil {
+		return Config{}, err
+	}
 
-	return config, nil
+	if err := validateConfig(config); err != nil {
+		return Config{}, err
+	}
+
+	return activeRules(config), nil
 }
 
-func queryPrometheus(endpoint string, query string, cacheDuration time.Duration) ([]map[string]interface{}, error) {
-	cacheKey := fmt.Sprintf("%s:%s", endpoint, query)
-	if cachedResult, found := queryCache.Get(cacheKey); found {
-		log.Printf("Cache hit for %s", cacheKey)
+// validateConfig checks the settings that can't be enforced by the YAML schema
+func validateConfig(config Config) error {
+	for name, tenant := range config.Tenants {
+		if err := tenant.validate(); err != nil {
+			return fmt.Errorf("tenant %s: %v", name, err)
+		}
+	}
+
+	discoveries := map[string]bool{}
+	for i, d := range config.Discovery {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("discovery %d: %v", i+1, err)
+		}
+		if discoveries[d.Name] {
+			return fmt.Errorf("duplicate discovery %s", d.Name)
+		}
+		discoveries[d.Name] = true
+	}
+
+	sinks := map[string]bool{}
+	for i, s := range config.Sinks {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("sink %d: %v", i+1, err)
+		}
+		if sinks[s.Name] {
+			return fmt.Errorf("duplicate sink %s", s.Name)
+		}
+		sinks[s.Name] = true
+	}
+
+	var names []string
+	for name := range config.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lowercase := map[string]string{}
+	for _, name := range names {
+		group := config.Targets[name]
+		if err := validateTargetName(name); err != nil {
+			return err
+		}
+		if other, exists := lowercase[strings.ToLower(name)]; exists {
+			return fmt.Errorf("targets %s and %s only differ in case", other, name)
+		}
+		lowercase[strings.ToLower(name)] = name
+
+		if len(group.AggregateOf) > 0 {
+			if err := validateAggregate(config, name, group); err != nil {
+				return fmt.Errorf("target %s: %v", name, err)
+			}
+		} else {
+			if _, err := newDatasource(group); err != nil {
+				return fmt.Errorf("target %s: %v", name, err)
+			}
+			if len(group.Rules) == 0 {
+				return fmt.Errorf("target %s: no rules", name)
+			}
+		}
+		switch group.OnError {
+		case "", "partial", "fail", "stale":
+		default:
+			return fmt.Errorf("target %s: unknown on_error %q", name, group.OnError)
+		}
+		if _, exists := config.Tenants[group.Tenant]; group.Tenant != "" && !exists {
+			return fmt.Errorf("target %s: unknown tenant %q", name, group.Tenant)
+		}
+		if err := group.HTTPClient.validate(group.Endpoint); err != nil {
+			return fmt.Errorf("target %s: %v", name, err)
+		}
+		if err := validateTagFilter(group.TagFilter); err != nil {
+			return fmt.Errorf("target %s: %v", name, err)
+		}
+		if err := validateDedup(group); err != nil {
+			return fmt.Errorf("target %s: %v", name, err)
+		}
+		for i, webhook := range group.Webhooks {
+			if _, err := newWebhook(webhook); err != nil {
+				return fmt.Errorf("target %s: webhook %d: %v", name, i+1, err)
+			}
+		}
+		// Active rules of one record would export series with different
+		// help, and share their counter totals and stale samples
+		records := map[string]bool{}
+		for _, rule := range activeGroupRules(group).Rules {
+			if rule.Record != "" && records[rule.Record] {
+				return fmt.Errorf("target %s: several rules record %s", name, rule.Record)
+			}
+			records[rule.Record] = true
+		}
+		for _, rule := range group.Rules {
+			if err := validateRule(rule); err != nil {
+				return fmt.Errorf("target %s, rule %s: %v", name, ruleID(rule), err)
+			}
+			if rule.ExemplarWindow != 0 && group.Type != "" && group.Type != "prometheus" {
+				return fmt.Errorf("target %s, rule %s: %s targets don't support exemplar_window", name, ruleID(rule), group.Type)
+			}
+		}
+		if err := validateDependencies(group.Rules); err != nil {
+			return fmt.Errorf("target %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateTargetName requires target names that can be used in the target
+// parameter of probe URLs without escaping
+func validateTargetName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty target name")
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-._~", c)) {
+			return fmt.Errorf("target %q: names may only contain letters, digits and -._~", name)
+		}
+	}
+	return nil
+}
+
+// validateEndpoint requires an absolute http or https URL
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("missing endpoint")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL", endpoint)
+	}
+	return nil
+}
+
+func validateRule(rule Rule) error {
+	if rule.Record == "" {
+		if !rule.KeepMetricName {
+			return fmt.Errorf("missing record, set keep_metric_name to export the upstream metric names")
+		}
+		if rule.Type != "" && rule.Type != "gauge" && rule.Type != "counter" {
+			return fmt.Errorf("rules without record must be gauge or counter rules")
+		}
+		if rule.Unit != "" || rule.Present || rule.OnEmpty != nil {
+			return fmt.Errorf("unit, present and on_empty need a record")
+		}
+	}
+	if rule.CacheTTL != nil && rule.Cache != 0 {
+		return fmt.Errorf("cache is the former name of cache_ttl, set only one")
+	}
+
+	switch rule.Type {
+	case "", "gauge", "histogram", "summary":
+	case "info":
+		if !strings.HasSuffix(rule.Record, "_info") {
+			return fmt.Errorf("info rules must be named <name>_info")
+		}
+	case "counter":
+		if rule.CounterReset != "" && rule.CounterReset != "accumulate" && rule.CounterReset != "ignore" {
+			return fmt.Errorf("unknown counter_reset %q", rule.CounterReset)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", rule.Type)
+	}
+
+	// Value conversions only apply to rules exporting plain values
+	scalar := rule.Type == "" || rule.Type == "gauge" || rule.Type == "counter"
+
+	if rule.Bool != nil {
+		if !scalar {
+			return fmt.Errorf("bool is only supported for gauge and counter rules")
+		}
+		if err := rule.Bool.validate(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Unit != "" {
+		if _, exists := unitConversions[rule.Unit]; !exists {
+			return fmt.Errorf("unknown unit %q", rule.Unit)
+		}
+		if !scalar {
+			return fmt.Errorf("unit is only supported for gauge and counter rules")
+		}
+		if rule.Bool != nil {
+			return fmt.Errorf("unit and bool can't be combined")
+		}
+	}
+
+	if rule.OnEmpty != nil && rule.Type != "" && rule.Type != "gauge" {
+		return fmt.Errorf("on_empty is only supported for gauge rules")
+	}
+
+	if rule.Join != nil {
+		if !scalar && rule.Type != "info" {
+			return fmt.Errorf("join is only supported for gauge, counter and info rules")
+		}
+		if err := rule.Join.validate(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Compute != nil {
+		if rule.Record == "" || rule.Expr != "" {
+			return fmt.Errorf("compute rules need a record and no expr")
+		}
+		if rule.Type != "" && rule.Type != "gauge" {
+			return fmt.Errorf("compute is only supported for gauge rules")
+		}
+		if rule.Join != nil || rule.Present || rule.KeepMetricName || rule.ExemplarWindow != 0 {
+			return fmt.Errorf("join, present, keep_metric_name and exemplar_window can't be combined with compute")
+		}
+		if err := rule.Compute.validate(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Align < 0 {
+		return fmt.Errorf("align must not be negative")
+	}
+	if rule.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if rule.BudgetWeight < 0 {
+		return fmt.Errorf("budget_weight must not be negative")
+	}
+	if rule.ExemplarWindow < 0 {
+		return fmt.Errorf("exemplar_window must not be negative")
+	}
+	if rule.ExemplarWindow != 0 && rule.Type == "summary" {
+		return fmt.Errorf("exemplar_window is not supported for summary rules")
+	}
+
+	if rule.ExpectMinSeries < 0 || rule.ExpectMaxSeries < 0 {
+		return fmt.Errorf("expect_min_series and expect_max_series must not be negative")
+	}
+	if rule.ExpectMaxSeries > 0 && rule.ExpectMinSeries > rule.ExpectMaxSeries {
+		return fmt.Errorf("expect_min_series is above expect_max_series")
+	}
+
+	if rule.Precision != nil {
+		if !scalar {
+			return fmt.Errorf("precision is only supported for gauge and counter rules")
+		}
+		if err := rule.Precision.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runQuery runs a query of the rule against the datasource of the group
+// at the given time, or the current time if it is zero, and caches the parsed
+// results for the rule's cache TTL in the namespace of the target
+func runQuery(ctx context.Context, target string, group Group, rule Rule, query string, at time.Time) ([]map[string]interface{}, error) {
+	cacheKey := fmt.Sprintf("%s:%s", group.Endpoint, query)
+	if settings := ruleSettings(rule); settings != "" {
+		cacheKey += " " + settings
+	}
+	if !at.IsZero() {
+		cacheKey = fmt.Sprintf("%s@%d", cacheKey, at.Unix())
+	}
+	namespace := queryCache.Namespace(target)
+	errorKey := cacheKey + " error"
+	cachedErr, found, err := namespace.GetContext(ctx, errorKey)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		log.Printf("Cached error for %s in target %s", cacheKey, target)
+		return nil, cachedErr.(error)
+	}
+
+	for {
+		loaded := false
+		cachedResult, err := namespace.FetchContext(ctx, cacheKey, cacheTTL(group, rule), func(ctx context.Context) (interface{}, error) {
+			loaded = true
+			start := time.Now()
+			var results []map[string]interface{}
+			datasource, err := newDatasource(group)
+			if err == nil {
+				results, err = queryRule(ctx, datasource, rule, query, at)
+			}
+			if ctx.Err() != nil {
+				// The probe was cancelled, the duration tells nothing
+				return nil, ctx.Err()
+			}
+			duration := time.Since(start)
+			ruleQueryDuration.WithLabelValues(target, ruleID(rule)).Observe(duration.Seconds())
+			if err != nil {
+				return nil, err
+			}
+			logSlowQuery(target, group, rule, query, duration, len(results))
+			return dedupReplicas(group, results), nil
+		})
+		if err != nil && !loaded && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			// The probe that ran the query was cancelled while this one
+			// waited for it, run it again
+			continue
+		}
+		if err != nil {
+			if loaded && group.ErrorCache > 0 {
+				// Errors of cancelled probes aren't cached
+				namespace.SetContext(ctx, errorKey, err, group.ErrorCache)
+			}
+			return nil, err
+		}
+		if !loaded {
+			log.Printf("Cache hit for %s in target %s", cacheKey, target)
+		}
 		return cachedResult.([]map[string]interface{}), nil
 	}
+}
+
+// queryResultSize estimates the memory used by cached query results
+func queryResultSize(key string, value interface{}) int64 {
+	size := int64(len(key))
+	results, ok := value.([]map[string]interface{})
+	if !ok {
+		// A cached error
+		return size + 64
+	}
+	for _, result := range results {
+		for name, v := range result {
+			size += int64(len(name)) + 16
+			switch v := v.(type) {
+			case string:
+				size += int64(len(v))
+			case *NativeHistogramValue:
+				size += int64(len(v.Positive)+len(v.Negative))*16 + 64
+			}
+		}
+	}
+	return size
+}
 
-	client := http.Client{Timeout: 50 * time.Second}
-	query = url.QueryEscape(query)
-	resp, err := client.Get(fmt.Sprintf("%s/api/v1/query?query=%s", endpoint, query))
+// fetchQuery runs an instant query and returns the raw API response
+func fetchQuery(ctx context.Context, group Group, query string, at time.Time) ([]byte, error) {
+	client, err := clientFor(group)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"query": {query}}
+	if !at.IsZero() {
+		params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v1/query?%s", group.Endpoint, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// queryResponse is a response of the instant query API of Prometheus
+type queryResponse struct {
+	Status   string   `json:"status"`
+	Warnings []string `json:"warnings"`
+	Data     *struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// seriesResult is a series of a vector or matrix result. Vectors have a
+// value or a histogram, matrices values or histograms.
+type seriesResult struct {
+	Metric     map[string]string `json:"metric"`
+	Value      *samplePair       `json:"value"`
+	Histogram  interface{}       `json:"histogram"`
+	Values     []samplePair      `json:"values"`
+	Histograms []interface{}     `json:"histograms"`
+}
+
+// samplePair is a [timestamp, "value"] pair of a result
+type samplePair struct {
+	Timestamp float64
+	Value     string
+}
+
+func (p *samplePair) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil || len(pair) != 2 {
+		return fmt.Errorf("expected [timestamp, value] instead of %s", data)
+	}
+	if err := json.Unmarshal(pair[0], &p.Timestamp); err != nil {
+		return fmt.Errorf("invalid timestamp %s", pair[0])
+	}
+	if err := json.Unmarshal(pair[1], &p.Value); err != nil {
+		return fmt.Errorf("invalid value %s, expected a string", pair[1])
+	}
+	return nil
+}
+
+// parseQueryResponse flattens the result of an instant query into label maps
+// with the sample value stored under "value", or a *NativeHistogramValue
+// under "histogram" for native histogram samples, and returns the warnings
+// of the response. Matrix results give the latest sample of every series,
+// scalar results a single sample without labels.
+func parseQueryResponse(body []byte) ([]map[string]interface{}, []string, error) {
+	var response queryResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, nil, &parseError{err}
+	}
+	if response.Status != "success" {
+		return nil, nil, responseError(http.StatusOK, body)
+	}
+	if response.Data == nil {
+		return nil, nil, &parseError{fmt.Errorf("response has no data")}
+	}
 
-	results := result["data"].(map[string]interface{})["result"].([]interface{})
 	var parsedResults []map[string]interface{}
+	switch resultType := response.Data.ResultType; resultType {
+	case "vector", "matrix":
+		var series []seriesResult
+		if err := json.Unmarshal(response.Data.Result, &series); err != nil {
+			return nil, nil, &parseError{fmt.Errorf("%s result: %v", resultType, err)}
+		}
+		for _, s := range series {
+			labels := make(map[string]interface{}, len(s.Metric)+1)
+			for name, value := range s.Metric {
+				labels[name] = value
+			}
+			value, histogram := s.Value, s.Histogram
+			if resultType == "matrix" {
+				value, histogram = nil, nil
+				if n := len(s.Values); n > 0 {
+					value = &s.Values[n-1]
+				}
+				if n := len(s.Histograms); n > 0 {
+					histogram = s.Histograms[n-1]
+				}
+			}
+			switch {
+			case histogram != nil:
+				h, err := parseNativeHistogram(histogram)
+				if err != nil {
+					return nil, nil, &parseError{err}
+				}
+				labels["histogram"] = h
+			case value != nil:
+				labels["value"] = value.Value
+			default:
+				return nil, nil, &parseError{fmt.Errorf("series %s has no value", formatLabels(s.Metric))}
+			}
+			parsedResults = append(parsedResults, labels)
+		}
+	case "scalar":
+		var value samplePair
+		if err := json.Unmarshal(response.Data.Result, &value); err != nil {
+			return nil, nil, &parseError{fmt.Errorf("scalar result: %v", err)}
+		}
+		parsedResults = append(parsedResults, map[string]interface{}{"value": value.Value})
+	default:
+		return nil, nil, &parseError{fmt.Errorf("unsupported result type %q", resultType)}
+	}
+	return parsedResults, response.Warnings, nil
+}
+
+// resultToSample splits a parsed result into the exported labels and value,
+// dropping the metric name. The value of native histogram samples is 0.
+func resultToSample(result map[string]interface{}) (prometheus.Labels, float64) {
+	value := 0.0
+	if s, ok := result["value"].(string); ok {
+		value, _ = strconv.ParseFloat(s, 64)
+	}
+	labels := make(prometheus.Labels)
+	for k, v := range result {
+		if k != "value" && k != "histogram" && k != "__name__" {
+			labels[k] = v.(string)
+		}
+	}
+	return labels, value
+}
 
-	for _, res := range results {
-		parsedResult := res.(map[string]interface{})
-		labels := parsedResult["metric"].(map[string]interface{})
-		value := parsedResult["value"].([]interface{})[1].(string)
-		labels["value"] = value
-		parsedResults = append(parsedResults, labels)
+// Sample is a single series produced by evaluating a rule
+type Sample struct {
+	Name   string
+	Help   string
+	Type   prometheus.ValueType
+	Labels prometheus.Labels
+	Value  float64
+	// Rule is the ruleID of the rule the sample is a result of
+	Rule string
+	// Histogram and Summary are set instead of Value for histogram and
+	// summary rules
+	Histogram *HistogramValue
+	Summary   *SummaryValue
+	// NativeHistogram is set instead of Value for native histogram results
+	NativeHistogram *NativeHistogramValue
+	// Exemplar is set for rules with exemplar_window
+	Exemplar *Exemplar
+}
+
+// evaluation is the outcome of evaluating all rules of a target
+type evaluation struct {
+	Samples []Sample
+	Time    time.Time
+	Errors  []RuleError
+}
+
+// RuleError records a rule that failed during an evaluation
+type RuleError struct {
+	Rule  string `json:"rule"`
+	Error string `json:"error"`
+}
+
+// evaluateTarget runs all rules of a group and returns the resulting samples.
+// Rules that fail are logged and recorded in the errors of the evaluation,
+// and replaced by their last successful samples with on_error: stale.
+// Aggregate targets evaluate their members.
+func evaluateTarget(ctx context.Context, target string, group Group) evaluation {
+	if len(group.AggregateOf) > 0 {
+		config := getConfig()
+		return aggregateEvaluation(group, func(member string) evaluation {
+			return evaluateTarget(ctx, member, config.Targets[member])
+		})
 	}
 
-	queryCache.Set(cacheKey, parsedResults, cacheDuration)
-	return parsedResults, nil
+	eval := evaluation{Time: time.Now()}
+	rules := prioritizedRules(group.Rules)
+	outputs := ruleOutputs{}
+	for i, rule := range rules {
+		if errors.Is(context.Cause(ctx), context.Canceled) {
+			// The probe was cancelled, no one waits for the other rules
+			break
+		}
+		ruleCtx, cancel := ruleContext(ctx, rules[i:])
+		samples, ruleErr := evaluateTargetRule(ruleCtx, target, group, rule, outputs)
+		cancel()
+		eval.Samples = append(eval.Samples, samples...)
+		if ruleErr != nil {
+			eval.Errors = append(eval.Errors, *ruleErr)
+		} else {
+			outputs.add(rule, samples)
+		}
+	}
+	return eval
 }
 
-func handler(config Config) http.HandlerFunc {
+// evaluateTargetRule evaluates one rule of a target, compute rules from the
+// outputs of the rules evaluated before, returning the stale samples of the
+// rule with on_error: stale if it fails
+func evaluateTargetRule(ctx context.Context, target string, group Group, rule Rule, outputs ruleOutputs) ([]Sample, *RuleError) {
+	var ruleSamples []Sample
+	var err error
+	if rule.Compute != nil {
+		ruleSamples, err = computeRule(rule, outputs)
+	} else {
+		ruleSamples, err = evaluateRule(ctx, target, group, rule)
+	}
+	if err != nil {
+		if errors.Is(context.Cause(ctx), context.Canceled) {
+			// The probe was cancelled, the rule didn't fail
+			return nil, &RuleError{Rule: ruleID(rule), Error: err.Error()}
+		}
+		if errors.Is(context.Cause(ctx), errRuleBudget) {
+			err = fmt.Errorf("exceeded its share of the probe deadline: %w", err)
+		}
+		log.Printf("Error querying datasource for rule %s: %v", ruleID(rule), err)
+		ruleErrors.WithLabelValues(target, ruleID(rule), classifyError(err)).Inc()
+		ruleErr := &RuleError{Rule: ruleID(rule), Error: err.Error()}
+		if group.OnError == "stale" {
+			return staleSamples(target, rule), ruleErr
+		}
+		return nil, ruleErr
+	}
+	series := len(ruleSamples)
+	if rule.Present {
+		series--
+	}
+	checkSeriesCount(target, rule, series)
+	for i := range ruleSamples {
+		ruleSamples[i].Rule = ruleID(rule)
+	}
+	if group.OnError == "stale" {
+		rememberSamples(target, rule, ruleSamples)
+	}
+	return ruleSamples, nil
+}
+
+// queryTime returns the evaluation time of a rule. It is zero, meaning the
+// time the upstream receives the query, unless the rule is aligned.
+func queryTime(rule Rule) time.Time {
+	if rule.Align <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Truncate(rule.Align)
+}
+
+// cacheTTL returns how long query results of a rule are reused: the rule's
+// own setting, then the target's, then --cache.ttl
+func cacheTTL(group Group, rule Rule) time.Duration {
+	switch {
+	case rule.CacheTTL != nil:
+		return *rule.CacheTTL
+	case rule.Cache != 0:
+		return rule.Cache
+	case group.CacheTTL != nil:
+		return *group.CacheTTL
+	}
+	return defaultCacheTTL
+}
+
+// evaluateRule queries a single rule and converts the results into samples
+func evaluateRule(ctx context.Context, target string, group Group, rule Rule) ([]Sample, error) {
+	switch rule.Type {
+	case "histogram":
+		samples, err := evaluateHistogram(ctx, target, group, rule)
+		attachExemplars(ctx, target, group, rule, samples)
+		return withPresence(rule, samples, len(samples) > 0), err
+	case "summary":
+		samples, err := evaluateSummary(ctx, target, group, rule)
+		return withPresence(rule, samples, len(samples) > 0), err
+	}
+
+	at := queryTime(rule)
+	results, err := runQuery(ctx, target, group, rule, rule.Expr, at)
+	if err != nil {
+		return nil, err
+	}
+
+	valueType := prometheus.GaugeValue
+	if rule.Type == "counter" {
+		valueType = prometheus.CounterValue
+	}
+
+	var samples []Sample
+	for _, result := range results {
+		labels, value := resultToSample(result)
+		name := ruleMetricName(rule)
+		if rule.KeepMetricName {
+			source, _ := result["__name__"].(string)
+			switch {
+			case rule.Record != "":
+				if source != "" {
+					labels["source_metric"] = source
+				}
+			case source == "":
+				return nil, fmt.Errorf("result without metric name, e.g. from an aggregation, needs a record")
+			default:
+				name = source
+			}
+		}
+		sample := Sample{
+			Name:   name,
+			Help:   ruleHelp(rule),
+			Type:   valueType,
+			Labels: labels,
+			Value:  transformValue(rule, value),
+		}
+		if h, ok := result["histogram"].(*NativeHistogramValue); ok {
+			sample.Help = fmt.Sprintf("Histogram of Prometheus query: %s", rule.Expr)
+			sample.NativeHistogram = h
+		}
+		if rule.Type == "info" {
+			// Info metrics carry their information in the labels only
+			sample.Help = fmt.Sprintf("Information from Prometheus query: %s", rule.Expr)
+			sample.NativeHistogram = nil
+			sample.Value = 1
+		}
+		samples = append(samples, sample)
+	}
+
+	if rule.Join != nil && len(samples) > 0 {
+		if err := applyJoin(ctx, target, group, rule, at, samples); err != nil {
+			return nil, err
+		}
+	}
+	attachExemplars(ctx, target, group, rule, samples)
+
+	present := len(samples) > 0
+	if !present && rule.OnEmpty != nil && rule.OnEmpty.Value != nil {
+		samples = append(samples, Sample{
+			Name:   ruleMetricName(rule),
+			Help:   ruleHelp(rule),
+			Type:   valueType,
+			Labels: prometheus.Labels{},
+			Value:  *rule.OnEmpty.Value,
+		})
+	}
+
+	if rule.Type == "counter" {
+		updateCounters(target, rule, samples)
+	}
+	return withPresence(rule, samples, present), nil
+}
+
+// withPresence adds the <name>_present sample of rules with present: true
+func withPresence(rule Rule, samples []Sample, present bool) []Sample {
+	if !rule.Present {
+		return samples
+	}
+	value := 0.0
+	if present {
+		value = 1
+	}
+	return append(samples, Sample{
+		Name:   ruleMetricName(rule) + "_present",
+		Help:   fmt.Sprintf("Whether Prometheus query returned any series: %s", rule.Expr),
+		Type:   prometheus.GaugeValue,
+		Labels: prometheus.Labels{},
+		Value:  value,
+	})
+}
+
+// sampleCollector exposes a fixed set of samples. It has no
+// descriptors, so several can be registered with the same registry.
+type sampleCollector struct {
+	samples   []Sample
+	timestamp time.Time // attached to every sample unless zero
+}
+
+func (c sampleCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c sampleCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range c.samples {
+		labelNames := getLabelNames(sample.Labels)
+		labelValues := make([]string, len(labelNames))
+		for i, name := range labelNames {
+			labelValues[i] = sample.Labels[name]
+		}
+
+		desc := prometheus.NewDesc(sample.Name, sample.Help, labelNames, nil)
+		var metric prometheus.Metric
+		var err error
+		if h := sample.Histogram; h != nil {
+			metric, err = prometheus.NewConstHistogram(desc, h.Count, h.Sum, h.Buckets, labelValues...)
+		} else if s := sample.Summary; s != nil {
+			metric, err = prometheus.NewConstSummary(desc, s.Count, s.Sum, s.Quantiles, labelValues...)
+		} else if h := sample.NativeHistogram; h != nil {
+			metric = newNativeHistogramMetric(desc, h, labelNames, labelValues)
+		} else {
+			metric, err = prometheus.NewConstMetric(desc, sample.Type, sample.Value, labelValues...)
+		}
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		if !c.timestamp.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(c.timestamp, metric)
+		}
+		ch <- metric
+	}
+}
+
+// probeFailure returns the rule error that fails the probe: any error with
+// on_error: fail, otherwise the first error of a rule with fail_on_error
+func probeFailure(group Group, eval evaluation) *RuleError {
+	for i, ruleErr := range eval.Errors {
+		if group.OnError == "fail" {
+			return &eval.Errors[i]
+		}
+		for _, rule := range group.Rules {
+			if ruleID(rule) == ruleErr.Rule && rule.FailOnError {
+				return &eval.Errors[i]
+			}
+		}
+	}
+	return nil
+}
+
+func handler(scheduled bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := r.URL.Query().Get("target")
-		if target == "" {
+		config := getConfig()
+		// Several targets can be given comma separated or repeated
+		targets := splitList(strings.Join(r.URL.Query()["target"], ","))
+		if len(targets) == 0 {
 			http.Error(w, "Missing target parameter", http.StatusBadRequest)
 			return
 		}
+		if slices.Contains(targets, "*") {
+			names := probeAllTargets(r, config)
+			if scheduled {
+				// Every shard serves its own targets and those whose
+				// evaluations peers shared, like for a single target
+				names = slices.DeleteFunc(names, func(name string) bool {
+					_, shared := peerEvaluation(name)
+					return !ownsTarget(name) && !shared
+				})
+			}
+			probeTargets(w, r, config, names, scheduled)
+			return
+		}
+		if len(targets) > 1 {
+			probeTargets(w, r, config, targets, scheduled)
+			return
+		}
+		target := targets[0]
 
 		group, exists := config.Targets[target]
 		if !exists {
@@ -105,66 +1012,345 @@ func handler(config Config) http.HandlerFunc {
 			return
 		}
 
-		for _, rule := range group.Rules {
+		if _, shared := peerEvaluation(target); scheduled && !ownsTarget(target) && !shared {
+			http.Error(w, fmt.Sprintf("Target is evaluated by shard %d", shardOf(target)), http.StatusNotFound)
+			return
+		}
+
+		if !checkProbeToken(w, r, group) {
+			return
+		}
+		release, admitted := admitTenant(w, r, config, group)
+		if !admitted {
+			return
+		}
+		defer release()
 
-			results, err := queryPrometheus(group.Endpoint, rule.Expr, rule.Cache)
+		// A rules parameter limits the probe to some of the rules, which are
+		// evaluated with the rules compute rules among them depend on
+		selected := strings.Join(r.URL.Query()["rules"], ",")
+		var selectedRules []Rule
+		if selected != "" {
+			if len(group.AggregateOf) > 0 {
+				http.Error(w, "The rules parameter is not supported for aggregate targets", http.StatusBadRequest)
+				return
+			}
+			rules, err := selectRules(group, splitList(selected))
 			if err != nil {
-				log.Printf("Error querying Prometheus for rule %s: %v", rule.Record, err)
-				continue
+				http.Error(w, "Invalid rules parameter: "+err.Error(), http.StatusBadRequest)
+				return
 			}
+			selectedRules = rules
+			group.Rules = withDependencies(group.Rules, rules)
+		}
 
-			for _, result := range results {
-				value, _ := strconv.ParseFloat(result["value"].(string), 64)
-				labels := make(prometheus.Labels)
-				for k, v := range result {
-					if k != "value" {
-						labels[k] = v.(string)
-					}
-				}
-
-				metric, exists := ruleMetrics[rule.Record]
-				if !exists {
-					metricVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-						Name: rule.Record,
-						Help: fmt.Sprintf("Value of Prometheus query: %s", rule.Expr),
-					}, getLabelNames(labels))
-					ruleMetrics[rule.Record] = metricVec
-					metric = metricVec
-					registry.MustRegister(metric) // Register the metric with the custom registry
+		format := expfmt.Negotiate(r.Header)
+		asJSON := r.URL.Query().Get("format") == "json"
+		render := func() (exposition, error) {
+			// In scheduled mode the probe serves the latest background evaluation
+			var eval evaluation
+			if scheduled {
+				eval = getEvaluation(target)
+			} else {
+				ctx, cancel := probeContext(r)
+				defer cancel()
+				eval = evaluateTarget(ctx, target, group)
+				if errors.Is(context.Cause(ctx), context.Canceled) {
+					// The scraper is gone, the partial evaluation must not
+					// be cached for others
+					return exposition{}, ctx.Err()
 				}
+			}
+			if selected != "" {
+				eval = filterEvaluation(eval, selectedRules)
+			}
+			if failed := probeFailure(group, eval); failed != nil {
+				return exposition{}, fmt.Errorf("rule %s failed: %s", failed.Rule, failed.Error)
+			}
 
-				metric.With(labels).Set(value)
+			if asJSON {
+				return renderJSON(target, eval.Samples, eval.Time)
 			}
+			return renderExposition(format, sampleCollector{samples: eval.Samples})
 		}
 
-		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-		h.ServeHTTP(w, r)
+		var e exposition
+		var err error
+		if group.ResponseCache > 0 {
+			// Only the parameters changing the response are part of the
+			// key, the target is its namespace
+			key := string(format)
+			if asJSON {
+				key = "json"
+			}
+			for _, rule := range selectedRules {
+				key += " " + ruleID(rule)
+			}
+			e, err = cachedExposition(r.Context(), target, key, group.ResponseCache, render)
+		} else {
+			e, err = render()
+		}
+		if r.Context().Err() != nil {
+			// The scraper is gone, there is no one to answer
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error rendering metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeExposition(w, r, e)
 	}
 }
 
+// getLabelNames returns the label names in sorted order
 func getLabelNames(labels prometheus.Labels) []string {
 	var labelNames []string
 	for k := range labels {
 		labelNames = append(labelNames, k)
 	}
+	sort.Strings(labelNames)
 	return labelNames
 }
 
+// formatLabels renders labels in exposition format with sorted names
+func formatLabels(labels prometheus.Labels) string {
+	var pairs []string
+	for _, name := range getLabelNames(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
 func main() {
+	// Run a subcommand if one is given
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("Error running %s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	// Define the command line parameters
-	listenAddress := flag.String("web.listen-address", "0.0.0.0:9401", "Address to listen on for web interface and telemetry.")
-	configFile := flag.String("config.file", "rules_exporter.yaml", "Path to configuration file.")
+	var listenAddresses stringsFlag
+	flag.Var(&listenAddresses, "web.listen-address", "Address to listen on for web interface and telemetry, unix:<path> for a unix socket. Repeat to listen on several addresses. (default 0.0.0.0:9401)")
+	systemdSocket := flag.Bool("web.systemd-socket", false, "Use the sockets passed by systemd socket activation instead of --web.listen-address.")
+	configFile := configFlags(flag.CommandLine)
+	bearerTokenFile := flag.String("web.auth.bearer-token-file", "", "File with a bearer token required on /probe.")
+	htpasswdFile := flag.String("web.auth.htpasswd-file", "", "htpasswd file with bcrypt or {SHA} hashed users allowed to use /probe.")
+	var corsOrigins, corsMethods stringsFlag
+	flag.Var(&corsOrigins, "web.cors.allowed-origin", "Origin allowed to fetch /probe from a browser, * for any. Repeat to allow several origins.")
+	flag.Var(&corsMethods, "web.cors.allowed-method", "Method allowed in CORS requests, repeat to allow several methods. (default GET)")
+	clientRate := flag.Float64("web.rate-limit.client", 0, "Probes per second allowed from one client IP, 0 disables the limit.")
+	targetRate := flag.Float64("web.rate-limit.target", 0, "Probes per second allowed for one target, 0 disables the limit.")
+	rateBurst := flag.Int("web.rate-limit.burst", 5, "Probes allowed in a burst above the client and target rates.")
+	flag.IntVar(&probeConcurrency, "web.probe-concurrency", probeConcurrency, "Number of targets evaluated at the same time by probes of several targets.")
+	flag.IntVar(&compressionThreshold, "web.compression-threshold", compressionThreshold, "Smallest response in bytes that is gzip compressed for scrapers accepting it.")
+	schedulerInterval := flag.Duration("scheduler.interval", 0, "Evaluate all targets in the background at this interval and serve the latest results, 0 evaluates on every probe.")
+	warmUp := flag.Bool("scheduler.warm-up", false, "Evaluate all targets once before serving in scheduled mode, instead of serving empty results until the first interval has passed.")
+	warmUpConcurrency := flag.Int("scheduler.warm-up-concurrency", 4, "Number of targets evaluated at the same time during the warm-up.")
+	stateFile := flag.String("scheduler.state-file", "", "File keeping the latest evaluations and the totals of counter rules across restarts in scheduled mode, saved every interval and on shutdown.")
+	stateMaxAge := flag.Duration("scheduler.state-max-age", 5*time.Minute, "Oldest evaluation restored from --scheduler.state-file, older ones are evaluated again instead of being served.")
+	flag.DurationVar(&defaultCacheTTL, "cache.ttl", 0, "How long query results are reused for targets and rules without cache_ttl, 0 queries on every probe.")
+	flag.DurationVar(&slowQueryThreshold, "log.slow-query-threshold", 0, "Log and count queries taking longer than this, 0 disables the slow query log.")
+	cacheMaxBytes := flag.Int64("cache.max-bytes", 0, "Estimated size in bytes each of the query and response caches may grow to before the oldest entries are removed, 0 disables the limit.")
+	cacheShards := flag.Int("cache.shards", cache.DefaultShards, "Number of independently locked shards of each of the query and response caches. More shards reduce lock contention between concurrent probes.")
+	cleanupInterval := flag.Duration("cache.cleanup-interval", time.Minute, "Interval at which expired entries are removed from the query and response caches.")
+	flag.IntVar(&shardIndex, "shard.index", shardIndex, "Shard of this replica in scheduled mode, from 0 to --shard.total minus 1.")
+	flag.IntVar(&shardTotal, "shard.total", shardTotal, "Number of replicas sharing the targets in scheduled mode, each evaluating the targets whose hashmod of the name is its --shard.index.")
+	leaseName := flag.String("leader-election.lease", "", "Kubernetes Lease, name or namespace/name, held by the replica performing the scheduled evaluations. Empty disables leader election.")
+	leaseIdentity := flag.String("leader-election.identity", "", "Holder identity of this replica in the lease, the hostname by default.")
+	leaseDuration := flag.Duration("leader-election.lease-duration", 15*time.Second, "How long other replicas wait for the leader to renew the lease before taking it over.")
+	leaseRetryPeriod := flag.Duration("leader-election.retry-period", 2*time.Second, "Interval of renewing the lease or trying to acquire it.")
+	var replicaPeers stringsFlag
+	flag.Var(&replicaPeers, "replica.peer", "URL of another replica whose scheduled evaluations are fetched, so probes of targets evaluated by the leader or another shard are answered here. Repeat for every peer.")
+	replicaSyncInterval := flag.Duration("replica.sync-interval", 5*time.Second, "Interval of fetching the evaluations of the peers.")
+	replicaTokenFile := flag.String("replica.token-file", "", "File with a token shared by the replicas, required on their requests for the evaluations. Needed with --replica.peer.")
+	queryProxy := flag.Bool("web.enable-query-proxy", false, "Serve /api/v1/query, answering instant queries of the records of gauge, counter and info rules by running their expressions, e.g. for Grafana.")
+	verify := flag.Bool("startup.verify-endpoints", false, "Check at startup that the endpoint of every target answers.")
+	verifyBuildinfo := flag.Bool("startup.verify-buildinfo", false, "Also query /api/v1/status/buildinfo of Prometheus targets with --startup.verify-endpoints, logging their version.")
+	verifyPolicy := flag.String("startup.verify-policy", "warn", "What to do if --startup.verify-endpoints fails for a target: warn, logging it, or fail, refusing to start.")
+	flag.DurationVar(&timeoutOffset, "web.timeout-offset", timeoutOffset, "Subtracted from the X-Prometheus-Scrape-Timeout-Seconds of probes, whose rules share the remaining time, to leave time for the response.")
+	tagFilter := flag.String("rules.tag-filter", "", "Comma separated tags of the rules to evaluate for targets without tag_filter, tags prefixed with ! exclude rules. Empty evaluates all enabled rules.")
 	flag.Parse()
 
+	ruleTagFilter = splitList(*tagFilter)
+	if err := validateShard(shardIndex, shardTotal); err != nil {
+		log.Fatalf("Error in flags: %v", err)
+	}
+	queryCache = cache.NewShardedCache(*cacheShards)
+	responseCache = cache.NewShardedCache(*cacheShards)
+	countCacheEvictions()
+	queryCache.SetMaxBytes(*cacheMaxBytes, queryResultSize)
+	responseCache.SetMaxBytes(*cacheMaxBytes, expositionSize)
+
+	if len(listenAddresses) == 0 {
+		listenAddresses = stringsFlag{"0.0.0.0:9401"}
+	}
+	if len(corsMethods) == 0 {
+		corsMethods = stringsFlag{http.MethodGet}
+	}
+	cors := corsConfig{origins: corsOrigins, methods: corsMethods}
+	limits := probeLimits{
+		client: newRateLimiter(*clientRate, *rateBurst),
+		target: newRateLimiter(*targetRate, *rateBurst),
+	}
+
 	// Load the configuration file
 	config, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	http.Handle("/probe", handler(config)) // Use the config in the handler
-	fmt.Printf("Listening on %s\n", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	if err := applyConfig(config); err != nil {
+		log.Fatalf("Error setting up HTTP clients: %v", err)
+	}
+	if *verifyPolicy != "warn" && *verifyPolicy != "fail" {
+		log.Fatalf("Unknown --startup.verify-policy %q, expected warn or fail", *verifyPolicy)
+	}
+	if *verify {
+		if err := verifyStartup(config, *verifyBuildinfo, *verifyPolicy); err != nil {
+			log.Fatalf("Error verifying endpoints: %v", err)
+		}
+	}
+
+	auth, err := loadProbeAuth(*bearerTokenFile, *htpasswdFile)
+	if err != nil {
+		log.Fatalf("Error loading credentials: %v", err)
+	}
+
+	scheduled := *schedulerInterval > 0
+	if !scheduled && len(config.Sinks) > 0 {
+		log.Printf("Sinks only receive scheduled evaluations, which need --scheduler.interval")
+	}
+	if !scheduled && shardTotal > 1 {
+		log.Printf("Sharding only applies to scheduled evaluations, which need --scheduler.interval")
+	}
+	if !scheduled && len(replicaPeers) > 0 {
+		log.Printf("Replicas only share scheduled evaluations, which need --scheduler.interval")
+	}
+	if len(replicaPeers) > 0 && *replicaTokenFile == "" {
+		// The evaluations include those of all tenants and probe tokens
+		log.Fatalf("--replica.peer needs --replica.token-file")
+	}
+	if len(replicaPeers) > 0 && *replicaSyncInterval <= 0 {
+		log.Fatalf("--replica.sync-interval must be positive")
+	}
+	var elector *leaderElector
+	if *leaseName != "" {
+		if !scheduled {
+			log.Fatalf("Leader election only applies to scheduled evaluations, which need --scheduler.interval")
+		}
+		if elector, err = newLeaderElector(*leaseName, *leaseIdentity, *leaseDuration, *leaseRetryPeriod); err != nil {
+			log.Fatalf("Error setting up leader election: %v", err)
+		}
+	}
+	if *stateFile != "" && !scheduled {
+		log.Fatalf("--scheduler.state-file needs --scheduler.interval")
+	}
+	var sched *scheduler
+	if scheduled {
+		if *stateFile != "" {
+			if err := loadState(*stateFile, *stateMaxAge); err != nil {
+				log.Printf("Error restoring state: %v", err)
+			}
+		}
+		concurrency := 0
+		if *warmUp {
+			concurrency = max(*warmUpConcurrency, 1)
+		}
+		sched = startScheduler(config, *schedulerInterval, concurrency, elector != nil)
+		http.Handle("/federate", auth.wrap(federateHandler()))
+		if len(replicaPeers) > 0 {
+			token, err := loadReplicaToken(*replicaTokenFile)
+			if err != nil {
+				log.Fatalf("Error loading replica token: %v", err)
+			}
+			http.Handle(replicaPath, replicaHandler(token))
+			startReplicaSync(replicaPeers, *replicaSyncInterval, token)
+		}
+		http.Handle("/snapshot", cors.wrap(auth.wrap(snapshotHandler())))
+	}
+
+	// Discovered targets change the configuration like a reload
+	rescheduled := func(config Config) {
+		if sched != nil {
+			sched.reschedule(config)
+		}
+	}
+	startDiscovery(rescheduled)
+
+	// Reload the configuration on SIGHUP. Probes that are running keep the
+	// configuration they started with.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(*configFile); err != nil {
+				log.Printf("Error reloading config: %v", err)
+				continue
+			}
+			startDiscovery(rescheduled)
+			rescheduled(getConfig())
+		}
+	}()
+
+	// Cache invalidation is only offered on authenticated servers
+	if auth != nil {
+		http.Handle("/api/v1/cache", cors.wrap(auth.wrap(cacheHandler())))
+	}
+	http.Handle("/probe", cors.wrap(auth.wrap(limits.wrap(handler(scheduled)))))
+	http.Handle("/api/v1/metadata", cors.wrap(auth.wrap(metadataHandler())))
+	if *queryProxy {
+		http.Handle("/api/v1/query", cors.wrap(auth.wrap(limits.wrap(queryProxyHandler()))))
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	var listeners []net.Listener
+	if *systemdSocket {
+		listeners, err = systemdListeners()
+	} else {
+		listeners, err = listen(listenAddresses)
+	}
+	if err != nil {
+		log.Fatalf("Error starting HTTP server: %v", err)
+	}
+
+	// The config is loaded and the sockets are bound, so requests can be served
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+
+	queryCache.StartJanitor(*cleanupInterval)
+	responseCache.StartJanitor(*cleanupInterval)
+	defer queryCache.Stop()
+	defer responseCache.Stop()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if elector != nil {
+		// Only the leader evaluates, the other replicas serve empty results
+		elected := make(chan struct{})
+		go func() {
+			defer close(elected)
+			elector.run(ctx, func(leader bool) { sched.setStandby(!leader) })
+		}()
+		defer func() { <-elected }()
+	}
+	if *stateFile != "" {
+		stopPersisting := make(chan struct{})
+		persisted := make(chan struct{})
+		go func() {
+			defer close(persisted)
+			persistState(*stateFile, *schedulerInterval, stopPersisting)
+		}()
+		defer func() {
+			close(stopPersisting)
+			<-persisted
+		}()
+	}
+	if err := serve(ctx, listeners); err != nil {
 		log.Fatalf("Error starting HTTP server: %v", err)
 	}
+	log.Printf("Shutting down")
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	evaluationsMu sync.RWMutex
+	evaluations   = map[string]evaluation{}
+)
+
+// scheduler evaluates the targets of a configuration in the background
+type scheduler struct {
+	interval time.Duration
+	warmUp   int
+	mu       sync.Mutex
+	stop     chan struct{} // closed to stop the goroutines of the targets
+	// standby is set while another replica is the leader
+	standby bool
+	// evaluateNow evaluates the targets when they are scheduled next
+	evaluateNow bool
+}
+
+// startScheduler evaluates every target in the background at the given
+// interval. With a positive warmUp it first evaluates all targets, at most
+// warmUp at a time, and returns once they are done. A scheduler started in
+// standby evaluates nothing until setStandby(false).
+func startScheduler(config Config, interval time.Duration, warmUp int, standby bool) *scheduler {
+	if warmUp > 0 && !standby {
+		warmUpTargets(config, warmUp)
+	}
+	s := &scheduler{interval: interval, warmUp: warmUp, standby: standby}
+	s.reschedule(config)
+	return s
+}
+
+// setStandby stops the evaluations, dropping their results, or starts them
+// again. With warm-up the targets are evaluated right away instead of after
+// the first interval.
+func (s *scheduler) setStandby(standby bool) {
+	s.mu.Lock()
+	s.standby = standby
+	s.evaluateNow = !standby && s.warmUp > 0
+	s.mu.Unlock()
+	s.reschedule(getConfig())
+}
+
+// reschedule replaces the evaluated targets with those of config owned by
+// this shard. Running evaluations finish with the configuration they started
+// with, and the results of removed targets are dropped.
+func (s *scheduler) reschedule(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.stop = make(chan struct{})
+	if s.standby {
+		evaluationsMu.Lock()
+		evaluations = map[string]evaluation{}
+		evaluationsMu.Unlock()
+		log.Printf("Not evaluating targets until this replica is the leader")
+		return
+	}
+	scheduled := 0
+	for name, group := range config.Targets {
+		if ownsTarget(name) {
+			go scheduleTarget(name, group, s.interval, s.evaluateNow, s.stop)
+			scheduled++
+		}
+	}
+	s.evaluateNow = false
+
+	evaluationsMu.Lock()
+	for name := range evaluations {
+		if _, exists := config.Targets[name]; !exists || !ownsTarget(name) {
+			delete(evaluations, name)
+		}
+	}
+	evaluationsMu.Unlock()
+	if shardTotal > 1 {
+		log.Printf("Evaluating %d of %d targets every %s as shard %d of %d", scheduled, len(config.Targets), s.interval, shardIndex, shardTotal)
+	} else {
+		log.Printf("Evaluating %d targets every %s", scheduled, s.interval)
+	}
+}
+
+// warmUpTargets evaluates all targets of this shard once with bounded
+// concurrency
+func warmUpTargets(config Config, concurrency int) {
+	start := time.Now()
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	warmed := 0
+	for name, group := range config.Targets {
+		if !ownsTarget(name) {
+			continue
+		}
+		warmed++
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			eval := evaluateTarget(context.Background(), name, group)
+			setEvaluation(name, eval)
+			publishEvaluation(name, eval)
+		}()
+	}
+	wg.Wait()
+	log.Printf("Warmed up %d targets in %s", warmed, time.Since(start).Round(time.Millisecond))
+}
+
+// scheduleTarget evaluates a target every interval until stop is closed.
+// With now, targets apart from aggregates are also evaluated right away.
+// Rules with their own interval are evaluated when it has passed, the
+// target is then scheduled at the shortest interval of its rules.
+func scheduleTarget(name string, group Group, interval time.Duration, now bool, stop <-chan struct{}) {
+	tick := interval
+	for _, rule := range group.Rules {
+		tick = min(tick, ruleInterval(rule, interval))
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	first := make(chan struct{}, 1)
+	if now && len(group.AggregateOf) == 0 {
+		first <- struct{}{}
+	}
+	group.Rules = prioritizedRules(group.Rules)
+	rules := make([]scheduledRule, len(group.Rules))
+	for {
+		select {
+		case <-first:
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		var eval evaluation
+		if len(group.AggregateOf) > 0 {
+			// Aggregates combine the latest evaluations of their members,
+			// evaluating those of other shards
+			eval = aggregateEvaluation(group, memberEvaluation)
+		} else {
+			eval = evaluateScheduled(name, group, interval, tick, rules)
+		}
+		select {
+		case <-stop:
+			// The target was rescheduled while it was evaluated
+			return
+		default:
+			setEvaluation(name, eval)
+			publishEvaluation(name, eval)
+		}
+	}
+}
+
+// scheduledRule is the last evaluation of a rule by scheduleTarget
+type scheduledRule struct {
+	at      time.Time
+	samples []Sample
+	err     *RuleError
+}
+
+// ruleInterval returns how often a rule is evaluated in scheduled mode
+func ruleInterval(rule Rule, interval time.Duration) time.Duration {
+	if rule.Interval > 0 {
+		return rule.Interval
+	}
+	return interval
+}
+
+// evaluateScheduled evaluates the rules of a target whose interval has
+// passed, within half a tick of the target, and reuses the last results of
+// the others
+func evaluateScheduled(target string, group Group, interval, tick time.Duration, rules []scheduledRule) evaluation {
+	eval := evaluation{Time: time.Now()}
+	outputs := ruleOutputs{}
+	for i, rule := range group.Rules {
+		r := &rules[i]
+		if r.at.IsZero() || eval.Time.Sub(r.at) >= ruleInterval(rule, interval)-tick/2 {
+			r.samples, r.err = evaluateTargetRule(context.Background(), target, group, rule, outputs)
+			r.at = eval.Time
+		}
+		eval.Samples = append(eval.Samples, r.samples...)
+		if r.err != nil {
+			eval.Errors = append(eval.Errors, *r.err)
+		} else {
+			outputs.add(rule, r.samples)
+		}
+	}
+	return eval
+}
+
+func setEvaluation(target string, eval evaluation) {
+	evaluationsMu.Lock()
+	defer evaluationsMu.Unlock()
+	evaluations[target] = eval
+}
+
+// getEvaluation returns the latest evaluation of a target by this replica or
+// its peers, which is empty until the target has been evaluated once. The
+// evaluations of peers are only used for targets this replica doesn't own
+// or hasn't evaluated yet.
+func getEvaluation(target string) evaluation {
+	evaluationsMu.RLock()
+	eval, exists := evaluations[target]
+	evaluationsMu.RUnlock()
+	if exists && ownsTarget(target) {
+		return eval
+	}
+	if peerEval, found := peerEvaluation(target); found && peerEval.Time.After(eval.Time) {
+		return peerEval
+	}
+	return eval
+}
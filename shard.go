@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// shardIndex and shardTotal select the targets evaluated by this replica in
+// scheduled mode, set by --shard.index and --shard.total
+var (
+	shardIndex = 0
+	shardTotal = 1
+)
+
+func validateShard(index, total int) error {
+	if total < 1 {
+		return fmt.Errorf("--shard.total must be at least 1")
+	}
+	if index < 0 || index >= total {
+		return fmt.Errorf("--shard.index must be between 0 and %d", total-1)
+	}
+	return nil
+}
+
+// shardOf returns the shard of a target, like the hashmod relabel action of
+// Prometheus with modulus shardTotal on the target name
+func shardOf(target string) int {
+	return int(hashmod(target, uint64(shardTotal)))
+}
+
+// ownsTarget tells whether this replica evaluates a target
+func ownsTarget(target string) bool {
+	return shardTotal <= 1 || shardOf(target) == shardIndex
+}
+
+// memberEvaluation returns the latest evaluation of a member of an aggregate
+// target, or evaluates it if another shard owns it and no peer shared its
+// evaluation
+func memberEvaluation(member string) evaluation {
+	eval := getEvaluation(member)
+	if eval.Time.IsZero() && !ownsTarget(member) {
+		return evaluateTarget(context.Background(), member, getConfig().Targets[member])
+	}
+	return eval
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// signaturePublicKey is the minisign or cosign public key configuration
+	// files must be signed with, set by --config.signature-public-key
+	signaturePublicKey string
+	// signatureFile is the detached signature of the configuration file, by
+	// default the file with .minisig or .sig appended for minisign and
+	// cosign keys, set by --config.signature-file
+	signatureFile string
+)
+
+// verifyConfigSignature checks the detached signature of a configuration
+// file against signaturePublicKey. Keys in PEM format are cosign keys, whose
+// signatures are base64 encoded ECDSA or Ed25519 signatures, others are
+// minisign keys.
+func verifyConfigSignature(configFile string, data []byte) error {
+	key, err := ioutil.ReadFile(signaturePublicKey)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(key)
+	cosign := block != nil
+
+	file := signatureFile
+	if file == "" && cosign {
+		file = configFile + ".sig"
+	} else if file == "" {
+		file = configFile + ".minisig"
+	}
+	signature, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+
+	if cosign {
+		err = verifyCosign(block, data, signature)
+	} else {
+		err = verifyMinisign(key, data, signature)
+	}
+	if err != nil {
+		return fmt.Errorf("signature %s: %v", file, err)
+	}
+	return nil
+}
+
+// verifyCosign verifies a signature of cosign sign-blob
+func verifyCosign(block *pem.Block, data, signature []byte) error {
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("public key: %v", err)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T, expected ECDSA or Ed25519", pub)
+	}
+	return nil
+}
+
+// verifyMinisign verifies a minisign signature, of the file itself or of its
+// BLAKE2b hash, and its trusted comment
+func verifyMinisign(key, data, signature []byte) error {
+	pub, err := minisignLine(key, 1)
+	if err != nil || len(pub) != 42 || string(pub[:2]) != "Ed" {
+		return fmt.Errorf("invalid minisign public key")
+	}
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	sig, err := minisignLine(signature, 1)
+	if err != nil || len(sig) != 74 || len(lines) < 4 {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	global, err := minisignLine(signature, 3)
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], pub[2:10]) {
+		return fmt.Errorf("signed with key %X instead of %X", sig[2:10], pub[2:10])
+	}
+
+	publicKey := ed25519.PublicKey(pub[10:])
+	message := data
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		hash := blake2b.Sum512(data)
+		message = hash[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(publicKey, message, sig[10:]) {
+		return fmt.Errorf("invalid signature")
+	}
+	comment, found := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !found || !ed25519.Verify(publicKey, append(append([]byte{}, sig[10:]...), comment...), global) {
+		return fmt.Errorf("invalid signature of the trusted comment")
+	}
+	return nil
+}
+
+// minisignLine decodes the base64 line n of a minisign key or signature,
+// whose first line is an untrusted comment
+func minisignLine(file []byte, n int) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(string(file)), "\n")
+	if len(lines) <= n {
+		return nil, fmt.Errorf("missing line %d", n+1)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(lines[n]))
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Sink sends the results of scheduled evaluations to another system. Every
+// sink has a queue, so a slow or unreachable sink doesn't delay the
+// evaluations; what happens while the queue is full is set by overflow.
+type Sink struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Targets limits the sink to these targets, all by default
+	Targets []string `yaml:"targets,omitempty"`
+	// QueueSize is the number of evaluations waiting to be sent, 100 by
+	// default
+	QueueSize int `yaml:"queue_size,omitempty"`
+	// Overflow is drop_newest (default) to drop evaluations arriving while
+	// the queue is full, drop_oldest to drop the oldest queued one instead,
+	// or block to hold up the evaluations of the targets until there is room
+	Overflow string `yaml:"overflow,omitempty"`
+	// BatchSize is the largest number of queued evaluations sent together by
+	// sinks that can combine them, like remote_write, 1 by default
+	BatchSize int `yaml:"batch_size,omitempty"`
+	// MaxRetries of failed writes, 0 by default, waiting RetryBackoff (1s by
+	// default) doubled after every attempt. They add to the retries of
+	// webhook and remote_write sinks.
+	MaxRetries   int           `yaml:"max_retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// WriteRelabelConfigs rewrite or drop the samples sent to the sink,
+	// without changing what probes return
+	WriteRelabelConfigs []RelabelConfig `yaml:"write_relabel_configs,omitempty"`
+
+	// Graphite configures graphite sinks
+	Graphite *GraphiteSink `yaml:"graphite,omitempty"`
+	// MQTT configures mqtt sinks
+	MQTT *MQTTSink `yaml:"mqtt,omitempty"`
+	// NATS configures nats sinks
+	NATS *NATSSink `yaml:"nats,omitempty"`
+	// RemoteWrite configures remote_write sinks
+	RemoteWrite *RemoteWriteSink `yaml:"remote_write,omitempty"`
+	// Webhook configures webhook sinks, like the webhooks of targets
+	Webhook *Webhook `yaml:"webhook,omitempty"`
+}
+
+const defaultSinkQueueSize = 100
+
+// sinkWriter sends evaluations. Writers connect on first use, constructing
+// one only validates the settings.
+type sinkWriter interface {
+	write(target string, eval evaluation) error
+	close()
+}
+
+// noRetryError is an error of a write that max_retries must not repeat,
+// like one rejected by the endpoint or kept in a WAL
+type noRetryError struct{ error }
+
+func (e noRetryError) Unwrap() error { return e.error }
+
+// batchWriter is a sinkWriter that can send several evaluations at once
+type batchWriter interface {
+	writeBatch(items []sinkItem) error
+}
+
+// sinkTypes are the constructors of the sink writers by type
+var sinkTypes = map[string]func(Sink) (sinkWriter, error){}
+
+func (s Sink) validate() error {
+	if s.Name == "" || strings.Contains(s.Name, "/") {
+		return fmt.Errorf("names must not be empty or contain /")
+	}
+	if s.QueueSize < 0 || s.BatchSize < 0 || s.MaxRetries < 0 || s.RetryBackoff < 0 {
+		return fmt.Errorf("queue_size, batch_size, max_retries and retry_backoff must not be negative")
+	}
+	switch s.Overflow {
+	case "", "drop_newest", "drop_oldest", "block":
+	default:
+		return fmt.Errorf("unknown overflow %q, expected drop_newest, drop_oldest or block", s.Overflow)
+	}
+	if _, err := compileRelabelConfigs(s.WriteRelabelConfigs); err != nil {
+		return fmt.Errorf("write_relabel_configs: %v", err)
+	}
+	_, err := newSinkWriter(s)
+	return err
+}
+
+func newSinkWriter(s Sink) (sinkWriter, error) {
+	newWriter, exists := sinkTypes[s.Type]
+	if !exists {
+		var types []string
+		for t := range sinkTypes {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return nil, fmt.Errorf("unknown type %q, expected one of %v", s.Type, types)
+	}
+	return newWriter(s)
+}
+
+var (
+	sinkWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_sink_writes_total",
+		Help: "Number of evaluations sent to the sink.",
+	}, []string{"sink"})
+	sinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_sink_errors_total",
+		Help: "Number of evaluations that failed to be sent to the sink.",
+	}, []string{"sink"})
+	sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_sink_dropped_total",
+		Help: "Number of evaluations dropped because the queue of the sink was full.",
+	}, []string{"sink"})
+	sinkQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_sink_queue_length",
+		Help: "Number of evaluations waiting in the queue of the sink.",
+	}, []string{"sink"})
+	sinkQueueCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_sink_queue_capacity",
+		Help: "Number of evaluations the queue of the sink holds.",
+	}, []string{"sink"})
+
+	sinksMu sync.Mutex
+	sinks   = map[string]*runningSink{}
+)
+
+func init() {
+	prometheus.MustRegister(sinkWrites, sinkErrors, sinkDropped, sinkQueueLength, sinkQueueCapacity)
+}
+
+// runningSink is a sink with its queue and the goroutine sending it
+type runningSink struct {
+	sink    Sink
+	key     string // the settings, to tell whether a reload changed them
+	targets map[string]bool
+	queue   chan sinkItem
+	relabel []relabeler
+	// stopped is closed when the sink is replaced, its goroutine sends what
+	// is queued then and stops
+	stopped chan struct{}
+	// done is closed once the goroutine has stopped
+	done chan struct{}
+}
+
+type sinkItem struct {
+	target string
+	eval   evaluation
+}
+
+// startSinks starts the sinks and the webhooks of the targets of config.
+// Sinks with unchanged settings keep running, the others are replaced after
+// sending their queue. A replacement only starts sending once the sink it
+// replaces has stopped, so they don't use the same WAL at the same time.
+func startSinks(config Config) error {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	next := map[string]*runningSink{}
+	for _, s := range append(append([]Sink{}, config.Sinks...), webhookSinks(config)...) {
+		data, _ := yaml.Marshal(s)
+		if running, exists := sinks[s.Name]; exists && running.key == string(data) {
+			next[s.Name] = running
+			continue
+		}
+		writer, err := newSinkWriter(s)
+		if err != nil {
+			return fmt.Errorf("sink %s: %v", s.Name, err)
+		}
+		size := s.QueueSize
+		if size == 0 {
+			size = defaultSinkQueueSize
+		}
+		relabelers, err := compileRelabelConfigs(s.WriteRelabelConfigs)
+		if err != nil {
+			return fmt.Errorf("sink %s: write_relabel_configs: %v", s.Name, err)
+		}
+		running := &runningSink{sink: s, key: string(data), queue: make(chan sinkItem, size), relabel: relabelers, stopped: make(chan struct{}), done: make(chan struct{})}
+		if len(s.Targets) > 0 {
+			running.targets = map[string]bool{}
+			for _, target := range s.Targets {
+				running.targets[target] = true
+			}
+		}
+		sinkQueueCapacity.WithLabelValues(s.Name).Set(float64(size))
+		var previous chan struct{}
+		if replaced, exists := sinks[s.Name]; exists {
+			previous = replaced.done
+		}
+		go running.run(writer, previous)
+		next[s.Name] = running
+	}
+	for name, running := range sinks {
+		if next[name] != running {
+			close(running.stopped)
+		}
+		if _, exists := next[name]; !exists {
+			sinkQueueLength.DeleteLabelValues(name)
+			sinkQueueCapacity.DeleteLabelValues(name)
+		}
+	}
+	sinks = next
+	return nil
+}
+
+// run sends the queued evaluations after the sink it replaces, whose done
+// channel is previous, has stopped
+func (r *runningSink) run(writer sinkWriter, previous chan struct{}) {
+	defer close(r.done)
+	defer writer.close()
+	if previous != nil {
+		<-previous
+	}
+	batchSize := max(r.sink.BatchSize, 1)
+	batcher, batches := writer.(batchWriter)
+	for {
+		var items []sinkItem
+		select {
+		case item := <-r.queue:
+			items = append(items, item)
+		case <-r.stopped:
+			// Send what is left in the queue
+			for {
+				select {
+				case item := <-r.queue:
+					item.eval = relabelEvaluation(r.relabel, item.target, item.eval)
+					r.send(writer, []sinkItem{item})
+				default:
+					return
+				}
+			}
+		}
+	batch:
+		for batches && len(items) < batchSize {
+			select {
+			case item := <-r.queue:
+				items = append(items, item)
+			default:
+				break batch
+			}
+		}
+		sinkQueueLength.WithLabelValues(r.sink.Name).Set(float64(len(r.queue)))
+		for i := range items {
+			items[i].eval = relabelEvaluation(r.relabel, items[i].target, items[i].eval)
+		}
+		if batches && len(items) > 1 {
+			r.retry(len(items), func() error { return batcher.writeBatch(items) })
+			continue
+		}
+		r.send(writer, items)
+	}
+}
+
+// send writes the evaluations one at a time
+func (r *runningSink) send(writer sinkWriter, items []sinkItem) {
+	for _, item := range items {
+		r.retry(1, func() error { return writer.write(item.target, item.eval) })
+	}
+}
+
+// retry runs a write of n evaluations up to max_retries more times until it
+// succeeds, and counts the outcome
+func (r *runningSink) retry(n int, write func() error) {
+	backoff := r.sink.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultWebhookBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil {
+			sinkWrites.WithLabelValues(r.sink.Name).Add(float64(n))
+			return
+		}
+		log.Printf("Error writing to sink %s: %v", r.sink.Name, err)
+		if attempt >= r.sink.MaxRetries || errors.As(err, new(noRetryError)) {
+			sinkErrors.WithLabelValues(r.sink.Name).Add(float64(n))
+			return
+		}
+		select {
+		case <-time.After(backoff << attempt):
+		case <-r.stopped:
+			// Don't hold up the replacement of the sink
+			sinkErrors.WithLabelValues(r.sink.Name).Add(float64(n))
+			return
+		}
+	}
+}
+
+// publishEvaluation queues a scheduled evaluation for the sinks of the target
+func publishEvaluation(target string, eval evaluation) {
+	sinksMu.Lock()
+	var targetSinks []*runningSink
+	for _, running := range sinks {
+		if running.targets == nil || running.targets[target] {
+			targetSinks = append(targetSinks, running)
+		}
+	}
+	sinksMu.Unlock()
+
+	item := sinkItem{target: target, eval: eval}
+	for _, running := range targetSinks {
+		running.enqueue(item)
+		sinkQueueLength.WithLabelValues(running.sink.Name).Set(float64(len(running.queue)))
+	}
+}
+
+// enqueue adds an evaluation to the queue, or handles a full queue as the
+// overflow of the sink says
+func (r *runningSink) enqueue(item sinkItem) {
+	switch r.sink.Overflow {
+	case "block":
+		select {
+		case r.queue <- item:
+		case <-r.stopped:
+			sinkDropped.WithLabelValues(r.sink.Name).Inc()
+		}
+		return
+	case "drop_oldest":
+		for {
+			select {
+			case r.queue <- item:
+				return
+			default:
+			}
+			select {
+			case <-r.queue:
+				sinkDropped.WithLabelValues(r.sink.Name).Inc()
+			default:
+			}
+		}
+	}
+	select {
+	case r.queue <- item:
+	default:
+		sinkDropped.WithLabelValues(r.sink.Name).Inc()
+	}
+}
+
+// flatSample is a single value of a sample, as metric name, labels and value
+type flatSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// flattenSample splits histograms and summaries into the series of their
+// text exposition. Native histograms only have their _count and _sum.
+func flattenSample(sample Sample) []flatSample {
+	with := func(name, value string) map[string]string {
+		labels := make(map[string]string, len(sample.Labels)+1)
+		for n, v := range sample.Labels {
+			labels[n] = v
+		}
+		labels[name] = value
+		return labels
+	}
+	switch {
+	case sample.Histogram != nil:
+		h := sample.Histogram
+		var bounds []float64
+		for le := range h.Buckets {
+			bounds = append(bounds, le)
+		}
+		sort.Float64s(bounds)
+		samples := make([]flatSample, 0, len(bounds)+3)
+		for _, le := range bounds {
+			samples = append(samples, flatSample{sample.Name + "_bucket", with("le", formatFloat(le)), float64(h.Buckets[le])})
+		}
+		return append(samples,
+			flatSample{sample.Name + "_bucket", with("le", "+Inf"), float64(h.Count)},
+			flatSample{sample.Name + "_sum", sample.Labels, h.Sum},
+			flatSample{sample.Name + "_count", sample.Labels, float64(h.Count)})
+	case sample.Summary != nil:
+		s := sample.Summary
+		var quantiles []float64
+		for q := range s.Quantiles {
+			quantiles = append(quantiles, q)
+		}
+		sort.Float64s(quantiles)
+		samples := make([]flatSample, 0, len(quantiles)+2)
+		for _, q := range quantiles {
+			samples = append(samples, flatSample{sample.Name, with("quantile", formatFloat(q)), s.Quantiles[q]})
+		}
+		return append(samples,
+			flatSample{sample.Name + "_sum", sample.Labels, s.Sum},
+			flatSample{sample.Name + "_count", sample.Labels, float64(s.Count)})
+	case sample.NativeHistogram != nil:
+		h := sample.NativeHistogram
+		return []flatSample{
+			{sample.Name + "_sum", sample.Labels, h.Sum},
+			{sample.Name + "_count", sample.Labels, h.Count},
+		}
+	}
+	return []flatSample{{sample.Name, sample.Labels, sample.Value}}
+}
+
+// sortedLabelNames returns the label names of a flat sample in order
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isFinite tells whether a value can be sent to systems without NaN and
+// infinities
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// topicMessages renders the topic template of every sample of an evaluation
+// and returns the samples of each topic, as JSON like format=json probes.
+// The template has .Target, .Name, .Rule and .Labels, escape cleans the
+// rendered topic.
+func topicMessages(topic *template.Template, target string, eval evaluation, escape func(string) string) (map[string][]byte, error) {
+	timestamp := float64(eval.Time.UnixMilli()) / 1000
+	byTopic := map[string]*jsonResponse{}
+	for _, sample := range eval.Samples {
+		var b strings.Builder
+		data := struct {
+			Target, Name, Rule string
+			Labels             map[string]string
+		}{target, sample.Name, sample.Rule, sample.Labels}
+		if err := topic.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		t := escape(b.String())
+		if byTopic[t] == nil {
+			byTopic[t] = &jsonResponse{Target: target}
+		}
+		byTopic[t].Samples = append(byTopic[t].Samples, toJSONSample(sample, timestamp))
+	}
+	messages := make(map[string][]byte, len(byTopic))
+	for t, response := range byTopic {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+		messages[t] = payload
+	}
+	return messages, nil
+}
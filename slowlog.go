@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// slowQueryThreshold is the duration above which queries are logged, 0
+	// disables the slow query log
+	slowQueryThreshold time.Duration
+
+	slowQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_slow_queries_total",
+		Help: "Number of queries that took longer than --log.slow-query-threshold.",
+	}, []string{"target", "rule"})
+)
+
+func init() {
+	prometheus.MustRegister(slowQueries)
+}
+
+// logSlowQuery logs and counts a query that took longer than the threshold
+func logSlowQuery(target string, group Group, rule Rule, query string, duration time.Duration, series int) {
+	if slowQueryThreshold <= 0 || duration < slowQueryThreshold {
+		return
+	}
+	slowQueries.WithLabelValues(target, ruleID(rule)).Inc()
+	log.Printf("Slow query: target=%s rule=%s duration=%s series=%d endpoint=%s query=%q",
+		target, ruleID(rule), duration.Round(time.Millisecond), series, group.Endpoint, query)
+}
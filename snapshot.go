@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// jsonSnapshot is the latest scheduled evaluation of a target. Timestamp is
+// null for targets that haven't been evaluated yet.
+type jsonSnapshot struct {
+	Timestamp *float64     `json:"timestamp"`
+	Errors    []RuleError  `json:"errors"`
+	Samples   []jsonSample `json:"samples"`
+}
+
+// snapshotHandler returns the latest evaluation of all targets, or of the
+// one given with ?target=, as JSON. Targets of tenants are only included
+// with the tenant's token, targets with a probe_token with that token.
+func snapshotHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		var targets []string
+		if target := r.URL.Query().Get("target"); target != "" {
+			if group, exists := config.Targets[target]; !exists || !tenantVisible(r, config, group) {
+				http.Error(w, "Target not found", http.StatusNotFound)
+				return
+			} else if !checkProbeToken(w, r, group) {
+				return
+			}
+			targets = []string{target}
+		} else {
+			for target, group := range config.Targets {
+				if tenantVisible(r, config, group) && probeAllowed(r, group) {
+					targets = append(targets, target)
+				}
+			}
+		}
+
+		response := struct {
+			Targets map[string]jsonSnapshot `json:"targets"`
+		}{Targets: map[string]jsonSnapshot{}}
+		for _, target := range targets {
+			eval := getEvaluation(target)
+			snapshot := jsonSnapshot{Errors: eval.Errors, Samples: []jsonSample{}}
+			if snapshot.Errors == nil {
+				snapshot.Errors = []RuleError{}
+			}
+			if !eval.Time.IsZero() {
+				timestamp := float64(eval.Time.UnixMilli()) / 1000
+				snapshot.Timestamp = &timestamp
+				for _, sample := range eval.Samples {
+					snapshot.Samples = append(snapshot.Samples, toJSONSample(sample, timestamp))
+				}
+			}
+			response.Targets[target] = snapshot
+		}
+
+		body, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeExposition(w, r, newExposition(body, "application/json"))
+	}
+}
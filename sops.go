@@ -0,0 +1,28 @@
+package main
+
+import "gopkg.in/yaml.v2"
+
+// sopsCommand decrypts configuration files encrypted with SOPS, set by
+// --config.sops-command
+var sopsCommand = "sops"
+
+// sopsEncrypted tells whether a YAML or JSON configuration file was
+// encrypted with SOPS, which keeps its metadata under sops
+func sopsEncrypted(data []byte) bool {
+	var file struct {
+		SOPS struct {
+			MAC     string `yaml:"mac"`
+			Version string `yaml:"version"`
+		} `yaml:"sops"`
+	}
+	return yaml.Unmarshal(data, &file) == nil && file.SOPS.MAC != "" && file.SOPS.Version != ""
+}
+
+// decryptSOPS decrypts the data of a configuration file with sopsCommand,
+// which takes the age, PGP or KMS keys from its environment, e.g.
+// SOPS_AGE_KEY_FILE or the AWS credentials
+func decryptSOPS(configFile string, data []byte) ([]byte, error) {
+	return withConfigCopy(configFile, data, func(file string) ([]byte, error) {
+		return runConfigCommand(sopsCommand, "--decrypt", file)
+	})
+}
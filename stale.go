@@ -0,0 +1,25 @@
+package main
+
+import "sync"
+
+var (
+	lastSamplesMu sync.Mutex
+	// lastSamples holds the samples of the last successful evaluation of
+	// every rule of targets with on_error: stale, keyed "target/record"
+	lastSamples = map[string][]Sample{}
+)
+
+// rememberSamples stores the samples of a successful rule evaluation
+func rememberSamples(target string, rule Rule, samples []Sample) {
+	lastSamplesMu.Lock()
+	defer lastSamplesMu.Unlock()
+	lastSamples[target+"/"+ruleID(rule)] = samples
+}
+
+// staleSamples returns the samples of the last successful evaluation of a
+// rule, nil if it never succeeded
+func staleSamples(target string, rule Rule) []Sample {
+	lastSamplesMu.Lock()
+	defer lastSamplesMu.Unlock()
+	return lastSamples[target+"/"+ruleID(rule)]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedState is what --scheduler.state-file keeps across restarts: the
+// latest evaluations, the totals of counter rules and the last samples of
+// rules of targets with on_error: stale
+type persistedState struct {
+	Evaluations map[string]evaluation
+	Counters    map[string]map[string]persistedCounter
+	LastSamples map[string][]Sample
+}
+
+type persistedCounter struct {
+	Last  float64
+	Total float64
+}
+
+// saveState writes the state to file, replacing it atomically
+func saveState(file string) error {
+	state := persistedState{
+		Evaluations: map[string]evaluation{},
+		Counters:    map[string]map[string]persistedCounter{},
+		LastSamples: map[string][]Sample{},
+	}
+	evaluationsMu.RLock()
+	for target, eval := range evaluations {
+		state.Evaluations[target] = eval
+	}
+	evaluationsMu.RUnlock()
+	countersMu.Lock()
+	for key, series := range counters {
+		persisted := make(map[string]persistedCounter, len(series))
+		for name, c := range series {
+			persisted[name] = persistedCounter{Last: c.last, Total: c.total}
+		}
+		state.Counters[key] = persisted
+	}
+	countersMu.Unlock()
+	lastSamplesMu.Lock()
+	for key, samples := range lastSamples {
+		state.LastSamples[key] = samples
+	}
+	lastSamplesMu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// loadState restores the state saved in file, which may not exist yet.
+// Evaluations older than maxAge are left out, they would be served as if
+// they were current.
+func loadState(file string, maxAge time.Duration) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state persistedState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	restored := 0
+	evaluationsMu.Lock()
+	for target, eval := range state.Evaluations {
+		if time.Since(eval.Time) <= maxAge {
+			evaluations[target] = eval
+			restored++
+		}
+	}
+	evaluationsMu.Unlock()
+	countersMu.Lock()
+	for key, series := range state.Counters {
+		restoredSeries := make(map[string]counterState, len(series))
+		for name, c := range series {
+			restoredSeries[name] = counterState{last: c.Last, total: c.Total}
+		}
+		counters[key] = restoredSeries
+	}
+	countersMu.Unlock()
+	lastSamplesMu.Lock()
+	for key, samples := range state.LastSamples {
+		lastSamples[key] = samples
+	}
+	lastSamplesMu.Unlock()
+	log.Printf("Restored %d evaluations and %d counter rules from %s", restored, len(state.Counters), file)
+	return nil
+}
+
+// persistState saves the state to file every interval until stop is closed,
+// and once more then
+func persistState(file string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := saveState(file); err != nil {
+				log.Printf("Error saving state: %v", err)
+			}
+			return
+		}
+		if err := saveState(file); err != nil {
+			log.Printf("Error saving state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SummaryValue holds the quantiles of a reconstructed summary
+type SummaryValue struct {
+	Quantiles map[float64]float64
+	Count     uint64
+	Sum       float64
+}
+
+// evaluateSummary builds summaries from a query returning quantile-labelled
+// series. Series with the same labels apart from quantile form one summary.
+// The _sum and _count come from the optional sum_expr and count_expr queries,
+// matched on the same labels; without them the sum is NaN and the count 0.
+func evaluateSummary(ctx context.Context, target string, group Group, rule Rule) ([]Sample, error) {
+	at := queryTime(rule)
+	results, err := runQuery(ctx, target, group, rule, rule.Expr, at)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := map[string]*Sample{}
+	var order []string
+	for _, result := range results {
+		labels, value := resultToSample(result)
+		quantile, err := strconv.ParseFloat(labels["quantile"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("quantile series %s has no valid quantile label", formatLabels(labels))
+		}
+		delete(labels, "quantile")
+
+		series := formatLabels(labels)
+		sample, exists := summaries[series]
+		if !exists {
+			sample = &Sample{
+				Name:    rule.Record,
+				Help:    fmt.Sprintf("Summary of Prometheus query: %s", rule.Expr),
+				Type:    prometheus.UntypedValue,
+				Labels:  labels,
+				Summary: &SummaryValue{Quantiles: map[float64]float64{}, Sum: math.NaN()},
+			}
+			summaries[series] = sample
+			order = append(order, series)
+		}
+		sample.Summary.Quantiles[quantile] = value
+	}
+
+	if rule.CountExpr != "" {
+		err := applySeriesQuery(ctx, target, group, rule, at, rule.CountExpr, summaries, func(s *Sample, v float64) {
+			s.Summary.Count = uint64(math.Round(v))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rule.SumExpr != "" {
+		err := applySeriesQuery(ctx, target, group, rule, at, rule.SumExpr, summaries, func(s *Sample, v float64) {
+			s.Summary.Sum = v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(order)
+	samples := make([]Sample, 0, len(order))
+	for _, series := range order {
+		samples = append(samples, *summaries[series])
+	}
+	return samples, nil
+}
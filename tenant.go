@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tenant is a team sharing the exporter. Probes of its targets need its
+// token and are limited separately from other tenants.
+type Tenant struct {
+	// Token must be sent in the X-Tenant-Token header of probes
+	Token string `yaml:"token"`
+	// MaxConcurrentProbes limits the probes running at the same time, 0 is
+	// unlimited
+	MaxConcurrentProbes int `yaml:"max_concurrent_probes,omitempty"`
+	// RateLimit is the number of probes per second allowed, 0 is unlimited
+	RateLimit float64 `yaml:"rate_limit,omitempty"`
+	// RateBurst is the number of probes allowed in a burst above the rate
+	RateBurst int `yaml:"rate_burst,omitempty"`
+}
+
+func (t Tenant) validate() error {
+	if t.Token == "" {
+		return fmt.Errorf("missing token")
+	}
+	if t.MaxConcurrentProbes < 0 || t.RateLimit < 0 || t.RateBurst < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+var (
+	tenantProbes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_tenant_probes_total",
+		Help: "Number of probes admitted for the targets of the tenant.",
+	}, []string{"tenant"})
+	tenantProbesInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_tenant_probes_in_flight",
+		Help: "Number of probes of the tenant currently running.",
+	}, []string{"tenant"})
+	tenantProbesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_tenant_probes_rejected_total",
+		Help: "Number of probes of the tenant rejected by reason.",
+	}, []string{"tenant", "reason"})
+
+	tenantLimitsMu sync.Mutex
+	tenantLimits   = map[string]*tenantLimit{}
+)
+
+func init() {
+	prometheus.MustRegister(tenantProbes, tenantProbesInFlight, tenantProbesRejected)
+}
+
+// tenantLimit holds the limiter state of a tenant. It is kept across reloads
+// as long as the tenant's settings don't change.
+type tenantLimit struct {
+	tenant  Tenant
+	slots   chan struct{} // nil without a concurrency limit
+	limiter *rateLimiter
+}
+
+func tenantLimitFor(name string, tenant Tenant) *tenantLimit {
+	tenantLimitsMu.Lock()
+	defer tenantLimitsMu.Unlock()
+	if l, exists := tenantLimits[name]; exists && l.tenant == tenant {
+		return l
+	}
+	l := &tenantLimit{tenant: tenant, limiter: newRateLimiter(tenant.RateLimit, max(tenant.RateBurst, 1))}
+	if tenant.MaxConcurrentProbes > 0 {
+		l.slots = make(chan struct{}, tenant.MaxConcurrentProbes)
+	}
+	tenantLimits[name] = l
+	return l
+}
+
+// admitTenant checks the tenant token and limits of a probe of the group. It
+// writes an error response and returns false if the probe is rejected, and
+// otherwise a function to call once the probe is done.
+func admitTenant(w http.ResponseWriter, r *http.Request, config Config, group Group) (func(), bool) {
+	if group.Tenant == "" {
+		return func() {}, true
+	}
+	name := group.Tenant
+	tenant := config.Tenants[name]
+
+	token := r.Header.Get("X-Tenant-Token")
+	if token == "" {
+		tenantProbesRejected.WithLabelValues(name, "token").Inc()
+		http.Error(w, "Missing tenant token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(tenant.Token)) != 1 {
+		tenantProbesRejected.WithLabelValues(name, "token").Inc()
+		http.Error(w, "Invalid tenant token", http.StatusForbidden)
+		return nil, false
+	}
+
+	limit := tenantLimitFor(name, tenant)
+	if limit.limiter != nil {
+		if ok, wait := limit.limiter.allow(name); !ok {
+			tenantProbesRejected.WithLabelValues(name, "rate").Inc()
+			tooManyRequests(w, "tenant", wait)
+			return nil, false
+		}
+	}
+	if limit.slots != nil {
+		select {
+		case limit.slots <- struct{}{}:
+		default:
+			tenantProbesRejected.WithLabelValues(name, "concurrency").Inc()
+			http.Error(w, "Too many concurrent probes for this tenant", http.StatusTooManyRequests)
+			return nil, false
+		}
+	}
+
+	tenantProbes.WithLabelValues(name).Inc()
+	tenantProbesInFlight.WithLabelValues(name).Inc()
+	return func() {
+		tenantProbesInFlight.WithLabelValues(name).Dec()
+		if limit.slots != nil {
+			<-limit.slots
+		}
+	}, true
+}
+
+// tenantVisible reports whether the results of the group may be shown to the
+// request, which requires the tenant token for targets of a tenant
+func tenantVisible(r *http.Request, config Config, group Group) bool {
+	if group.Tenant == "" {
+		return true
+	}
+	token := r.Header.Get("X-Tenant-Token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Tenants[group.Tenant].Token)) == 1
+}
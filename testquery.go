@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testQueryCommand evaluates a single rule against its endpoint, bypassing the
+// cache, and prints every stage of the result
+func testQueryCommand(args []string) error {
+	fs := flag.NewFlagSet("test-query", flag.ExitOnError)
+	configFile := configFlags(fs)
+	target := fs.String("target", "", "Target containing the rule.")
+	record := fs.String("rule", "", "Record name of the rule to run, or its expression if it has no record.")
+	fs.Parse(args)
+
+	if *target == "" || *record == "" {
+		return fmt.Errorf("--target and --rule are required")
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	group, exists := config.Targets[*target]
+	if !exists {
+		return fmt.Errorf("target %q not found", *target)
+	}
+
+	var rule *Rule
+	for i := range group.Rules {
+		if ruleID(group.Rules[i]) == *record {
+			rule = &group.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return fmt.Errorf("rule %q not found in target %q", *record, *target)
+	}
+
+	if c := rule.Compute; c != nil {
+		fmt.Printf("Compute:  %s %s %s\n\n", c.Left, c.Op, c.Right)
+		samples, err := evaluateWithDependencies(context.Background(), *target, group, *rule)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported:\n")
+		for _, sample := range samples {
+			printSample(sample)
+		}
+		return nil
+	}
+
+	datasource, err := newDatasource(group)
+	if err != nil {
+		return err
+	}
+	if group.Endpoint != "" {
+		fmt.Printf("Endpoint: %s\n", group.Endpoint)
+	} else {
+		fmt.Printf("Type:     %s\n", group.Type)
+	}
+	fmt.Printf("Query:    %s\n", rule.Expr)
+	at := queryTime(*rule)
+	if !at.IsZero() {
+		fmt.Printf("Time:     %s\n", at.Format(time.RFC3339))
+	}
+	fmt.Println()
+
+	var results []map[string]interface{}
+	if _, ok := datasource.(prometheusDatasource); ok {
+		body, err := fetchQuery(context.Background(), group, rule.Expr, at)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Raw response:\n%s\n\n", strings.TrimSpace(string(body)))
+		var warnings []string
+		results, warnings, err = parseQueryResponse(body)
+		if err != nil {
+			return err
+		}
+		for _, warning := range warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+	} else if results, err = queryRule(context.Background(), datasource, *rule, rule.Expr, at); err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsed samples (%d):\n", len(results))
+	for _, result := range results {
+		labels, _ := resultToSample(result)
+		value := result["value"]
+		if h, exists := result["histogram"]; exists {
+			value = h
+		}
+		fmt.Printf("  %s %v\n", formatLabels(labels), value)
+	}
+
+	samples, err := evaluateRule(context.Background(), *target, group, *rule)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nExported:\n")
+	for _, sample := range samples {
+		printSample(sample)
+	}
+	return nil
+}
+
+// printSample prints a sample in a format close to the text exposition
+func printSample(sample Sample) {
+	if sample.NativeHistogram != nil {
+		fmt.Printf("  %s%s %v\n", sample.Name, formatLabels(sample.Labels), sample.NativeHistogram)
+		return
+	}
+
+	if s := sample.Summary; s != nil {
+		var quantiles []float64
+		for q := range s.Quantiles {
+			quantiles = append(quantiles, q)
+		}
+		sort.Float64s(quantiles)
+
+		for _, q := range quantiles {
+			labels := prometheus.Labels{"quantile": strconv.FormatFloat(q, 'g', -1, 64)}
+			for k, v := range sample.Labels {
+				labels[k] = v
+			}
+			fmt.Printf("  %s%s %g\n", sample.Name, formatLabels(labels), s.Quantiles[q])
+		}
+		fmt.Printf("  %s_sum%s %g\n", sample.Name, formatLabels(sample.Labels), s.Sum)
+		fmt.Printf("  %s_count%s %d\n", sample.Name, formatLabels(sample.Labels), s.Count)
+		return
+	}
+
+	h := sample.Histogram
+	if h == nil {
+		fmt.Printf("  %s%s %g\n", sample.Name, formatLabels(sample.Labels), sample.Value)
+		return
+	}
+
+	var bounds []float64
+	for le := range h.Buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+
+	bucket := func(le string, count uint64) {
+		labels := prometheus.Labels{"le": le}
+		for k, v := range sample.Labels {
+			labels[k] = v
+		}
+		fmt.Printf("  %s_bucket%s %d\n", sample.Name, formatLabels(labels), count)
+	}
+	for _, le := range bounds {
+		bucket(strconv.FormatFloat(le, 'g', -1, 64), h.Buckets[le])
+	}
+	bucket("+Inf", h.Count)
+	fmt.Printf("  %s_sum%s %g\n", sample.Name, formatLabels(sample.Labels), h.Sum)
+	fmt.Printf("  %s_count%s %d\n", sample.Name, formatLabels(sample.Labels), h.Count)
+}
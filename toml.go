@@ -0,0 +1,517 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tomlToYAML converts a .toml configuration file to YAML. The TOML has the
+// structure of the YAML configuration, tables for mappings and arrays of
+// tables for lists like [[targets.example.rules]], durations are strings.
+// Dates and times are kept as strings.
+func tomlToYAML(data []byte) ([]byte, error) {
+	config, err := parseTOML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(config)
+}
+
+// tomlParser parses TOML 1.0 into maps, slices and scalars
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+	root map[string]interface{}
+	// current is the table of the last [table] or [[array]] header
+	current map[string]interface{}
+	// headers are the tables defined by a header, which can't be defined
+	// again
+	headers map[string]bool
+	// arrays are the arrays of tables defined by [[array]] headers, static
+	// arrays can't be extended by them
+	arrays map[string]bool
+}
+
+func parseTOML(s string) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	p := &tomlParser{s: s, line: 1, root: root, current: root, headers: map[string]bool{}, arrays: map[string]bool{}}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("line %d: %v", p.line, err)
+	}
+	return root, nil
+}
+
+func (p *tomlParser) parse() error {
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.s) {
+			return nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.s[p.pos:], "[["):
+			p.pos += 2
+			err = p.arrayTable()
+		case p.s[p.pos] == '[':
+			p.pos++
+			err = p.table()
+		default:
+			err = p.keyValue(p.current)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *tomlParser) table() error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	if err := p.expect("]"); err != nil {
+		return err
+	}
+	name := strings.Join(path, "\x00")
+	if p.headers[name] {
+		return fmt.Errorf("table [%s] defined twice", strings.Join(path, "."))
+	}
+	p.headers[name] = true
+	t, err := p.tables(p.root, path)
+	if err != nil {
+		return err
+	}
+	p.current = t
+	return nil
+}
+
+func (p *tomlParser) arrayTable() error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	if err := p.expect("]]"); err != nil {
+		return err
+	}
+	parent, err := p.tables(p.root, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	last := path[len(path)-1]
+	name := strings.Join(path, "\x00")
+	array, ok := parent[last].([]interface{})
+	if parent[last] != nil && (!ok || !p.arrays[name]) {
+		return fmt.Errorf("%s is not an array of tables", strings.Join(path, "."))
+	}
+	// The tables below the previous element may be defined again
+	prefix := name + "\x00"
+	for name := range p.headers {
+		if strings.HasPrefix(name, prefix) {
+			delete(p.headers, name)
+		}
+	}
+	for name := range p.arrays {
+		if strings.HasPrefix(name, prefix) {
+			delete(p.arrays, name)
+		}
+	}
+	p.arrays[name] = true
+	t := map[string]interface{}{}
+	parent[last] = append(array, t)
+	p.current = t
+	return nil
+}
+
+// tables returns the table at path below t, creating missing tables. The
+// last element of an array of tables stands for the array.
+func (p *tomlParser) tables(t map[string]interface{}, path []string) (map[string]interface{}, error) {
+	for i, key := range path {
+		switch v := t[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			t[key] = next
+			t = next
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			var next map[string]interface{}
+			if len(v) > 0 {
+				next, _ = v[len(v)-1].(map[string]interface{})
+			}
+			if next == nil {
+				return nil, fmt.Errorf("%s is not a table", strings.Join(path[:i+1], "."))
+			}
+			t = next
+		default:
+			return nil, fmt.Errorf("%s is not a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	return t, nil
+}
+
+func (p *tomlParser) keyValue(t map[string]interface{}) error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	t, err = p.tables(t, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	last := path[len(path)-1]
+	if _, exists := t[last]; exists {
+		return fmt.Errorf("%s defined twice", strings.Join(path, "."))
+	}
+	t[last] = value
+	return nil
+}
+
+// key parses a bare, quoted or dotted key
+func (p *tomlParser) key() ([]string, error) {
+	var path []string
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("missing key")
+		}
+		switch c := p.s[p.pos]; {
+		case c == '"':
+			p.pos++
+			key, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, key)
+		case c == '\'':
+			p.pos++
+			key, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, key)
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && isBareKeyChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("invalid key at %q", p.rest())
+			}
+			path = append(path, p.s[start:p.pos])
+		}
+		p.skipSpace(false)
+		if p.pos >= len(p.s) || p.s[p.pos] != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("missing value")
+	}
+	rest := p.s[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, `"""`):
+		p.pos += 3
+		return p.multilineString(`"""`)
+	case strings.HasPrefix(rest, "'''"):
+		p.pos += 3
+		return p.multilineString("'''")
+	case rest[0] == '"':
+		p.pos++
+		return p.basicString()
+	case rest[0] == '\'':
+		p.pos++
+		return p.literalString()
+	case rest[0] == '[':
+		p.pos++
+		return p.array()
+	case rest[0] == '{':
+		p.pos++
+		return p.inlineTable()
+	}
+	return p.scalar()
+}
+
+func (p *tomlParser) array() (interface{}, error) {
+	array := []interface{}{}
+	for {
+		p.skipSpace(true)
+		if p.pos < len(p.s) && p.s[p.pos] == ']' {
+			p.pos++
+			break
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		p.skipSpace(true)
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		break
+	}
+	return array, nil
+}
+
+func (p *tomlParser) inlineTable() (interface{}, error) {
+	t := map[string]interface{}{}
+	p.skipSpace(false)
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+		break
+	}
+	return t, nil
+}
+
+// basicString parses a "string" after the opening quote
+func (p *tomlParser) basicString() (string, error) {
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\n':
+			return "", fmt.Errorf("unterminated string")
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// literalString parses a 'string' after the opening quote
+func (p *tomlParser) literalString() (string, error) {
+	end := strings.IndexAny(p.s[p.pos:], "'\n")
+	if end < 0 || p.s[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// multilineString parses a string after the opening """ or ”'
+func (p *tomlParser) multilineString(delim string) (string, error) {
+	// A newline right after the delimiter is trimmed
+	if strings.HasPrefix(p.s[p.pos:], "\r\n") {
+		p.pos += 2
+	} else if strings.HasPrefix(p.s[p.pos:], "\n") {
+		p.pos++
+	}
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		if strings.HasPrefix(p.s[p.pos:], delim) {
+			p.pos += len(delim)
+			// Up to two quotes before the delimiter belong to the string
+			for i := 0; i < 2 && p.pos < len(p.s) && p.s[p.pos] == delim[0]; i++ {
+				b.WriteByte(p.s[p.pos])
+				p.pos++
+			}
+			return b.String(), nil
+		}
+		c := p.s[p.pos]
+		switch {
+		case c == '\\' && delim == `"""`:
+			// A backslash at the end of a line trims the whitespace after it
+			i := p.pos + 1
+			for i < len(p.s) && (p.s[i] == ' ' || p.s[i] == '\t') {
+				i++
+			}
+			if i < len(p.s) && (p.s[i] == '\n' || p.s[i] == '\r') {
+				p.pos = i
+				for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+					if p.s[p.pos] == '\n' {
+						p.line++
+					}
+					p.pos++
+				}
+				continue
+			}
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+var tomlEscapes = map[byte]string{'b': "\b", 't': "\t", 'n': "\n", 'f': "\f", 'r': "\r", '"': `"`, '\\': `\`}
+
+// escape writes the escape sequence at the backslash at pos
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.s) {
+		return fmt.Errorf("unterminated string")
+	}
+	c := p.s[p.pos+1]
+	if s, exists := tomlEscapes[c]; exists {
+		b.WriteString(s)
+		p.pos += 2
+		return nil
+	}
+	digits := map[byte]int{'u': 4, 'U': 8}[c]
+	if digits == 0 || p.pos+2+digits > len(p.s) {
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	code, err := strconv.ParseUint(p.s[p.pos+2:p.pos+2+digits], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(code)) {
+		return fmt.Errorf("invalid escape \\%s", p.s[p.pos+1:p.pos+2+digits])
+	}
+	b.WriteRune(rune(code))
+	p.pos += 2 + digits
+	return nil
+}
+
+// scalar parses booleans, numbers and dates, which are kept as strings
+func (p *tomlParser) scalar() (interface{}, error) {
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n,]}#", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	token := p.s[start:p.pos]
+	// A space may separate the date and time of a date-time
+	if len(token) == 10 && token[4] == '-' && p.pos+1 < len(p.s) && p.s[p.pos] == ' ' && '0' <= p.s[p.pos+1] && p.s[p.pos+1] <= '9' {
+		p.pos++
+		for p.pos < len(p.s) && strings.IndexByte(" \t\r\n,]}#", p.s[p.pos]) < 0 {
+			p.pos++
+		}
+		token = p.s[start:p.pos]
+	}
+
+	switch token {
+	case "":
+		return nil, fmt.Errorf("missing value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	}
+	if len(token) >= 8 && (token[4] == '-' || token[2] == ':') {
+		return token, nil
+	}
+
+	number := strings.ReplaceAll(token, "_", "")
+	for prefix, base := range map[string]int{"0x": 16, "0o": 8, "0b": 2} {
+		if strings.HasPrefix(number, prefix) {
+			i, err := strconv.ParseInt(number[2:], base, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer %q", token)
+			}
+			return i, nil
+		}
+	}
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil && strings.ContainsAny(number, ".eE") {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q, strings need quotes", token)
+}
+
+// skipSpace skips whitespace and comments, and newlines if newlines is set
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.s) {
+		switch c := p.s[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.line++
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine requires the rest of the line to be empty or a comment
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q", p.rest())
+	}
+	return nil
+}
+
+func (p *tomlParser) expect(token string) error {
+	p.skipSpace(false)
+	if !strings.HasPrefix(p.s[p.pos:], token) {
+		return fmt.Errorf("expected %s at %q", token, p.rest())
+	}
+	p.pos += len(token)
+	return nil
+}
+
+// rest returns the rest of the line for errors
+func (p *tomlParser) rest() string {
+	rest := p.s[p.pos:]
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+func isBareKeyChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-'
+}
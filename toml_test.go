@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]interface{}
+	}{
+		{
+			name:  "scalars",
+			input: "a = 1\nb = -2_000\nc = 0x1f\nd = 1.5\ne = 1e3\nf = true\ng = false\nh = inf\n",
+			want: map[string]interface{}{
+				"a": int64(1), "b": int64(-2000), "c": int64(31), "d": 1.5, "e": 1000.0,
+				"f": true, "g": false, "h": math.Inf(1),
+			},
+		},
+		{
+			name:  "dates are strings",
+			input: "a = 1979-05-27\nb = 1979-05-27T07:32:00Z\nc = 1979-05-27 07:32:00\nd = 07:32:00\n",
+			want: map[string]interface{}{
+				"a": "1979-05-27", "b": "1979-05-27T07:32:00Z", "c": "1979-05-27 07:32:00", "d": "07:32:00",
+			},
+		},
+		{
+			name:  "strings",
+			input: `a = "tab\tquote\" \u00e9"` + "\nb = 'C:\\path'\nc = \"\"\"\nline 1\nline 2\"\"\"\nd = '''\nraw \\n'''\ne = \"\"\"one \\\n    two\"\"\"\n",
+			want: map[string]interface{}{
+				"a": "tab\tquote\" é", "b": `C:\path`, "c": "line 1\nline 2", "d": `raw \n`, "e": "one two",
+			},
+		},
+		{
+			name:  "comments and blank lines",
+			input: "# comment\n\na = 1 # trailing\n  \n",
+			want:  map[string]interface{}{"a": int64(1)},
+		},
+		{
+			name:  "dotted and quoted keys",
+			input: "a.b = 1\na.\"c.d\" = 2\n'e f' = 3\n",
+			want: map[string]interface{}{
+				"a":   map[string]interface{}{"b": int64(1), "c.d": int64(2)},
+				"e f": int64(3),
+			},
+		},
+		{
+			name:  "arrays and inline tables",
+			input: "a = [1, 2,\n  3,]\nb = []\nc = {x = 1, y.z = \"v\"}\nd = [{n = 1}, {n = 2}]\n",
+			want: map[string]interface{}{
+				"a": []interface{}{int64(1), int64(2), int64(3)},
+				"b": []interface{}{},
+				"c": map[string]interface{}{"x": int64(1), "y": map[string]interface{}{"z": "v"}},
+				"d": []interface{}{map[string]interface{}{"n": int64(1)}, map[string]interface{}{"n": int64(2)}},
+			},
+		},
+		{
+			name:  "tables and arrays of tables",
+			input: "[targets.a]\nendpoint = \"x\"\n\n[[targets.a.rules]]\nrecord = \"r1\"\n[targets.a.rules.labels]\nk = \"v\"\n\n[[targets.a.rules]]\nrecord = \"r2\"\n[targets.a.rules.labels]\nk = \"w\"\n",
+			want: map[string]interface{}{
+				"targets": map[string]interface{}{
+					"a": map[string]interface{}{
+						"endpoint": "x",
+						"rules": []interface{}{
+							map[string]interface{}{"record": "r1", "labels": map[string]interface{}{"k": "v"}},
+							map[string]interface{}{"record": "r2", "labels": map[string]interface{}{"k": "w"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseTOML(test.input)
+			if err != nil {
+				t.Fatalf("parseTOML: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseTOML =\n%#v\nwant\n%#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"a = 1\na = 2\n", "line 2: a defined twice"},
+		{"[t]\n[t]\n", "line 2: table [t] defined twice"},
+		{"a = 1\n[a]\n", "line 2: a is not a table"},
+		{"a = [1]\n[[a]]\n", "line 2: a is not an array of tables"},
+		{"a = \"open\n", "line 1: unterminated string"},
+		{"a = bare\n", `line 1: invalid value "bare", strings need quotes`},
+		{"a = 1 b = 2\n", "line 1"},
+		{"a =\n", "line 1: missing value"},
+		{"a = \"\\q\"\n", `line 1: invalid escape \q`},
+		{"= 1\n", "line 1: invalid key"},
+		{"a = [1, 2\n", "line 2"},
+	}
+	for _, test := range tests {
+		_, err := parseTOML(test.input)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("parseTOML(%q) error = %v, want %s", test.input, err, test.err)
+		}
+	}
+}
+
+func TestTOMLToYAMLConfig(t *testing.T) {
+	input := `
+[targets.api]
+endpoint = "http://localhost:9090"
+
+[[targets.api.rules]]
+record = "job:up:sum"
+expr = 'sum by (job) (up{job="api"})'
+interval = "30s"
+`
+	data, err := tomlToYAML([]byte(input))
+	if err != nil {
+		t.Fatalf("tomlToYAML: %v", err)
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		t.Fatalf("decoding the converted configuration: %v\n%s", err, data)
+	}
+	group := config.Targets["api"]
+	if group.Endpoint != "http://localhost:9090" {
+		t.Errorf("endpoint = %q", group.Endpoint)
+	}
+	if len(group.Rules) != 1 || group.Rules[0].Record != "job:up:sum" || group.Rules[0].Expr != `sum by (job) (up{job="api"})` || group.Rules[0].Interval != 30*time.Second {
+		t.Errorf("rules = %+v", group.Rules)
+	}
+}
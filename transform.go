@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BoolMapping turns a value into 1 if it compares true against the threshold
+// and 0 otherwise
+type BoolMapping struct {
+	Operator  string  `yaml:"operator"`
+	Threshold float64 `yaml:"threshold"`
+}
+
+func (b BoolMapping) validate() error {
+	switch b.Operator {
+	case "==", "!=", ">", ">=", "<", "<=":
+		return nil
+	}
+	return fmt.Errorf("unknown bool operator %q", b.Operator)
+}
+
+func (b BoolMapping) apply(v float64) float64 {
+	var result bool
+	switch b.Operator {
+	case "==":
+		result = v == b.Threshold
+	case "!=":
+		result = v != b.Threshold
+	case ">":
+		result = v > b.Threshold
+	case ">=":
+		result = v >= b.Threshold
+	case "<":
+		result = v < b.Threshold
+	case "<=":
+		result = v <= b.Threshold
+	}
+	if result {
+		return 1
+	}
+	return 0
+}
+
+// Precision rounds values to a number of decimal places or significant
+// digits, exactly one of which must be set
+type Precision struct {
+	Decimals          *int `yaml:"decimals,omitempty"`
+	SignificantDigits int  `yaml:"significant_digits,omitempty"`
+}
+
+func (p Precision) validate() error {
+	switch {
+	case p.Decimals != nil && p.SignificantDigits != 0:
+		return fmt.Errorf("precision can't set both decimals and significant_digits")
+	case p.Decimals != nil && *p.Decimals < 0:
+		return fmt.Errorf("precision decimals must not be negative")
+	case p.Decimals == nil && p.SignificantDigits < 1:
+		return fmt.Errorf("precision needs decimals or a positive significant_digits")
+	}
+	return nil
+}
+
+// apply rounds through the decimal representation, so the result is the
+// float closest to the rounded decimal number
+func (p Precision) apply(v float64) float64 {
+	var s string
+	if p.Decimals != nil {
+		s = strconv.FormatFloat(v, 'f', *p.Decimals, 64)
+	} else {
+		s = strconv.FormatFloat(v, 'g', p.SignificantDigits, 64)
+	}
+	rounded, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return v
+	}
+	return rounded
+}
+
+// transformValue applies the value conversions configured for a rule
+func transformValue(rule Rule, v float64) float64 {
+	if conversion, exists := unitConversions[rule.Unit]; exists {
+		v *= conversion.factor
+	}
+	if rule.Bool != nil {
+		v = rule.Bool.apply(v)
+	}
+	if rule.Precision != nil {
+		v = rule.Precision.apply(v)
+	}
+	return v
+}
+
+// unitConversion scales values from one unit to another
+type unitConversion struct {
+	from   string
+	to     string
+	factor float64
+}
+
+// unitConversions lists the supported values of the unit option
+var unitConversions = map[string]unitConversion{
+	"bytes_to_mebibytes":      {"bytes", "mebibytes", 1.0 / (1 << 20)},
+	"bytes_to_gibibytes":      {"bytes", "gibibytes", 1.0 / (1 << 30)},
+	"seconds_to_milliseconds": {"seconds", "milliseconds", 1000},
+	"ratio_to_percent":        {"ratio", "percent", 100},
+}
+
+// ruleMetricName returns the exported name of a rule. With a unit conversion
+// the source unit suffix of the record is replaced by the target unit, or the
+// target unit is appended, keeping a trailing _total last.
+func ruleMetricName(rule Rule) string {
+	conversion, exists := unitConversions[rule.Unit]
+	if !exists {
+		return rule.Record
+	}
+
+	name := rule.Record
+	total := strings.HasSuffix(name, "_total")
+	name = strings.TrimSuffix(name, "_total")
+	if !strings.HasSuffix(name, "_"+conversion.to) {
+		name = strings.TrimSuffix(name, "_"+conversion.from) + "_" + conversion.to
+	}
+	if total {
+		name += "_total"
+	}
+	return name
+}
+
+// ruleID identifies a rule in logs, metrics and evaluation state: its record,
+// or its expression if it exports the upstream metric names
+func ruleID(rule Rule) string {
+	if rule.Record == "" {
+		return rule.Expr
+	}
+	return rule.Record
+}
+
+// ruleHelp returns the HELP text of a rule
+func ruleHelp(rule Rule) string {
+	help := fmt.Sprintf("Value of Prometheus query: %s", rule.Expr)
+	if c := rule.Compute; c != nil {
+		help = fmt.Sprintf("Computed from rules: %s %s %s", c.Left, c.Op, c.Right)
+	}
+	if conversion, exists := unitConversions[rule.Unit]; exists {
+		help += fmt.Sprintf(" (converted from %s to %s)", conversion.from, conversion.to)
+	}
+	return help
+}
+
+// OnEmpty is what a rule exports when its query returns no series: skip
+// (nothing), zero or {value: N}, a single series without labels
+type OnEmpty struct {
+	Value *float64 `yaml:"value"`
+}
+
+func (o *OnEmpty) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var keyword string
+	if err := unmarshal(&keyword); err == nil {
+		switch keyword {
+		case "skip":
+			*o = OnEmpty{}
+		case "zero":
+			zero := 0.0
+			*o = OnEmpty{Value: &zero}
+		default:
+			return fmt.Errorf("unknown on_empty %q, expected skip, zero or value: N", keyword)
+		}
+		return nil
+	}
+
+	type plain OnEmpty
+	if err := unmarshal((*plain)(o)); err != nil {
+		return err
+	}
+	if o.Value == nil {
+		return fmt.Errorf("on_empty needs a value")
+	}
+	return nil
+}
+
+func (o OnEmpty) MarshalYAML() (interface{}, error) {
+	switch {
+	case o.Value == nil:
+		return "skip", nil
+	case *o.Value == 0:
+		return "zero", nil
+	}
+	return struct {
+		Value float64 `yaml:"value"`
+	}{*o.Value}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ruleErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rules_exporter_rule_errors_total",
+	Help: "Number of failed rule evaluations by reason: dns, connect, tls, timeout, http_4xx, http_5xx, parse, api_error or other.",
+}, []string{"target", "rule", "reason"})
+
+func init() {
+	prometheus.MustRegister(ruleErrors)
+}
+
+// apiError is a response of the query API with status error
+type apiError struct {
+	errorType string
+	message   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("query failed: %s: %s", e.errorType, e.message)
+}
+
+// httpStatusError is an error status without an API error in the body, as
+// returned by proxies and load balancers
+type httpStatusError struct {
+	code int
+	body string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.code, e.body)
+}
+
+// parseError is a response that isn't a valid instant query result
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "invalid response: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// responseError returns the error of an unsuccessful query response with the
+// given status code and body
+func responseError(code int, body []byte) error {
+	var response struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}
+	if json.Unmarshal(body, &response) == nil && response.Status == "error" {
+		return &apiError{errorType: response.ErrorType, message: response.Error}
+	}
+	text := strings.TrimSpace(string(body))
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	return &httpStatusError{code: code, body: text}
+}
+
+// classifyError returns the reason label of a rule error
+func classifyError(err error) string {
+	var (
+		api       *apiError
+		status    *httpStatusError
+		parse     *parseError
+		dns       *net.DNSError
+		verify    *tls.CertificateVerificationError
+		authority x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		header    tls.RecordHeaderError
+		alert     tls.AlertError
+		netErr    net.Error
+		opErr     *net.OpError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &api):
+		return "api_error"
+	case errors.As(err, &status):
+		if status.code >= 500 {
+			return "http_5xx"
+		}
+		return "http_4xx"
+	case errors.As(err, &parse), errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "parse"
+	case errors.As(err, &dns):
+		return "dns"
+	case errors.As(err, &verify), errors.As(err, &authority), errors.As(err, &hostname),
+		errors.As(err, &invalid), errors.As(err, &header), errors.As(err, &alert):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	}
+	return "other"
+}
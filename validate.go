@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// validateCommand checks the configuration file and with --execute runs
+// every rule once against its endpoint, printing whether it succeeded, the
+// number of series and the label names they have
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := configFlags(fs)
+	execute := fs.Bool("execute", false, "Run every rule once against its endpoint.")
+	target := fs.String("target", "", "Only run the rules of this target with --execute.")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	rules := 0
+	for _, group := range config.Targets {
+		rules += len(group.Rules)
+	}
+	fmt.Printf("%s is valid: %d targets, %d rules\n", *configFile, len(config.Targets), rules)
+	if !*execute {
+		return nil
+	}
+
+	var names []string
+	for name, group := range config.Targets {
+		if len(group.AggregateOf) == 0 && (*target == "" || name == *target) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && *target != "" {
+		return fmt.Errorf("target %q not found", *target)
+	}
+	sort.Strings(names)
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tRULE\tSTATUS\tSERIES\tLABELS")
+	var failures []string
+	executed := 0
+	for _, name := range names {
+		group := config.Targets[name]
+		outputs := ruleOutputs{}
+		for _, rule := range prioritizedRules(group.Rules) {
+			executed++
+			var samples []Sample
+			if rule.Compute != nil {
+				samples, err = computeRule(rule, outputs)
+			} else {
+				samples, err = evaluateRule(context.Background(), name, group, rule)
+			}
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\tfailed\t-\t-\n", name, ruleID(rule))
+				failures = append(failures, fmt.Sprintf("%s, rule %s: %v", name, ruleID(rule), err))
+				continue
+			}
+			outputs.add(rule, samples)
+			labels := map[string]bool{}
+			for _, sample := range samples {
+				for label := range sample.Labels {
+					labels[label] = true
+				}
+			}
+			var labelNames []string
+			for label := range labels {
+				labelNames = append(labelNames, label)
+			}
+			sort.Strings(labelNames)
+			fmt.Fprintf(w, "%s\t%s\tok\t%d\t%s\n", name, ruleID(rule), len(samples), strings.Join(labelNames, ","))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		fmt.Println()
+		for _, failure := range failures {
+			fmt.Printf("target %s\n", failure)
+		}
+		return fmt.Errorf("%d of %d rules failed", len(failures), executed)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const verifyTimeout = 10 * time.Second
+
+// verifyEndpoints checks that the endpoint of every target answers, and
+// with buildinfo that Prometheus targets serve /api/v1/status/buildinfo,
+// logging the version. Targets without endpoint, like exec and cloud
+// datasources, are skipped. It returns the failures by target.
+func verifyEndpoints(config Config, buildinfo bool) map[string]error {
+	var mu sync.Mutex
+	failures := map[string]error{}
+	var wg sync.WaitGroup
+	for name, group := range config.Targets {
+		if group.Endpoint == "" || len(group.AggregateOf) > 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+			defer cancel()
+			prometheus := group.Type == "" || group.Type == "prometheus"
+			var err error
+			if buildinfo && prometheus {
+				var version string
+				if version, err = fetchBuildinfo(ctx, group); err == nil {
+					log.Printf("Target %s: %s runs version %s", name, group.Endpoint, version)
+				}
+			} else {
+				err = checkReachable(ctx, group)
+			}
+			if err != nil {
+				mu.Lock()
+				failures[name] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// checkReachable requests the endpoint of a group. Any HTTP response counts,
+// the endpoint may not serve its root.
+func checkReachable(ctx context.Context, group Group) error {
+	client, err := clientFor(group)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, group.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// fetchBuildinfo returns the version a Prometheus compatible endpoint
+// reports
+func fetchBuildinfo(ctx context.Context, group Group) (string, error) {
+	client, err := clientFor(group)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, group.Endpoint+"/api/v1/status/buildinfo", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 400 {
+		return "", responseError(resp.StatusCode, body)
+	}
+	var response struct {
+		Status string `json:"status"`
+		Data   struct {
+			Version string `json:"version"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", &parseError{err}
+	}
+	if response.Status != "success" {
+		return "", responseError(resp.StatusCode, body)
+	}
+	return response.Data.Version, nil
+}
+
+// verifyStartup runs verifyEndpoints and logs the failures, and with the
+// policy fail returns an error if there are any
+func verifyStartup(config Config, buildinfo bool, policy string) error {
+	failures := verifyEndpoints(config, buildinfo)
+	var names []string
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Target %s: endpoint %s failed verification: %v", name, config.Targets[name].Endpoint, failures[name])
+	}
+	if len(failures) > 0 && policy == "fail" {
+		return fmt.Errorf("%d targets failed verification", len(failures))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	walBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rules_exporter_sink_wal_bytes",
+		Help: "Size of the requests waiting in the write-ahead log of the sink.",
+	}, []string{"sink"})
+	walDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rules_exporter_sink_wal_dropped_total",
+		Help: "Number of requests dropped from the write-ahead log of the sink because it was full or the endpoint rejected them.",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(walBytes, walDropped)
+}
+
+// writeAheadLog keeps requests that could not be sent in a directory, one
+// file per request named by its sequence number, so they survive restarts.
+// It is opened on first use and only used by the goroutine of its sink.
+type writeAheadLog struct {
+	sink    string
+	dir     string
+	maxSize int64
+
+	opened  bool
+	entries []walEntry // oldest first
+	size    int64
+	next    uint64
+}
+
+type walEntry struct {
+	seq  uint64
+	size int64
+}
+
+const walSuffix = ".req"
+
+func (l *writeAheadLog) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+// open reads the requests left by a previous run
+func (l *writeAheadLog) open() error {
+	if l.opened {
+		return nil
+	}
+	if err := os.MkdirAll(l.dir, 0o700); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), walSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), walSuffix) {
+			// Like the temporary files of an interrupted append
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return err
+		}
+		l.entries = append(l.entries, walEntry{seq: seq, size: info.Size()})
+		l.size += info.Size()
+	}
+	sort.Slice(l.entries, func(i, j int) bool { return l.entries[i].seq < l.entries[j].seq })
+	if len(l.entries) > 0 {
+		l.next = l.entries[len(l.entries)-1].seq + 1
+		log.Printf("Sink %s has %d requests in its WAL %s", l.sink, len(l.entries), l.dir)
+	}
+	l.opened = true
+	walBytes.WithLabelValues(l.sink).Set(float64(l.size))
+	return nil
+}
+
+func (l *writeAheadLog) len() int {
+	return len(l.entries)
+}
+
+// append adds a request, dropping the oldest ones while the WAL is larger
+// than its maximum size
+func (l *writeAheadLog) append(data []byte) error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(l.dir, "append*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path(l.next)); err != nil {
+		return err
+	}
+	l.entries = append(l.entries, walEntry{seq: l.next, size: int64(len(data))})
+	l.size += int64(len(data))
+	l.next++
+	for l.size > l.maxSize && len(l.entries) > 1 {
+		l.remove()
+		walDropped.WithLabelValues(l.sink).Inc()
+	}
+	walBytes.WithLabelValues(l.sink).Set(float64(l.size))
+	return nil
+}
+
+// replay sends the requests in order until one fails with an error that may
+// be retried, which is returned. Requests the endpoint rejects are dropped.
+func (l *writeAheadLog) replay(send func([]byte) (bool, error)) error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	defer func() { walBytes.WithLabelValues(l.sink).Set(float64(l.size)) }()
+	for len(l.entries) > 0 {
+		data, err := os.ReadFile(l.path(l.entries[0].seq))
+		if err != nil {
+			return err
+		}
+		retry, err := send(data)
+		if err != nil && retry {
+			return err
+		}
+		if err != nil {
+			log.Printf("Sink %s dropped a request of its WAL: %v", l.sink, err)
+			walDropped.WithLabelValues(l.sink).Inc()
+		}
+		l.remove()
+	}
+	return nil
+}
+
+// remove deletes the oldest request
+func (l *writeAheadLog) remove() {
+	entry := l.entries[0]
+	if err := os.Remove(l.path(entry.seq)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing request from WAL of sink %s: %v", l.sink, err)
+	}
+	l.entries = l.entries[1:]
+	l.size -= entry.size
+}
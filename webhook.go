@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Webhook posts the results of scheduled evaluations of a target as JSON:
+//
+//	{"target": "a", "timestamp": 1700000000, "samples": [...], "errors": [...]}
+//
+// with the samples like format=json probes and the failed rules.
+type Webhook struct {
+	URL       string            `yaml:"url"`
+	Headers   map[string]string `yaml:"headers,omitempty"`
+	TLSConfig *TLSConfig        `yaml:"tls_config,omitempty"`
+	// Secret signs the body with HMAC-SHA256, sent as sha256=<hex> in the
+	// X-Rules-Exporter-Signature header
+	Secret string `yaml:"secret,omitempty"`
+	// Rules limits the samples to those of these rules
+	Rules []string `yaml:"rules,omitempty"`
+	// Breach only sends the samples whose value compares true against the
+	// threshold, and nothing if there are none
+	Breach *BoolMapping `yaml:"breach,omitempty"`
+	// Retries of failed deliveries, 3 by default, waiting RetryBackoff (1s by
+	// default) doubled after every attempt. Responses with status 4xx apart
+	// from 429 are not retried.
+	Retries      *int          `yaml:"retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// Timeout of every attempt, 10s by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+type webhookPayload struct {
+	Target    string       `json:"target"`
+	Timestamp float64      `json:"timestamp"`
+	Samples   []jsonSample `json:"samples"`
+	Errors    []RuleError  `json:"errors"`
+}
+
+func init() {
+	sinkTypes["webhook"] = newWebhookWriter
+}
+
+type webhookWriter struct {
+	config Webhook
+	client *http.Client
+	rules  map[string]bool
+}
+
+func newWebhookWriter(s Sink) (sinkWriter, error) {
+	if s.Webhook == nil {
+		return nil, fmt.Errorf("webhook sinks need webhook settings")
+	}
+	return newWebhook(*s.Webhook)
+}
+
+func newWebhook(config Webhook) (*webhookWriter, error) {
+	if err := validateEndpoint(config.URL); err != nil {
+		return nil, fmt.Errorf("webhook url: %v", err)
+	}
+	if config.Breach != nil {
+		if err := config.Breach.validate(); err != nil {
+			return nil, fmt.Errorf("webhook breach: %v", err)
+		}
+	}
+	if config.Retries != nil && *config.Retries < 0 || config.RetryBackoff < 0 || config.Timeout < 0 {
+		return nil, fmt.Errorf("webhook retries, retry_backoff and timeout must not be negative")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TLSConfig != nil {
+		tlsConfig, err := config.TLSConfig.tlsClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	w := &webhookWriter{config: config, client: &http.Client{Transport: transport, Timeout: config.Timeout}}
+	if len(config.Rules) > 0 {
+		w.rules = map[string]bool{}
+		for _, rule := range config.Rules {
+			w.rules[rule] = true
+		}
+	}
+	return w, nil
+}
+
+// webhookSinks returns the webhooks of the targets as sinks of their target
+func webhookSinks(config Config) []Sink {
+	var names []string
+	for name := range config.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sinks []Sink
+	for _, name := range names {
+		for i, webhook := range config.Targets[name].Webhooks {
+			webhook := webhook
+			sinks = append(sinks, Sink{
+				Name:    fmt.Sprintf("%s/webhook-%d", name, i+1),
+				Type:    "webhook",
+				Targets: []string{name},
+				Webhook: &webhook,
+			})
+		}
+	}
+	return sinks
+}
+
+func (w *webhookWriter) write(target string, eval evaluation) error {
+	timestamp := float64(eval.Time.UnixMilli()) / 1000
+	payload := webhookPayload{Target: target, Timestamp: timestamp, Samples: []jsonSample{}, Errors: []RuleError{}}
+	for _, sample := range eval.Samples {
+		if w.rules != nil && !w.rules[sample.Rule] {
+			continue
+		}
+		if w.config.Breach != nil && !w.breaches(sample) {
+			continue
+		}
+		payload.Samples = append(payload.Samples, toJSONSample(sample, timestamp))
+	}
+	if w.config.Breach != nil && len(payload.Samples) == 0 {
+		return nil
+	}
+	for _, e := range eval.Errors {
+		if w.rules == nil || w.rules[e.Rule] {
+			payload.Errors = append(payload.Errors, e)
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	retries := defaultWebhookRetries
+	if w.config.Retries != nil {
+		retries = *w.config.Retries
+	}
+	backoff := w.config.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultWebhookBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err != nil && !retry {
+			return noRetryError{err}
+		}
+		if err == nil || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff << attempt)
+	}
+}
+
+// breaches tells whether the value of a gauge or counter sample compares
+// true against the threshold
+func (w *webhookWriter) breaches(sample Sample) bool {
+	if sample.Histogram != nil || sample.Summary != nil || sample.NativeHistogram != nil {
+		return false
+	}
+	return w.config.Breach.apply(sample.Value) == 1
+}
+
+// post sends the body once and tells whether a failure may be retried
+func (w *webhookWriter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rules_exporter")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Rules-Exporter-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, responseError(resp.StatusCode, data)
+}
+
+func (w *webhookWriter) close() {
+	w.client.CloseIdleConnections()
+}